@@ -0,0 +1,296 @@
+package iscsi
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	redactedSecret = "<redacted>"
+)
+
+// Account is a CHAP account bound to a target. Outgoing accounts are used by
+// the target to authenticate itself to the initiators, i.e. mutual CHAP.
+type Account struct {
+	User     string
+	Outgoing bool
+}
+
+// executeWithSecret executes tgtadm with the secret in opts, the secret is
+// redacted from the error, which carries the arguments and the output
+func (t *Tgtd) executeWithSecret(opts []string, secret string) (string, error) {
+	output, err := t.execute(opts)
+	if err != nil && secret != "" {
+		return "", fmt.Errorf("%s", strings.Replace(err.Error(), secret, redactedSecret, -1))
+	}
+	return output, err
+}
+
+// CreateAccount creates the CHAP account, which can be shared by the targets
+// once it's bound to them by BindAccount. The password is never logged, but
+// tgtadm only takes it on the command line, so it's visible in
+// /proc/<pid>/cmdline to the other processes of the node while tgtadm runs.
+func (t *Tgtd) CreateAccount(user, password string) error {
+	if user == "" || password == "" {
+		return fmt.Errorf("Both user and password are required by the account")
+	}
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "new",
+		"--mode", "account",
+		"--user", user,
+		"--password", password,
+	}
+	_, err := t.executeWithSecret(opts, password)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteAccount deletes the CHAP account, it's unbound from all the targets
+func (t *Tgtd) DeleteAccount(user string) error {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "delete",
+		"--mode", "account",
+		"--user", user,
+	}
+	_, err := t.execute(opts)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// UpdateAccountPassword changes the password of the CHAP account. tgtd has
+// no update of the accounts, so the account is recreated and bound to the
+// same targets again. A temporary account with a random password is bound to
+// the targets in the meantime, so they keep requiring CHAP instead of
+// accepting any initiator. If the account fails to be recreated or bound, the
+// error names the targets left bound to the temporary account. The password
+// is exposed the same as CreateAccount.
+func (t *Tgtd) UpdateAccountPassword(user, password string) error {
+	if password == "" {
+		return fmt.Errorf("Both user and password are required by the account")
+	}
+	bindings, err := t.getAccountBindings(user)
+	if err != nil {
+		return err
+	}
+	tids := []int{}
+	for tid := range bindings {
+		tids = append(tids, tid)
+	}
+	sort.Ints(tids)
+
+	tmpUser, tmpPassword, err := newTemporaryAccount(user)
+	if err != nil {
+		return err
+	}
+	if err := t.CreateAccount(tmpUser, tmpPassword); err != nil {
+		return err
+	}
+	for _, tid := range tids {
+		if bindings[tid] {
+			// Only the incoming accounts guard the logins
+			continue
+		}
+		if err := t.BindAccount(tid, tmpUser, false); err != nil {
+			if deleteErr := t.DeleteAccount(tmpUser); deleteErr != nil {
+				return fmt.Errorf("Failed to bind temporary account %v to target %v: %v, and failed to delete it: %v", tmpUser, tid, err, deleteErr)
+			}
+			return fmt.Errorf("Failed to bind temporary account %v to target %v: %v", tmpUser, tid, err)
+		}
+	}
+
+	if err := t.DeleteAccount(user); err != nil {
+		return failAccountUpdate(user, tmpUser, tids, err)
+	}
+	if err := t.CreateAccount(user, password); err != nil {
+		return failAccountUpdate(user, tmpUser, tids, err)
+	}
+	for i, tid := range tids {
+		if err := t.BindAccount(tid, user, bindings[tid]); err != nil {
+			return failAccountUpdate(user, tmpUser, tids[i:], err)
+		}
+	}
+	return t.DeleteAccount(tmpUser)
+}
+
+// failAccountUpdate keeps the temporary account bound so the targets still
+// require CHAP, and returns the error naming the targets the account isn't
+// bound to
+func failAccountUpdate(user, tmpUser string, unbound []int, err error) error {
+	return fmt.Errorf("Failed to update the password of account %v, it's not bound to targets %v, which are guarded by temporary account %v instead: %v",
+		user, unbound, tmpUser, err)
+}
+
+// newTemporaryAccount returns the user and the random password of the
+// temporary account replacing user during the update
+func newTemporaryAccount(user string) (string, string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", fmt.Errorf("Failed to generate temporary account: %v", err)
+	}
+	secret := hex.EncodeToString(buf)
+	return user + "-tmp-" + secret[:8], secret, nil
+}
+
+// ListAccounts returns the users of the CHAP accounts
+func (t *Tgtd) ListAccounts() ([]string, error) {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "show",
+		"--mode", "account",
+	}
+	output, err := t.execute(opts)
+	if err != nil {
+		return nil, err
+	}
+	return parseAccounts(output), nil
+}
+
+func parseAccounts(output string) []string {
+	/* Output will looks like:
+	Account list:
+	    user1
+	    user2
+	*/
+	res := []string{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasSuffix(line, ":") {
+			continue
+		}
+		res = append(res, line)
+	}
+	return res
+}
+
+// BindAccount binds the CHAP account to the target. Only one outgoing
+// account can be bound to a target.
+func (t *Tgtd) BindAccount(tid int, user string, outgoing bool) error {
+	return t.bindAccount("bind", tid, user, outgoing)
+}
+
+// UnbindAccount unbinds the CHAP account from the target
+func (t *Tgtd) UnbindAccount(tid int, user string, outgoing bool) error {
+	return t.bindAccount("unbind", tid, user, outgoing)
+}
+
+func (t *Tgtd) bindAccount(op string, tid int, user string, outgoing bool) error {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", op,
+		"--mode", "account",
+		"--tid", strconv.Itoa(tid),
+		"--user", user,
+	}
+	if outgoing {
+		opts = append(opts, "--outgoing")
+	}
+	_, err := t.execute(opts)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetTargetAccounts returns the CHAP accounts bound to the target
+func (t *Tgtd) GetTargetAccounts(tid int) ([]*Account, error) {
+	output, err := t.showTargets()
+	if err != nil {
+		return nil, err
+	}
+	accounts, err := parseTargetAccounts(output)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := accounts[tid]; !ok {
+		return nil, fmt.Errorf("Cannot find target %v", tid)
+	}
+	return accounts[tid], nil
+}
+
+// getAccountBindings returns the targets the account is bound to, mapped to
+// whether it's bound as the outgoing account
+func (t *Tgtd) getAccountBindings(user string) (map[int]bool, error) {
+	output, err := t.showTargets()
+	if err != nil {
+		return nil, err
+	}
+	accounts, err := parseTargetAccounts(output)
+	if err != nil {
+		return nil, err
+	}
+	res := map[int]bool{}
+	for tid, list := range accounts {
+		for _, account := range list {
+			if account.User == user {
+				res[tid] = account.Outgoing
+			}
+		}
+	}
+	return res, nil
+}
+
+func (t *Tgtd) showTargets() (string, error) {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "show",
+		"--mode", "target",
+	}
+	return t.execute(opts)
+}
+
+func parseTargetAccounts(output string) (map[int][]*Account, error) {
+	/* Output will looks like:
+	Target 1: iqn.2016-08.com.example:a
+	    ...
+	    Account information:
+	        user1
+	        user2 (outgoing)
+	    ACL information:
+	        ALL
+	*/
+	res := map[int][]*Account{}
+	tid := 0
+	inAccounts := false
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "Target ") {
+			fields := strings.SplitN(strings.TrimPrefix(line, "Target "), ":", 2)
+			id, err := strconv.Atoi(fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("BUG: Fail to parse %s, %v", line, err)
+			}
+			tid = id
+			res[tid] = []*Account{}
+			inAccounts = false
+			continue
+		}
+		line = strings.TrimSpace(line)
+		if strings.HasSuffix(line, " information:") {
+			inAccounts = line == "Account information:"
+			continue
+		}
+		if !inAccounts || line == "" {
+			continue
+		}
+		account := &Account{User: line}
+		if strings.HasSuffix(line, " (outgoing)") {
+			account.User = strings.TrimSuffix(line, " (outgoing)")
+			account.Outgoing = true
+		}
+		res[tid] = append(res[tid], account)
+	}
+	return res, nil
+}
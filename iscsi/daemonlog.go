@@ -0,0 +1,58 @@
+package iscsi
+
+import (
+	"strings"
+	"sync"
+)
+
+var (
+	// DaemonLogLines is how many recent lines of the tgtd output are kept
+	// in memory, see GetDaemonLogs
+	DaemonLogLines = 200
+)
+
+// lineBuffer is an io.Writer keeping the last lines written to it
+type lineBuffer struct {
+	lock    sync.Mutex
+	lines   []string
+	partial string
+}
+
+func newLineBuffer() *lineBuffer {
+	return &lineBuffer{}
+}
+
+func (b *lineBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	data := b.partial + string(p)
+	lines := strings.Split(data, "\n")
+	b.partial = lines[len(lines)-1]
+	b.lines = append(b.lines, lines[:len(lines)-1]...)
+	if len(b.lines) > DaemonLogLines {
+		b.lines = append([]string{}, b.lines[len(b.lines)-DaemonLogLines:]...)
+	}
+	return len(p), nil
+}
+
+// last returns at most n recent lines, including the unterminated one
+func (b *lineBuffer) last(n int) []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	lines := b.lines
+	if b.partial != "" {
+		lines = append(append([]string{}, lines...), b.partial)
+	}
+	if n > 0 && len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return append([]string{}, lines...)
+}
+
+// GetDaemonLogs returns at most n recent lines of the output of the tgtd
+// started by StartDaemon in this process, or all the kept lines if n <= 0
+func (t *Tgtd) GetDaemonLogs(n int) []string {
+	return t.logs.last(n)
+}
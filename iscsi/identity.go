@@ -0,0 +1,163 @@
+package iscsi
+
+import (
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/longhorn/go-iscsi-helper/util"
+)
+
+const (
+	// tgtDefaultSerialFormat is the serial tgtd assigns to the LUNs without
+	// scsi_sn, which is derived from the TID and the LUN only
+	tgtDefaultSerialFormat = "beaf%d%d"
+
+	lunSerialPrefix = "lh"
+)
+
+// DeviceIdentity is the identity of the SCSI device of an iSCSI LUN reported
+// by sysfs, which tells what the kernel device actually is
+type DeviceIdentity struct {
+	Target string
+	LUN    int
+	Major  int
+	Minor  int
+	// Serial is the unit serial number from the VPD page 0x80, empty if the
+	// device doesn't report it
+	Serial string
+}
+
+// GetLunSerial returns the serial number of the LUN of the target, set as
+// scsi_sn by SetLunSerial. It's derived from the target name, so it stays the
+// same across the restarts and the TID changes, unlike the default one.
+func GetLunSerial(target string, lun int) string {
+	h := fnv.New64a()
+	h.Write([]byte(target))
+	return fmt.Sprintf("%s%016x%02x", lunSerialPrefix, h.Sum64(), lun)
+}
+
+// getDefaultLunSerial returns the default serial tgtd assigns to the LUN of
+// the TID, e.g. the LUN was created without SetLunSerial
+func getDefaultLunSerial(tid, lun int) string {
+	return fmt.Sprintf(tgtDefaultSerialFormat, tid, lun)
+}
+
+// SetLunSerial sets the unit serial number reported by the LUN, which must be
+// done before the initiators login
+func (t *Tgtd) SetLunSerial(tid int, lun int, serial string) error {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "update",
+		"--mode", "logicalunit",
+		"--tid", strconv.Itoa(tid),
+		"--lun", strconv.Itoa(lun),
+		"--params", "scsi_sn=" + serial,
+	}
+	_, err := t.execute(opts)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetDeviceIdentity reads the identity of the SCSI device from sysfs in the
+// namespace of ne
+func GetDeviceIdentity(dev *util.KernelDevice, ne *util.NamespaceExecutor) (*DeviceIdentity, error) {
+	identity := &DeviceIdentity{}
+
+	devNumber, err := readSysfs(filepath.Join("/sys/block", dev.Name, "dev"), ne)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Sscanf(devNumber, "%d:%d", &identity.Major, &identity.Minor); err != nil {
+		return nil, fmt.Errorf("Invalid device number %v of %v: %v", devNumber, dev.Name, err)
+	}
+
+	devicePath, err := ne.Execute("readlink", []string{"-f", getScsiDeviceSysfsDir(dev.Name)})
+	if err != nil {
+		return nil, err
+	}
+	sid, lun, err := parseScsiDevicePath(strings.TrimSpace(devicePath))
+	if err != nil {
+		return nil, err
+	}
+	identity.LUN = lun
+	if identity.Target, err = readSysfs(filepath.Join(iscsiSessionSysfsDir, "session"+sid, "targetname"), ne); err != nil {
+		return nil, err
+	}
+
+	// Not all the devices report the VPD page 0x80
+	if vpd, err := ne.Execute("cat", []string{filepath.Join(getScsiDeviceSysfsDir(dev.Name), "vpd_pg80")}); err == nil {
+		if identity.Serial, err = parseVPDSerial(vpd); err != nil {
+			return nil, err
+		}
+	}
+	return identity, nil
+}
+
+func parseScsiDevicePath(path string) (string, int, error) {
+	/* The path will looks like:
+	/sys/devices/platform/host3/session1/target3:0:0/3:0:0:1
+	*/
+	sid := ""
+	for _, component := range strings.Split(path, "/") {
+		if strings.HasPrefix(component, "session") {
+			sid = strings.TrimPrefix(component, "session")
+		}
+	}
+	if sid == "" {
+		return "", 0, fmt.Errorf("Device %v is not a device of any iSCSI session", path)
+	}
+	hctl := strings.Split(filepath.Base(path), ":")
+	if len(hctl) != 4 {
+		return "", 0, fmt.Errorf("Invalid SCSI address of device %v", path)
+	}
+	lun, err := strconv.Atoi(hctl[3])
+	if err != nil {
+		return "", 0, fmt.Errorf("Invalid LUN of device %v: %v", path, err)
+	}
+	return sid, lun, nil
+}
+
+// parseVPDSerial parses the unit serial number out of the raw VPD page 0x80,
+// which has a 4 bytes header with the page length
+func parseVPDSerial(vpd string) (string, error) {
+	if len(vpd) < 4 || vpd[1] != 0x80 {
+		return "", fmt.Errorf("Invalid VPD page 0x80 %q", vpd)
+	}
+	length := int(vpd[2])<<8 | int(vpd[3])
+	if len(vpd) < 4+length {
+		return "", fmt.Errorf("Truncated VPD page 0x80 %q", vpd)
+	}
+	return strings.TrimSpace(strings.Trim(vpd[4:4+length], "\x00")), nil
+}
+
+// VerifyDeviceIdentity verifies the device is the LUN of the target, so a
+// device renamed or renumbered after being resolved is never used as another
+// one. The target and the LUN of the session only catch a reused device name,
+// it's the serial that ties the device to the LUN the target exported, so it's
+// verified if it's not empty. The default serial of tgtd, e.g. of the LUNs
+// created by the older versions, is only accepted for the TID the target is
+// exported with, and not at all if tid is 0, i.e. unknown.
+func VerifyDeviceIdentity(dev *util.KernelDevice, target string, lun, tid int, serial string, ne *util.NamespaceExecutor) error {
+	identity, err := GetDeviceIdentity(dev, ne)
+	if err != nil {
+		return fmt.Errorf("Failed to get identity of device %v: %v", dev.Name, err)
+	}
+	if identity.Major != dev.Major || identity.Minor != dev.Minor {
+		return fmt.Errorf("Device %v is %v:%v rather than the resolved %v:%v", dev.Name, identity.Major, identity.Minor, dev.Major, dev.Minor)
+	}
+	if identity.Target != target || identity.LUN != lun {
+		return fmt.Errorf("Device %v is LUN %v of target %v rather than LUN %v of target %v", dev.Name, identity.LUN, identity.Target, lun, target)
+	}
+	if serial == "" || identity.Serial == serial {
+		return nil
+	}
+	if tid != 0 && identity.Serial == getDefaultLunSerial(tid, lun) {
+		return nil
+	}
+	return fmt.Errorf("Device %v reports serial %v rather than %v", dev.Name, identity.Serial, serial)
+}
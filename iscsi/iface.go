@@ -0,0 +1,258 @@
+package iscsi
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+
+	"github.com/longhorn/go-iscsi-helper/util"
+)
+
+const (
+	IfaceDefault = "default"
+
+	TransportTCP    = "tcp"
+	TransportBnx2i  = "bnx2i"
+	TransportQedi   = "qedi"
+	TransportCxgb4i = "cxgb4i"
+
+	iscsiuioBinary = "iscsiuio"
+)
+
+// offloadTransports are the hardware offload transports supported, mapped to
+// whether they depend on iscsiuio for the network stack in the userspace
+var offloadTransports = map[string]bool{
+	TransportBnx2i:  true,
+	TransportQedi:   true,
+	TransportCxgb4i: false,
+}
+
+// Iface is an iface record listed by iscsiadm
+type Iface struct {
+	Name          string
+	Transport     string
+	HWAddress     string
+	IPAddress     string
+	NetIfaceName  string
+	InitiatorName string
+}
+
+// IsIfaceExisting checks if the iface record exists
+func IsIfaceExisting(iface string, ne *util.NamespaceExecutor) bool {
+	opts := []string{
+		"-m", "iface",
+		"-I", iface,
+	}
+	_, err := ne.Execute(iscsiBinary, opts)
+	return err == nil
+}
+
+// CreateIface creates the iface record
+func CreateIface(iface string, ne *util.NamespaceExecutor) error {
+	opts := []string{
+		"-m", "iface",
+		"-I", iface,
+		"-o", "new",
+	}
+	_, err := ne.Execute(iscsiBinary, opts)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteIface deletes the iface record
+func DeleteIface(iface string, ne *util.NamespaceExecutor) error {
+	opts := []string{
+		"-m", "iface",
+		"-I", iface,
+		"-o", "delete",
+	}
+	_, err := ne.Execute(iscsiBinary, opts)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// UpdateIfaceParam updates the parameter of the iface record, e.g.
+// iface.net_ifacename
+func UpdateIfaceParam(iface, name, value string, ne *util.NamespaceExecutor) error {
+	opts := []string{
+		"-m", "iface",
+		"-I", iface,
+		"-o", "update",
+		"-n", name,
+		"-v", value,
+	}
+	_, err := ne.Execute(iscsiBinary, opts)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// SetupIface creates the iface if it doesn't exist, and binds it to the
+// network interface netIfaceName or the NIC with hwAddress. Either of them
+// can be empty.
+func SetupIface(iface, netIfaceName, hwAddress string, ne *util.NamespaceExecutor) error {
+	if !IsIfaceExisting(iface, ne) {
+		if err := CreateIface(iface, ne); err != nil {
+			return err
+		}
+	}
+	if netIfaceName != "" {
+		if err := UpdateIfaceParam(iface, "iface.net_ifacename", netIfaceName, ne); err != nil {
+			return err
+		}
+	}
+	if hwAddress != "" {
+		if err := UpdateIfaceParam(iface, "iface.hwaddress", hwAddress, ne); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsOffloadTransport returns true if the transport is a supported hardware
+// offload transport
+func IsOffloadTransport(transport string) bool {
+	_, ok := offloadTransports[transport]
+	return ok
+}
+
+// CheckOffloadTransport verifies the kernel module of the offload transport
+// is loaded, and iscsiuio is running if the transport depends on it
+func CheckOffloadTransport(transport string, ne *util.NamespaceExecutor) error {
+	needIscsiuio, ok := offloadTransports[transport]
+	if !ok {
+		return fmt.Errorf("Unsupported offload transport %v", transport)
+	}
+	if _, err := ne.Execute("ls", []string{"/sys/module/" + transport}); err != nil {
+		return fmt.Errorf("Kernel module %v of the offload transport is not loaded: %v", transport, err)
+	}
+	if needIscsiuio {
+		if _, err := ne.Execute("pgrep", []string{"-x", iscsiuioBinary}); err != nil {
+			return fmt.Errorf("%v is not running, which is required by the offload transport %v", iscsiuioBinary, transport)
+		}
+	}
+	return nil
+}
+
+// SetupOffloadIface creates the iface of the offload transport if it doesn't
+// exist, and binds it to the offload NIC with hwAddress. The offload NIC has
+// its own network stack, so ipAddress is assigned to the iface rather than
+// the network interface. ipAddress can be empty if it's already configured,
+// e.g. by DHCP of iscsiuio.
+func SetupOffloadIface(iface, transport, hwAddress, ipAddress string, ne *util.NamespaceExecutor) error {
+	if err := CheckOffloadTransport(transport, ne); err != nil {
+		return err
+	}
+	if !IsIfaceExisting(iface, ne) {
+		if err := CreateIface(iface, ne); err != nil {
+			return err
+		}
+	}
+	if err := UpdateIfaceParam(iface, "iface.transport_name", transport, ne); err != nil {
+		return err
+	}
+	if hwAddress != "" {
+		if err := UpdateIfaceParam(iface, "iface.hwaddress", hwAddress, ne); err != nil {
+			return err
+		}
+	}
+	if ipAddress != "" {
+		if err := UpdateIfaceParam(iface, "iface.ipaddress", ipAddress, ne); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListIfaces returns the iface records, including the ones of the offload
+// NICs created by iscsiadm automatically
+func ListIfaces(ne *util.NamespaceExecutor) ([]*Iface, error) {
+	opts := []string{
+		"-m", "iface",
+	}
+	output, err := ne.Execute(iscsiBinary, opts)
+	if err != nil {
+		return nil, err
+	}
+	return parseIfaces(output), nil
+}
+
+func parseIfaces(output string) []*Iface {
+	/* Output will looks like:
+	default tcp,<empty>,<empty>,<empty>,<empty>
+	bnx2i.00:10:18:aa:bb:cc bnx2i,00:10:18:aa:bb:cc,10.0.0.5,eth2,<empty>
+	*/
+	res := []*Iface{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		params := strings.Split(fields[1], ",")
+		for len(params) < 5 {
+			params = append(params, "")
+		}
+		for i := range params {
+			if params[i] == "<empty>" {
+				params[i] = ""
+			}
+		}
+		res = append(res, &Iface{
+			Name:          fields[0],
+			Transport:     params[0],
+			HWAddress:     params[1],
+			IPAddress:     params[2],
+			NetIfaceName:  params[3],
+			InitiatorName: params[4],
+		})
+	}
+	return res
+}
+
+// GetIfaceParams returns the parameters of the iface record
+func GetIfaceParams(iface string, ne *util.NamespaceExecutor) (map[string]string, error) {
+	opts := []string{
+		"-m", "iface",
+		"-I", iface,
+	}
+	output, err := ne.Execute(iscsiBinary, opts)
+	if err != nil {
+		return nil, err
+	}
+	return parseRecordParams(output), nil
+}
+
+// parseRecordParams parses the records printed by iscsiadm
+func parseRecordParams(output string) map[string]string {
+	/* Output will looks like:
+	# BEGIN RECORD 2.0-874
+	iface.iscsi_ifacename = storage
+	iface.net_ifacename = eth1
+	iface.hwaddress = <empty>
+	# END RECORD
+	*/
+	res := map[string]string{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " = ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(fields[1])
+		if value == "<empty>" {
+			value = ""
+		}
+		res[strings.TrimSpace(fields[0])] = value
+	}
+	return res
+}
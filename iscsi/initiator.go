@@ -8,21 +8,54 @@ import (
 	"strings"
 	"time"
 
+	"github.com/sirupsen/logrus"
+
 	"github.com/longhorn/go-iscsi-helper/util"
 )
 
 var (
 	DeviceWaitRetryCounts   = 10
 	DeviceWaitRetryInterval = 1 * time.Second
+	DeviceWaitPollInterval  = 250 * time.Millisecond
 
 	ScsiNodesDirs = []string{
 		"/etc/iscsi/nodes/",
 		"/var/lib/iscsi/nodes/",
 	}
+	ScsiSendTargetsDirs = []string{
+		"/etc/iscsi/send_targets/",
+		"/var/lib/iscsi/send_targets/",
+	}
 )
 
 const (
 	iscsiBinary = "iscsiadm"
+
+	discoverySendTargets = "sendtargets"
+	discoveryISNS        = "isns"
+
+	iscsiSessionSysfsDir = "/sys/class/iscsi_session"
+)
+
+var (
+	// InitiatorBinaries are executed by the initiator operations through
+	// util.NamespaceExecutor
+	InitiatorBinaries = []string{
+		iscsiBinary,
+		sgTursBinary,
+		sgReadcapBinary,
+		sgResetBinary,
+		blockdevBinary,
+		ddBinary,
+		syncBinary,
+	}
+	// TargetBinaries are executed by the target operations in the namespace
+	// of the caller
+	TargetBinaries = []string{
+		tgtdBinary,
+		tgtBinary,
+		tgtAdminBinary,
+	}
 )
 
 func CheckForInitiatorExistence(ne *util.NamespaceExecutor) error {
@@ -37,10 +70,35 @@ func CheckForInitiatorExistence(ne *util.NamespaceExecutor) error {
 }
 
 func DiscoverTarget(ip, target string, ne *util.NamespaceExecutor) error {
+	return discoverTarget(discoverySendTargets, ip, target, "", ne)
+}
+
+// DiscoverTargetWithIface discovers the target through the iface, which
+// creates the node records bound to the iface
+func DiscoverTargetWithIface(ip, target, iface string, ne *util.NamespaceExecutor) error {
+	return discoverTarget(discoverySendTargets, ip, target, iface, ne)
+}
+
+// DiscoverTargetISNS discovers the target through the iSNS server, instead of
+// asking the portal of the target directly
+func DiscoverTargetISNS(isnsServer, target string, ne *util.NamespaceExecutor) error {
+	return discoverTarget(discoveryISNS, isnsServer, target, "", ne)
+}
+
+// DiscoverTargetISNSWithIface discovers the target through the iSNS server
+// and the iface, which creates the node records bound to the iface
+func DiscoverTargetISNSWithIface(isnsServer, target, iface string, ne *util.NamespaceExecutor) error {
+	return discoverTarget(discoveryISNS, isnsServer, target, iface, ne)
+}
+
+func discoverTarget(discoveryType, portal, target, iface string, ne *util.NamespaceExecutor) error {
 	opts := []string{
 		"-m", "discovery",
-		"-t", "sendtargets",
-		"-p", ip,
+		"-t", discoveryType,
+		"-p", portal,
+	}
+	if iface != "" {
+		opts = append(opts, "-I", iface)
 	}
 	output, err := ne.Execute(iscsiBinary, opts)
 	if err != nil {
@@ -61,6 +119,63 @@ func DiscoverTarget(ip, target string, ne *util.NamespaceExecutor) error {
 	return nil
 }
 
+// DiscoveredTarget is a target advertised by a portal during discovery
+type DiscoveredTarget struct {
+	IQN     string
+	Portals []*Portal
+}
+
+// DiscoverPortal returns all the targets advertised by the portal, via
+// SendTargets discovery. It doesn't create node records for the targets.
+func DiscoverPortal(portal string, ne *util.NamespaceExecutor) ([]*DiscoveredTarget, error) {
+	opts := []string{
+		"-m", "discovery",
+		"-t", discoverySendTargets,
+		"-p", portal,
+		"-o", "nonpersistent",
+	}
+	output, err := ne.Execute(iscsiBinary, opts)
+	if err != nil {
+		return nil, err
+	}
+	return parseDiscoveredTargets(output)
+}
+
+func parseDiscoveredTargets(output string) ([]*DiscoveredTarget, error) {
+	/* Output will looks like:
+	172.18.0.5:3260,1 iqn.2019-10.io.longhorn:vol1
+	172.18.0.6:3260,1 iqn.2019-10.io.longhorn:vol1
+	172.18.0.5:3260,1 iqn.2019-10.io.longhorn:vol2
+	*/
+	if strings.Contains(output, "Could not") {
+		return nil, fmt.Errorf("Cannot discover targets: %s", output)
+	}
+	res := []*DiscoveredTarget{}
+	targets := map[string]*DiscoveredTarget{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		portal, err := parsePortal(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		target, exists := targets[fields[1]]
+		if !exists {
+			target = &DiscoveredTarget{
+				IQN:     fields[1],
+				Portals: []*Portal{},
+			}
+			targets[fields[1]] = target
+			res = append(res, target)
+		}
+		target.Portals = append(target.Portals, portal)
+	}
+	return res, nil
+}
+
 func DeleteDiscoveredTarget(ip, target string, ne *util.NamespaceExecutor) error {
 	opts := []string{
 		"-m", "node",
@@ -88,13 +203,40 @@ func IsTargetDiscovered(ip, target string, ne *util.NamespaceExecutor) bool {
 	return true
 }
 
+// UpdateNodeParam will update the parameter of the node record, which takes
+// effect on the next login
+func UpdateNodeParam(ip, target, name, value string, ne *util.NamespaceExecutor) error {
+	opts := []string{
+		"-m", "node",
+		"-T", target,
+		"-p", ip,
+		"-o", "update",
+		"-n", name,
+		"-v", value,
+	}
+	_, err := ne.Execute(iscsiBinary, opts)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 func LoginTarget(ip, target string, ne *util.NamespaceExecutor) error {
+	return LoginTargetWithIface(ip, target, "", ne)
+}
+
+// LoginTargetWithIface logs in the target through the iface, so the traffic
+// is pinned to the network interface of the iface
+func LoginTargetWithIface(ip, target, iface string, ne *util.NamespaceExecutor) error {
 	opts := []string{
 		"-m", "node",
 		"-T", target,
 		"-p", ip,
-		"--login",
 	}
+	if iface != "" {
+		opts = append(opts, "-I", iface)
+	}
+	opts = append(opts, "--login")
 	_, err := ne.Execute(iscsiBinary, opts)
 	if err != nil {
 		return err
@@ -119,23 +261,58 @@ func LogoutTarget(ip, target string, ne *util.NamespaceExecutor) error {
 	return nil
 }
 
+// RescanTarget rescans the sessions of the target, so the LUNs added to the
+// target after login show up without re-login
+func RescanTarget(ip, target string, ne *util.NamespaceExecutor) error {
+	opts := []string{
+		"-m", "node",
+		"-T", target,
+		"-p", ip,
+		"--rescan",
+	}
+	_, err := ne.Execute(iscsiBinary, opts)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetDevice waits for the device of the LUN to show up. It's woken up by the
+// block device uevents, and falls back to poll every DeviceWaitPollInterval.
 func GetDevice(ip, target string, lun int, ne *util.NamespaceExecutor) (*util.KernelDevice, error) {
 	var err error
 
+	// Subscribe before the first check so no event is missed
+	monitor, monitorErr := util.NewUeventMonitor()
+	if monitorErr != nil {
+		logrus.Debugf("Cannot monitor uevents, fall back to polling: %v", monitorErr)
+	} else {
+		defer monitor.Close()
+	}
+
 	var dev *util.KernelDevice
-	for i := 0; i < DeviceWaitRetryCounts; i++ {
+	timeout := time.Duration(DeviceWaitRetryCounts) * DeviceWaitRetryInterval
+	util.WaitForCondition(timeout, DeviceWaitPollInterval, monitor, isBlockDeviceAdded, func() bool {
 		dev, err = findScsiDevice(ip, target, lun, ne)
-		if err == nil {
-			break
-		}
-		time.Sleep(DeviceWaitRetryInterval)
-	}
+		return err == nil
+	})
 	if err != nil {
 		return nil, err
 	}
 	return dev, nil
 }
 
+func isBlockDeviceAdded(event *util.Uevent) bool {
+	return event.Subsystem == "block" &&
+		(event.Action == util.UeventActionAdd || event.Action == util.UeventActionChange)
+}
+
+// FindDevice looks up the device of the LUN once, without waiting for it to
+// show up like GetDevice does. It checks the session of any portal if ip == ""
+func FindDevice(ip, target string, lun int, ne *util.NamespaceExecutor) (*util.KernelDevice, error) {
+	return findScsiDevice(ip, target, lun, ne)
+}
+
 // IsTargetLoggedIn check all portals if ip == ""
 func IsTargetLoggedIn(ip, target string, ne *util.NamespaceExecutor) bool {
 	opts := []string{
@@ -166,6 +343,157 @@ func IsTargetLoggedIn(ip, target string, ne *util.NamespaceExecutor) bool {
 	return found
 }
 
+// Session is an iSCSI session of the initiator
+type Session struct {
+	Transport string
+	SID       string
+	Portal    *Portal
+	Target    string
+}
+
+// ListSessions returns all the sessions of the initiator
+func ListSessions(ne *util.NamespaceExecutor) ([]*Session, error) {
+	opts := []string{
+		"-m", "session",
+	}
+	output, err := ne.Execute(iscsiBinary, opts)
+	if err != nil {
+		// iscsiadm returns 21 if there is no session
+		if strings.Contains(err.Error(), "exit status 21") {
+			return []*Session{}, nil
+		}
+		return nil, err
+	}
+	return parseSessions(output)
+}
+
+func parseSessions(output string) ([]*Session, error) {
+	/* It will looks like:
+		tcp: [463] 172.17.0.2:3260,1 iqn.2019-10.io.longhorn:test-volume
+	or:
+		tcp: [463] 172.17.0.2:3260,1 iqn.2019-10.io.longhorn:test-volume (non-flash)
+	*/
+	res := []*Session{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || !strings.HasSuffix(fields[0], ":") {
+			continue
+		}
+		portal, err := parsePortal(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, &Session{
+			Transport: strings.TrimSuffix(fields[0], ":"),
+			SID:       strings.Trim(fields[1], "[]"),
+			Portal:    portal,
+			Target:    fields[3],
+		})
+	}
+	return res, nil
+}
+
+// GetDevices returns the devices of all the LUNs of the target indexed by LUN.
+// It checks the session of any portal if ip == ""
+func GetDevices(ip, target string, ne *util.NamespaceExecutor) (map[int]*util.KernelDevice, error) {
+	devices, err := ListDevices(ip, []string{target}, ne)
+	if err != nil {
+		return nil, err
+	}
+	return devices[target], nil
+}
+
+// ListDevices returns the devices of all the LUNs of the targets indexed by
+// the target and the LUN, in one pass of the sessions
+func ListDevices(ip string, targets []string, ne *util.NamespaceExecutor) (map[string]map[int]*util.KernelDevice, error) {
+	res := map[string]map[int]*util.KernelDevice{}
+	for _, target := range targets {
+		res[target] = map[int]*util.KernelDevice{}
+	}
+
+	opts := []string{
+		"-m", "session",
+		"-P", "3",
+	}
+	output, err := ne.Execute(iscsiBinary, opts)
+	if err != nil {
+		// iscsiadm returns 21 if there is no session
+		if strings.Contains(err.Error(), "exit status 21") {
+			return res, nil
+		}
+		return nil, err
+	}
+
+	devices, err := util.GetKnownDevices(ne)
+	if err != nil {
+		return nil, err
+	}
+	for _, target := range targets {
+		names, err := parseScsiDeviceNames(output, ip, target)
+		if err != nil {
+			return nil, err
+		}
+		for lun, name := range names {
+			dev, known := devices[name]
+			if !known {
+				return nil, fmt.Errorf("Cannot find kernel device for iscsi device: %s", name)
+			}
+			res[target][lun] = dev
+		}
+	}
+	return res, nil
+}
+
+// parseScsiDeviceNames parses the output of "iscsiadm -m session -P 3", see
+// findScsiDevice for the format
+func parseScsiDeviceNames(output, ip, target string) (map[int]string, error) {
+	res := map[int]string{}
+	targetLine := "Target: " + target
+	ipLine := " " + ip + ":"
+	diskPrefix := "Attached scsi disk"
+	stateLine := "State:"
+
+	inTarget := false
+	inIP := false
+	lun := -1
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(strings.TrimSpace(line), "Target: ") {
+			inTarget = strings.Contains(line, targetLine+" ") || strings.HasSuffix(line, targetLine)
+			inIP = false
+			lun = -1
+			continue
+		}
+		if !inTarget {
+			continue
+		}
+		if strings.Contains(line, "Current Portal:") {
+			inIP = ip == "" || strings.Contains(line, ipLine)
+			lun = -1
+			continue
+		}
+		if !inIP {
+			continue
+		}
+		if i := strings.Index(line, "Lun: "); i != -1 {
+			var err error
+			if lun, err = strconv.Atoi(strings.TrimSpace(line[i+len("Lun: "):])); err != nil {
+				return nil, fmt.Errorf("Invalid output format, cannot parse LUN in: %s", line)
+			}
+			continue
+		}
+		if lun != -1 && strings.Contains(line, diskPrefix) {
+			name := strings.TrimSpace(strings.Split(line, stateLine)[0])
+			name = strings.TrimSpace(strings.TrimPrefix(name, diskPrefix))
+			res[lun] = name
+			lun = -1
+		}
+	}
+	return res, nil
+}
+
 func findScsiDevice(ip, target string, lun int, ne *util.NamespaceExecutor) (*util.KernelDevice, error) {
 	name := ""
 
@@ -213,7 +541,9 @@ func findScsiDevice(ip, target string, lun int, ne *util.NamespaceExecutor) (*ut
 			inTarget = true
 			continue
 		}
-		if inTarget && strings.Contains(scanner.Text(), ipLine) {
+		if inTarget &&
+			(strings.Contains(scanner.Text(), ipLine) ||
+				(ip == "" && strings.Contains(scanner.Text(), "Current Portal:"))) {
 			inIP = true
 			continue
 		}
@@ -284,3 +614,133 @@ func CleanupScsiNodes(target string, ne *util.NamespaceExecutor) error {
 	}
 	return nil
 }
+
+// GarbageCollectScsiNodes scans the whole node database for the records of the
+// targets with iqnPrefix, which is required. The records of the targets
+// without a session are removed, as well as the empty files of the ones with
+// a session and the dangling send_targets entries. The sessions in recovery
+// count, since iscsid needs the records to log them back in. It returns the
+// removed records.
+//
+// The caller must make sure no discovery or login of the matching targets is
+// in progress, otherwise the records being used may be removed.
+func GarbageCollectScsiNodes(iqnPrefix string, ne *util.NamespaceExecutor) ([]string, error) {
+	if iqnPrefix == "" {
+		return nil, fmt.Errorf("IQN prefix is required to garbage collect the node records")
+	}
+	sessionTargets, err := getSessionTargets(ne)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the targets with sessions: %v", err)
+	}
+
+	removed := []string{}
+	for _, dir := range ScsiNodesDirs {
+		output, err := ne.Execute("ls", []string{dir})
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(strings.NewReader(output))
+		for scanner.Scan() {
+			target := strings.TrimSpace(scanner.Text())
+			if !strings.HasPrefix(target, iqnPrefix) {
+				continue
+			}
+			if _, exists := sessionTargets[target]; exists {
+				if err := CleanupScsiNodes(target, ne); err != nil {
+					return removed, err
+				}
+				continue
+			}
+			targetDir := filepath.Join(dir, target)
+			// Corrupted records may fail iscsiadm, remove them directly then
+			if err := deleteNodeRecords(target, ne); err != nil {
+				logrus.Warnf("Failed to delete node records of %v, removing %v: %v", target, targetDir, err)
+				if _, err := ne.Execute("rm", []string{"-rf", targetDir}); err != nil {
+					return removed, fmt.Errorf("Failed to remove SCSI node directory %v: %v", targetDir, err)
+				}
+			}
+			removed = append(removed, targetDir)
+		}
+	}
+
+	for _, dir := range ScsiSendTargetsDirs {
+		if _, err := ne.Execute("ls", []string{dir}); err != nil {
+			continue
+		}
+		// The entries are symlinks named <target>,<ip>,<port>,<tpgt>,<iface>
+		// to the node records
+		opts := []string{
+			dir,
+			"-mindepth", "2",
+			"-maxdepth", "2",
+			"-xtype", "l",
+			"-name", iqnPrefix + "*",
+		}
+		output, err := ne.Execute("find", opts)
+		if err != nil {
+			return removed, fmt.Errorf("Failed to search send_targets directory %v: %v", dir, err)
+		}
+		scanner := bufio.NewScanner(strings.NewReader(output))
+		for scanner.Scan() {
+			link := strings.TrimSpace(scanner.Text())
+			if link == "" {
+				continue
+			}
+			if _, err := ne.Execute("rm", []string{"-f", link}); err != nil {
+				return removed, fmt.Errorf("Failed to remove dangling send_targets entry %v: %v", link, err)
+			}
+			removed = append(removed, link)
+		}
+	}
+	return removed, nil
+}
+
+// getSessionTargets returns the targets of all the sessions, including the
+// ones in recovery known by the kernel only
+func getSessionTargets(ne *util.NamespaceExecutor) (map[string]struct{}, error) {
+	res := map[string]struct{}{}
+	sessions, err := ListSessions(ne)
+	if err != nil {
+		return nil, err
+	}
+	for _, session := range sessions {
+		res[session.Target] = struct{}{}
+	}
+
+	// The class doesn't exist until the iSCSI transport module is loaded
+	if _, err := ne.Execute("ls", []string{iscsiSessionSysfsDir}); err != nil {
+		return res, nil
+	}
+	opts := []string{
+		"-L", iscsiSessionSysfsDir,
+		"-mindepth", "2",
+		"-maxdepth", "2",
+		"-name", "targetname",
+		"-exec", "cat", "{}", "+",
+	}
+	output, err := ne.Execute("find", opts)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		if target := strings.TrimSpace(scanner.Text()); target != "" {
+			res[target] = struct{}{}
+		}
+	}
+	return res, nil
+}
+
+// deleteNodeRecords deletes the node records of the target on all portals
+func deleteNodeRecords(target string, ne *util.NamespaceExecutor) error {
+	opts := []string{
+		"-m", "node",
+		"-o", "delete",
+		"-T", target,
+	}
+	_, err := ne.Execute(iscsiBinary, opts)
+	if err != nil {
+		return err
+	}
+	return nil
+}
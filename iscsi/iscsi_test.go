@@ -229,3 +229,16 @@ func (s *TestSuite) TestAio(c *C) {
 	err = DeleteTarget(tid)
 	c.Assert(err, IsNil)
 }
+
+func (s *TestSuite) TestGetBackingStores(c *C) {
+	backingStores, err := GetBackingStores()
+	c.Assert(err, IsNil)
+
+	found := false
+	for _, bs := range backingStores {
+		if bs == "rdwr" {
+			found = true
+		}
+	}
+	c.Assert(found, Equals, true)
+}
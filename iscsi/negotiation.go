@@ -0,0 +1,174 @@
+package iscsi
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/longhorn/go-iscsi-helper/util"
+)
+
+const (
+	paramMaxRecvDataSegmentLength = "MaxRecvDataSegmentLength"
+	paramFirstBurstLength         = "FirstBurstLength"
+	paramMaxBurstLength           = "MaxBurstLength"
+	paramImmediateData            = "ImmediateData"
+)
+
+// NegotiationParams are the iSCSI parameters negotiated on login. The zero
+// values and nil ImmediateData mean keeping the defaults.
+type NegotiationParams struct {
+	MaxRecvDataSegmentLength int
+	FirstBurstLength         int
+	MaxBurstLength           int
+	ImmediateData            *bool
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "Yes"
+	}
+	return "No"
+}
+
+// SetTargetNegotiationParams will update the parameters the target offers,
+// which are applied to the sessions established afterwards
+func (t *Tgtd) SetTargetNegotiationParams(tid int, params *NegotiationParams) error {
+	if params.MaxRecvDataSegmentLength != 0 {
+		if err := t.UpdateTargetParam(tid, paramMaxRecvDataSegmentLength, strconv.Itoa(params.MaxRecvDataSegmentLength)); err != nil {
+			return err
+		}
+	}
+	if params.FirstBurstLength != 0 {
+		if err := t.UpdateTargetParam(tid, paramFirstBurstLength, strconv.Itoa(params.FirstBurstLength)); err != nil {
+			return err
+		}
+	}
+	if params.MaxBurstLength != 0 {
+		if err := t.UpdateTargetParam(tid, paramMaxBurstLength, strconv.Itoa(params.MaxBurstLength)); err != nil {
+			return err
+		}
+	}
+	if params.ImmediateData != nil {
+		if err := t.UpdateTargetParam(tid, paramImmediateData, yesNo(*params.ImmediateData)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetNodeNegotiationParams will update the parameters the initiator proposes
+// in the node record, which are applied on the next login
+func SetNodeNegotiationParams(ip, target string, params *NegotiationParams, ne *util.NamespaceExecutor) error {
+	if params.MaxRecvDataSegmentLength != 0 {
+		if err := UpdateNodeParam(ip, target, "node.conn[0].iscsi."+paramMaxRecvDataSegmentLength,
+			strconv.Itoa(params.MaxRecvDataSegmentLength), ne); err != nil {
+			return err
+		}
+	}
+	if params.FirstBurstLength != 0 {
+		if err := UpdateNodeParam(ip, target, "node.session.iscsi."+paramFirstBurstLength,
+			strconv.Itoa(params.FirstBurstLength), ne); err != nil {
+			return err
+		}
+	}
+	if params.MaxBurstLength != 0 {
+		if err := UpdateNodeParam(ip, target, "node.session.iscsi."+paramMaxBurstLength,
+			strconv.Itoa(params.MaxBurstLength), ne); err != nil {
+			return err
+		}
+	}
+	if params.ImmediateData != nil {
+		if err := UpdateNodeParam(ip, target, "node.session.iscsi."+paramImmediateData,
+			yesNo(*params.ImmediateData), ne); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetNegotiatedParams returns the parameters negotiated by the session of the
+// target through the portal ip
+func GetNegotiatedParams(ip, target string, ne *util.NamespaceExecutor) (*NegotiationParams, error) {
+	opts := []string{
+		"-m", "session",
+		"-P", "2",
+	}
+	output, err := ne.Execute(iscsiBinary, opts)
+	if err != nil {
+		return nil, err
+	}
+	return parseNegotiatedParams(output, ip, target)
+}
+
+func parseNegotiatedParams(output, ip, target string) (*NegotiationParams, error) {
+	/*
+		Output will looks like:
+		Target: iqn.2019-10.io.longhorn:vol (non-flash)
+			Current Portal: 172.17.0.2:3260,1
+			Persistent Portal: 172.17.0.2:3260,1
+				...
+				************************
+				Negotiated iSCSI params:
+				************************
+				HeaderDigest: None
+				MaxRecvDataSegmentLength: 262144
+				MaxXmitDataSegmentLength: 65536
+				FirstBurstLength: 65536
+				MaxBurstLength: 262144
+				ImmediateData: Yes
+				...
+		Target: ...
+	*/
+	targetLine := "Target: " + target
+	ipLine := " " + ip + ":"
+
+	var params *NegotiationParams
+	inTarget := false
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(strings.TrimSpace(line), "Target: ") {
+			if params != nil {
+				break
+			}
+			inTarget = strings.Contains(line, targetLine+" ") || strings.HasSuffix(line, targetLine)
+			continue
+		}
+		if inTarget && params == nil && strings.Contains(line, "Current Portal:") && strings.Contains(line, ipLine) {
+			params = &NegotiationParams{}
+			continue
+		}
+		if params == nil {
+			continue
+		}
+		fields := strings.SplitN(strings.TrimSpace(line), ": ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		key, value := fields[0], strings.TrimSpace(fields[1])
+		switch key {
+		case paramMaxRecvDataSegmentLength, paramFirstBurstLength, paramMaxBurstLength:
+			v, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid negotiated param %v: %v", key, value)
+			}
+			switch key {
+			case paramMaxRecvDataSegmentLength:
+				params.MaxRecvDataSegmentLength = v
+			case paramFirstBurstLength:
+				params.FirstBurstLength = v
+			case paramMaxBurstLength:
+				params.MaxBurstLength = v
+			}
+		case paramImmediateData:
+			immediateData := value == "Yes"
+			params.ImmediateData = &immediateData
+		}
+	}
+	if params == nil {
+		return nil, fmt.Errorf("Cannot find session of target %v through portal %v", target, ip)
+	}
+	return params, nil
+}
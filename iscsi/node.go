@@ -0,0 +1,110 @@
+package iscsi
+
+import (
+	"bufio"
+	"net"
+	"strings"
+
+	"github.com/longhorn/go-iscsi-helper/util"
+)
+
+// NodeRecord is a record of the node database, which the initiator logs in
+// by the startup mode
+type NodeRecord struct {
+	Portal      *Portal
+	IQN         string
+	Iface       string
+	StartupMode string
+	AuthMethod  string
+	Username    string
+}
+
+// ListNodeRecords returns all the records of the node database with their
+// details
+func ListNodeRecords(ne *util.NamespaceExecutor) ([]*NodeRecord, error) {
+	opts := []string{
+		"-m", "node",
+	}
+	output, err := ne.Execute(iscsiBinary, opts)
+	if err != nil {
+		// iscsiadm returns 21 if there is no record
+		if strings.Contains(err.Error(), "exit status 21") {
+			return []*NodeRecord{}, nil
+		}
+		return nil, err
+	}
+	records, err := parseNodeRecords(output)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		portal := net.JoinHostPort(record.Portal.IP, record.Portal.Port)
+		params, err := GetNodeParams(portal, record.IQN, ne)
+		if err != nil {
+			return nil, err
+		}
+		record.Iface = params["iface.iscsi_ifacename"]
+		record.StartupMode = params["node.startup"]
+		record.AuthMethod = params["node.session.auth.authmethod"]
+		record.Username = params["node.session.auth.username"]
+	}
+	return records, nil
+}
+
+func parseNodeRecords(output string) ([]*NodeRecord, error) {
+	/* Output will looks like:
+	172.17.0.2:3260,1 iqn.2019-10.io.longhorn:vol1
+	[fd00::2]:3260,1 iqn.2019-10.io.longhorn:vol2
+	*/
+	res := []*NodeRecord{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		portal, err := parsePortal(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, &NodeRecord{
+			Portal: portal,
+			IQN:    fields[1],
+		})
+	}
+	return res, nil
+}
+
+// CreateNodeRecord creates the node record of the target directly, without
+// the SendTargets discovery, when the target and the portal are known exactly
+func CreateNodeRecord(ip, target, iface string, ne *util.NamespaceExecutor) error {
+	opts := []string{
+		"-m", "node",
+		"-T", target,
+		"-p", ip,
+	}
+	if iface != "" {
+		opts = append(opts, "-I", iface)
+	}
+	opts = append(opts, "-o", "new")
+	_, err := ne.Execute(iscsiBinary, opts)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetNodeParams returns all the parameters of the node record. ip can be in the
+// IP:Port format to select the record of the port.
+func GetNodeParams(ip, target string, ne *util.NamespaceExecutor) (map[string]string, error) {
+	opts := []string{
+		"-m", "node",
+		"-T", target,
+		"-p", ip,
+	}
+	output, err := ne.Execute(iscsiBinary, opts)
+	if err != nil {
+		return nil, err
+	}
+	return parseRecordParams(output), nil
+}
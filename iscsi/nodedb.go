@@ -0,0 +1,190 @@
+package iscsi
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/go-iscsi-helper/util"
+)
+
+const (
+	nodeDatabaseBackupVersion  = 1
+	nodeDatabaseBackupMetadata = "metadata.json"
+)
+
+// NodeDatabaseBackupMetadata is stored in the backup tarball along with the
+// node and discovery databases
+type NodeDatabaseBackupMetadata struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	Hostname  string    `json:"hostname"`
+	Dirs      []string  `json:"dirs"`
+}
+
+// getNodeDatabaseDirs returns the existing node and discovery database
+// directories
+func getNodeDatabaseDirs(ne *util.NamespaceExecutor) []string {
+	dirs := []string{}
+	for _, dir := range append(append([]string{}, ScsiNodesDirs...), ScsiSendTargetsDirs...) {
+		if _, err := ne.Execute("ls", []string{dir}); err == nil {
+			dirs = append(dirs, filepath.Clean(dir))
+		}
+	}
+	return dirs
+}
+
+// BackupScsiNodeDatabase snapshots the node and discovery databases of the
+// initiator into the gzipped tarball backupFile, which can be restored by
+// RestoreScsiNodeDatabase
+func BackupScsiNodeDatabase(backupFile string, ne *util.NamespaceExecutor) (*NodeDatabaseBackupMetadata, error) {
+	hostname, err := ne.Execute("hostname", []string{})
+	if err != nil {
+		return nil, err
+	}
+	metadata := &NodeDatabaseBackupMetadata{
+		Version:   nodeDatabaseBackupVersion,
+		CreatedAt: time.Now().UTC(),
+		Hostname:  strings.TrimSpace(hostname),
+		Dirs:      getNodeDatabaseDirs(ne),
+	}
+	content, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpDir, err := ne.Execute("mktemp", []string{"-d"})
+	if err != nil {
+		return nil, err
+	}
+	tmpDir = strings.TrimSpace(tmpDir)
+	defer ne.Execute("rm", []string{"-rf", tmpDir})
+
+	if _, err := ne.ExecuteWithStdin("tee", []string{filepath.Join(tmpDir, nodeDatabaseBackupMetadata)}, string(content)); err != nil {
+		return nil, err
+	}
+	opts := []string{
+		"-czf", backupFile,
+		"-C", tmpDir, nodeDatabaseBackupMetadata,
+		"-C", "/",
+	}
+	for _, dir := range metadata.Dirs {
+		opts = append(opts, strings.TrimPrefix(dir, "/"))
+	}
+	if _, err := ne.Execute("tar", opts); err != nil {
+		return nil, fmt.Errorf("Failed to backup SCSI node database to %v: %v", backupFile, err)
+	}
+	return metadata, nil
+}
+
+// GetScsiNodeDatabaseBackupMetadata reads the metadata of the backup
+func GetScsiNodeDatabaseBackupMetadata(backupFile string, ne *util.NamespaceExecutor) (*NodeDatabaseBackupMetadata, error) {
+	output, err := ne.Execute("tar", []string{"-xzOf", backupFile, nodeDatabaseBackupMetadata})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read metadata of SCSI node database backup %v: %v", backupFile, err)
+	}
+	metadata := &NodeDatabaseBackupMetadata{}
+	if err := json.Unmarshal([]byte(output), metadata); err != nil {
+		return nil, fmt.Errorf("Invalid metadata of SCSI node database backup %v: %v", backupFile, err)
+	}
+	if metadata.Version != nodeDatabaseBackupVersion {
+		return nil, fmt.Errorf("Unsupported SCSI node database backup version %v", metadata.Version)
+	}
+	return metadata, nil
+}
+
+// RestoreScsiNodeDatabase replaces the node and discovery databases with the
+// ones in the backup. The sessions already logged in are not affected. The
+// caller must make sure no discovery or login is in progress.
+//
+// The databases are extracted next to the existing ones first, then renamed
+// into place, so the existing ones are kept if the backup cannot be extracted
+// and put back if any rename fails.
+func RestoreScsiNodeDatabase(backupFile string, ne *util.NamespaceExecutor) error {
+	metadata, err := GetScsiNodeDatabaseBackupMetadata(backupFile, ne)
+	if err != nil {
+		return err
+	}
+	for _, dir := range metadata.Dirs {
+		// Only the known directories are allowed to be replaced
+		if !isNodeDatabaseDir(dir) {
+			return fmt.Errorf("Invalid directory %v in SCSI node database backup %v", dir, backupFile)
+		}
+	}
+
+	// The staging directories are in the parent directories of the
+	// databases, so they're on the same filesystems and can be renamed
+	stagingDirs := map[string]string{}
+	defer func() {
+		for _, stagingDir := range stagingDirs {
+			ne.Execute("rm", []string{"-rf", stagingDir})
+		}
+	}()
+	for _, dir := range metadata.Dirs {
+		stagingDir, err := ne.Execute("mktemp", []string{"-d", filepath.Join(filepath.Dir(dir), ".iscsi-restore-XXXXXX")})
+		if err != nil {
+			return fmt.Errorf("Failed to create staging directory for %v: %v", dir, err)
+		}
+		stagingDir = strings.TrimSpace(stagingDir)
+		stagingDirs[dir] = stagingDir
+		opts := []string{
+			"-xzf", backupFile,
+			"-C", stagingDir,
+			strings.TrimPrefix(dir, "/"),
+		}
+		if _, err := ne.Execute("tar", opts); err != nil {
+			return fmt.Errorf("Failed to extract %v from SCSI node database backup %v: %v", dir, backupFile, err)
+		}
+	}
+
+	replaced := []string{}
+	rollback := func() {
+		for _, dir := range replaced {
+			stagingDir := stagingDirs[dir]
+			if _, err := ne.Execute("rm", []string{"-rf", dir}); err != nil {
+				logrus.Errorf("Failed to remove restored %v for rollback: %v", dir, err)
+				continue
+			}
+			if _, err := ne.Execute("ls", []string{filepath.Join(stagingDir, "old")}); err != nil {
+				continue
+			}
+			if _, err := ne.Execute("mv", []string{filepath.Join(stagingDir, "old"), dir}); err != nil {
+				logrus.Errorf("Failed to put back %v, it's kept in %v: %v", dir, stagingDir, err)
+				delete(stagingDirs, dir)
+			}
+		}
+	}
+	for _, dir := range metadata.Dirs {
+		stagingDir := stagingDirs[dir]
+		if _, err := ne.Execute("ls", []string{dir}); err == nil {
+			if _, err := ne.Execute("mv", []string{dir, filepath.Join(stagingDir, "old")}); err != nil {
+				rollback()
+				return fmt.Errorf("Failed to move %v aside before restoring: %v", dir, err)
+			}
+		}
+		replaced = append(replaced, dir)
+		if _, err := ne.Execute("mv", []string{filepath.Join(stagingDir, strings.TrimPrefix(dir, "/")), dir}); err != nil {
+			rollback()
+			return fmt.Errorf("Failed to restore %v from SCSI node database backup %v: %v", dir, backupFile, err)
+		}
+	}
+	return nil
+}
+
+func isNodeDatabaseDir(dir string) bool {
+	for _, d := range append(append([]string{}, ScsiNodesDirs...), ScsiSendTargetsDirs...) {
+		if filepath.Clean(d) == filepath.Clean(dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetScsiNodeDatabaseBackupName returns a timestamped backup file name in dir
+func GetScsiNodeDatabaseBackupName(dir string) string {
+	return filepath.Join(dir, fmt.Sprintf("iscsi-nodes-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z")))
+}
@@ -0,0 +1,513 @@
+package iscsi
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/longhorn/go-iscsi-helper/util"
+
+	. "gopkg.in/check.v1"
+)
+
+// ParseSuite covers the parsing and other helpers that need neither tgtd nor
+// the host namespace, so it runs without the setup of TestSuite
+type ParseSuite struct {
+}
+
+var _ = Suite(&ParseSuite{})
+
+// tgtadmShowOutput is shared by the tests parsing "tgtadm --op show --mode
+// target", which prints every section of all the targets
+const tgtadmShowOutput = `Target 1: iqn.2016-08.com.example:a
+    System information:
+        Driver: iscsi
+        State: ready
+    I_T nexus information:
+    LUN information:
+        LUN: 0
+            Type: controller
+            Online: Yes
+            Backing store type: null
+            Backing store path: None
+        LUN: 1
+            Type: disk
+            Online: No
+            Backing store type: rdwr
+            Backing store path: /var/lib/a.img
+    Account information:
+        user1
+        user2 (outgoing)
+    ACL information:
+        ALL
+        iqn.2016-08.com.example:node1
+Target 12: iqn.2016-08.com.example:b
+    System information:
+        Driver: iscsi
+        State: offline
+    I_T nexus information:
+    LUN information:
+        LUN: 1
+            Type: disk
+            Online: Yes
+            Backing store type: aio
+            Backing store path: /var/lib/b.img
+    Account information:
+    ACL information:
+`
+
+func (s *ParseSuite) TestParseTargetSessions(c *C) {
+	output := `Session: 11
+    Connection: 0
+        Initiator: iqn.2016-08.com.example:a alias: node-a
+        IP Address: 192.168.0.1
+Session: 12
+    Connection: 1
+        Initiator: iqn.2016-08.com.example:b
+        IP Address: 192.168.0.2
+`
+	sessions, err := parseTargetSessions(output)
+	c.Assert(err, IsNil)
+	c.Assert(sessions, HasLen, 2)
+	c.Assert(sessions[0].SID, Equals, "11")
+	c.Assert(sessions[0].Initiator, Equals, "iqn.2016-08.com.example:a")
+	c.Assert(sessions[0].IPAddresses, DeepEquals, []string{"192.168.0.1"})
+	c.Assert(sessions[0].CIDs, DeepEquals, []string{"0"})
+	c.Assert(sessions[1].SID, Equals, "12")
+	c.Assert(sessions[1].Initiator, Equals, "iqn.2016-08.com.example:b")
+
+	_, err = parseTargetSessions("Session: x\n")
+	c.Assert(err, NotNil)
+}
+
+func (s *ParseSuite) TestParsePortals(c *C) {
+	portals, err := parsePortals("Portal: 0.0.0.0:3260,1\nPortal: [::]:3260,1\n")
+	c.Assert(err, IsNil)
+	c.Assert(portals, HasLen, 2)
+	c.Assert(*portals[0], DeepEquals, Portal{IP: "0.0.0.0", Port: "3260", Tag: 1})
+	c.Assert(*portals[1], DeepEquals, Portal{IP: "::", Port: "3260", Tag: 1})
+	c.Assert(portals[1].String(), Equals, "[::]:3260")
+
+	_, err = parsePortals("Portal: 0.0.0.0:3260,x\n")
+	c.Assert(err, NotNil)
+}
+
+func (s *ParseSuite) TestParseDiscoveredTargets(c *C) {
+	output := `172.18.0.5:3260,1 iqn.2019-10.io.longhorn:vol1
+172.18.0.6:3260,1 iqn.2019-10.io.longhorn:vol1
+172.18.0.5:3260,1 iqn.2019-10.io.longhorn:vol2
+`
+	targets, err := parseDiscoveredTargets(output)
+	c.Assert(err, IsNil)
+	c.Assert(targets, HasLen, 2)
+	c.Assert(targets[0].IQN, Equals, "iqn.2019-10.io.longhorn:vol1")
+	c.Assert(targets[0].Portals, HasLen, 2)
+	c.Assert(targets[0].Portals[1].IP, Equals, "172.18.0.6")
+	c.Assert(targets[1].IQN, Equals, "iqn.2019-10.io.longhorn:vol2")
+	c.Assert(targets[1].Portals, HasLen, 1)
+
+	_, err = parseDiscoveredTargets("iscsiadm: Could not stat /etc/iscsi/nodes//,3260,-1/default\n")
+	c.Assert(err, NotNil)
+}
+
+func (s *ParseSuite) TestParseTargetState(c *C) {
+	state, err := parseTargetState(tgtadmShowOutput, 1)
+	c.Assert(err, IsNil)
+	c.Assert(state, Equals, TargetStateReady)
+	state, err = parseTargetState(tgtadmShowOutput, 12)
+	c.Assert(err, IsNil)
+	c.Assert(state, Equals, TargetStateOffline)
+	_, err = parseTargetState(tgtadmShowOutput, 2)
+	c.Assert(err, NotNil)
+}
+
+func (s *ParseSuite) TestParseNegotiatedParams(c *C) {
+	output := `Target: iqn.2019-10.io.longhorn:other (non-flash)
+	Current Portal: 172.17.0.2:3260,1
+	Persistent Portal: 172.17.0.2:3260,1
+		Negotiated iSCSI params:
+		MaxRecvDataSegmentLength: 8192
+Target: iqn.2019-10.io.longhorn:vol (non-flash)
+	Current Portal: 172.17.0.2:3260,1
+	Persistent Portal: 172.17.0.2:3260,1
+		************************
+		Negotiated iSCSI params:
+		************************
+		HeaderDigest: None
+		MaxRecvDataSegmentLength: 262144
+		MaxXmitDataSegmentLength: 65536
+		FirstBurstLength: 65536
+		MaxBurstLength: 262144
+		ImmediateData: No
+`
+	params, err := parseNegotiatedParams(output, "172.17.0.2", "iqn.2019-10.io.longhorn:vol")
+	c.Assert(err, IsNil)
+	c.Assert(params.MaxRecvDataSegmentLength, Equals, 262144)
+	c.Assert(params.FirstBurstLength, Equals, 65536)
+	c.Assert(params.MaxBurstLength, Equals, 262144)
+	c.Assert(params.ImmediateData, NotNil)
+	c.Assert(*params.ImmediateData, Equals, false)
+
+	_, err = parseNegotiatedParams(output, "172.17.0.3", "iqn.2019-10.io.longhorn:vol")
+	c.Assert(err, NotNil)
+}
+
+func (s *ParseSuite) TestParseReadCapacity(c *C) {
+	output := `Read Capacity results:
+   Last LBA=8191 (0x1fff), Number of logical blocks=8192
+   Logical block length=512 bytes
+Hence:
+   Device size: 4194304 bytes, 4.0 MiB, 0.00 GB
+`
+	size, err := parseReadCapacity(output)
+	c.Assert(err, IsNil)
+	c.Assert(size, Equals, int64(4194304))
+
+	_, err = parseReadCapacity("Read Capacity results:\n")
+	c.Assert(err, NotNil)
+}
+
+func (s *ParseSuite) TestParseRecordParams(c *C) {
+	output := `# BEGIN RECORD 2.0-874
+iface.iscsi_ifacename = storage
+iface.net_ifacename = eth1
+iface.hwaddress = <empty>
+# END RECORD
+`
+	params := parseRecordParams(output)
+	c.Assert(params["iface.iscsi_ifacename"], Equals, "storage")
+	c.Assert(params["iface.net_ifacename"], Equals, "eth1")
+	value, exists := params["iface.hwaddress"]
+	c.Assert(exists, Equals, true)
+	c.Assert(value, Equals, "")
+}
+
+func (s *ParseSuite) TestConvertUevent(c *C) {
+	event := convertUevent(&util.Uevent{
+		Action:    util.UeventActionAdd,
+		DevPath:   "/devices/platform/host3/session1/target3:0:0/3:0:0:1/block/sdb",
+		Subsystem: "block",
+		DevName:   "sdb",
+		Env:       map[string]string{"DEVTYPE": "disk"},
+	})
+	c.Assert(event, NotNil)
+	c.Assert(event.Type, Equals, EventDeviceAdded)
+	c.Assert(event.Device, Equals, "sdb")
+	c.Assert(event.Session, Equals, "session1")
+
+	event = convertUevent(&util.Uevent{
+		Action:    util.UeventActionRemove,
+		DevPath:   "/devices/platform/host3/session12/iscsi_session/session12",
+		Subsystem: "iscsi_session",
+		Env:       map[string]string{},
+	})
+	c.Assert(event, NotNil)
+	c.Assert(event.Type, Equals, EventSessionRemoved)
+	c.Assert(event.Session, Equals, "session12")
+
+	event = convertUevent(&util.Uevent{
+		Action:    util.UeventActionAdd,
+		DevPath:   "/devices/pci0000:00/0000:00:1f.2/ata1/host0/target0:0:0/0:0:0:0/block/sda",
+		Subsystem: "block",
+		Env:       map[string]string{"DEVTYPE": "disk"},
+	})
+	c.Assert(event, IsNil)
+}
+
+func (s *ParseSuite) TestExpandPortals(c *C) {
+	portals := []*Portal{
+		{IP: "0.0.0.0", Port: "3260", Tag: 1},
+		{IP: "192.168.1.1", Port: "3261", Tag: 1},
+	}
+	addrs := []net.Addr{
+		&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)},
+		&net.IPNet{IP: net.ParseIP("10.0.0.2"), Mask: net.CIDRMask(24, 32)},
+		&net.IPNet{IP: net.ParseIP("fd00::2"), Mask: net.CIDRMask(64, 128)},
+	}
+	res := expandPortals(portals, addrs)
+	c.Assert(res, HasLen, 2)
+	c.Assert(res[0].String(), Equals, "10.0.0.2:3260")
+	c.Assert(res[1].String(), Equals, "192.168.1.1:3261")
+}
+
+func (s *ParseSuite) TestParseSessions(c *C) {
+	output := `tcp: [463] 172.17.0.2:3260,1 iqn.2019-10.io.longhorn:vol1 (non-flash)
+tcp: [464] [fd00::2]:3260,1 iqn.2019-10.io.longhorn:vol2
+`
+	sessions, err := parseSessions(output)
+	c.Assert(err, IsNil)
+	c.Assert(sessions, HasLen, 2)
+	c.Assert(sessions[0].Transport, Equals, "tcp")
+	c.Assert(sessions[0].SID, Equals, "463")
+	c.Assert(sessions[0].Portal.IP, Equals, "172.17.0.2")
+	c.Assert(sessions[0].Target, Equals, "iqn.2019-10.io.longhorn:vol1")
+	c.Assert(sessions[1].Portal.IP, Equals, "fd00::2")
+	c.Assert(sessions[1].Target, Equals, "iqn.2019-10.io.longhorn:vol2")
+}
+
+func (s *ParseSuite) TestParseTargets(c *C) {
+	targets, err := parseTargets(tgtadmShowOutput)
+	c.Assert(err, IsNil)
+	c.Assert(targets, DeepEquals, map[int]string{
+		1:  "iqn.2016-08.com.example:a",
+		12: "iqn.2016-08.com.example:b",
+	})
+}
+
+func (s *ParseSuite) TestParseScsiDeviceNames(c *C) {
+	output := `Target: iqn.2019-10.io.longhorn:vol1 (non-flash)
+	Current Portal: 172.17.0.2:3260,1
+	Persistent Portal: 172.17.0.2:3260,1
+		************************
+		Attached SCSI devices:
+		************************
+		Host Number: 12	State: running
+		scsi12 Channel 00 Id 0 Lun: 0
+		scsi12 Channel 00 Id 0 Lun: 1
+			Attached scsi disk sdb		State: running
+		scsi12 Channel 00 Id 0 Lun: 2
+			Attached scsi disk sdc		State: running
+Target: iqn.2019-10.io.longhorn:vol2 (non-flash)
+	Current Portal: 172.17.0.2:3260,1
+	Persistent Portal: 172.17.0.2:3260,1
+		scsi13 Channel 00 Id 0 Lun: 1
+			Attached scsi disk sdd		State: running
+`
+	names, err := parseScsiDeviceNames(output, "172.17.0.2", "iqn.2019-10.io.longhorn:vol1")
+	c.Assert(err, IsNil)
+	c.Assert(names, DeepEquals, map[int]string{1: "sdb", 2: "sdc"})
+
+	names, err = parseScsiDeviceNames(output, "", "iqn.2019-10.io.longhorn:vol2")
+	c.Assert(err, IsNil)
+	c.Assert(names, DeepEquals, map[int]string{1: "sdd"})
+
+	names, err = parseScsiDeviceNames(output, "172.17.0.3", "iqn.2019-10.io.longhorn:vol1")
+	c.Assert(err, IsNil)
+	c.Assert(names, HasLen, 0)
+}
+
+func (s *ParseSuite) TestParseInflight(c *C) {
+	reads, writes, err := parseInflight("       3       12")
+	c.Assert(err, IsNil)
+	c.Assert(reads, Equals, 3)
+	c.Assert(writes, Equals, 12)
+
+	_, _, err = parseInflight("")
+	c.Assert(err, NotNil)
+}
+
+func (s *ParseSuite) TestParseLunStats(c *C) {
+	output := `LUN: 0
+    Read ops: 0
+    Write ops: 0
+    Read bytes: 0
+    Write bytes: 0
+LUN: 1
+    Read ops: 120
+    Write ops: 36
+    Read bytes: 491520
+    Write bytes: 147456
+`
+	stats, err := parseLunStats(output)
+	c.Assert(err, IsNil)
+	c.Assert(stats, HasLen, 2)
+	c.Assert(*stats[1], DeepEquals, LunStats{
+		LUN:        1,
+		ReadOps:    120,
+		WriteOps:   36,
+		ReadBytes:  491520,
+		WriteBytes: 147456,
+	})
+
+	_, err = parseLunStats("    Read ops: 1\n")
+	c.Assert(err, NotNil)
+}
+
+func (s *ParseSuite) TestParseNodeRecords(c *C) {
+	output := `172.17.0.2:3260,1 iqn.2019-10.io.longhorn:vol1
+[fd00::2]:3260,1 iqn.2019-10.io.longhorn:vol2
+`
+	records, err := parseNodeRecords(output)
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 2)
+	c.Assert(records[0].Portal.IP, Equals, "172.17.0.2")
+	c.Assert(records[0].Portal.Port, Equals, "3260")
+	c.Assert(records[0].IQN, Equals, "iqn.2019-10.io.longhorn:vol1")
+	c.Assert(records[1].Portal.IP, Equals, "fd00::2")
+	c.Assert(records[1].IQN, Equals, "iqn.2019-10.io.longhorn:vol2")
+}
+
+func (s *ParseSuite) TestDataVerifyPattern(c *C) {
+	pattern := newDataVerifyPattern("sdb")
+	c.Assert(pattern, HasLen, DataVerifyBlockSize)
+	c.Assert(strings.HasPrefix(pattern, "go-iscsi-helper data verification sdb "), Equals, true)
+
+	index, err := getDataBlockIndex(3 * DataVerifyBlockSize)
+	c.Assert(err, IsNil)
+	c.Assert(index, Equals, "3")
+	_, err = getDataBlockIndex(512)
+	c.Assert(err, NotNil)
+}
+
+func (s *ParseSuite) TestHashTargetID(c *C) {
+	name := "iqn.2019-10.io.longhorn:vol1"
+	tid, err := hashTargetID(name, map[int]string{})
+	c.Assert(err, IsNil)
+
+	again, err := hashTargetID(name, map[int]string{})
+	c.Assert(err, IsNil)
+	c.Assert(again, Equals, tid)
+
+	same, err := hashTargetID(name, map[int]string{tid: name})
+	c.Assert(err, IsNil)
+	c.Assert(same, Equals, tid)
+
+	// Collision probes the following TIDs, skipping the taken ones
+	next, err := hashTargetID(name, map[int]string{tid: "other"})
+	c.Assert(err, IsNil)
+	c.Assert(next, Equals, tid%maxTargetID+1)
+	next, err = hashTargetID(name, map[int]string{tid: "other", tid%maxTargetID + 1: "another"})
+	c.Assert(err, IsNil)
+	c.Assert(next, Equals, (tid+1)%maxTargetID+1)
+
+	existing := map[int]string{}
+	for i := 1; i <= maxTargetID; i++ {
+		existing[i] = "other"
+	}
+	_, err = hashTargetID(name, existing)
+	c.Assert(err, NotNil)
+}
+
+func (s *ParseSuite) TestHashTargetIDRange(c *C) {
+	for i := 0; i < 10000; i++ {
+		tid, err := hashTargetID(fmt.Sprintf("iqn.2019-10.io.longhorn:vol%d", i), map[int]string{})
+		c.Assert(err, IsNil)
+		c.Assert(tid >= 1 && tid <= maxTargetID, Equals, true)
+	}
+
+	// The TID wraps around to 1 after maxTargetID
+	existing := map[int]string{}
+	for i := 2; i <= maxTargetID; i++ {
+		existing[i] = "other"
+	}
+	tid, err := hashTargetID("iqn.2019-10.io.longhorn:vol1", existing)
+	c.Assert(err, IsNil)
+	c.Assert(tid, Equals, 1)
+}
+
+func (s *ParseSuite) TestParseLunOnline(c *C) {
+	online, err := parseLunOnline(tgtadmShowOutput, 1, 0)
+	c.Assert(err, IsNil)
+	c.Assert(online, Equals, true)
+	online, err = parseLunOnline(tgtadmShowOutput, 1, 1)
+	c.Assert(err, IsNil)
+	c.Assert(online, Equals, false)
+	online, err = parseLunOnline(tgtadmShowOutput, 12, 1)
+	c.Assert(err, IsNil)
+	c.Assert(online, Equals, true)
+	_, err = parseLunOnline(tgtadmShowOutput, 12, 2)
+	c.Assert(err, NotNil)
+}
+
+func (s *ParseSuite) TestLineBuffer(c *C) {
+	lines := DaemonLogLines
+	DaemonLogLines = 3
+	defer func() {
+		DaemonLogLines = lines
+	}()
+
+	b := newLineBuffer()
+	b.Write([]byte("a\nb"))
+	c.Assert(b.last(0), DeepEquals, []string{"a", "b"})
+	b.Write([]byte("c\nd\ne\n"))
+	c.Assert(b.last(0), DeepEquals, []string{"bc", "d", "e"})
+	c.Assert(b.last(2), DeepEquals, []string{"d", "e"})
+	b.Write([]byte("f"))
+	c.Assert(b.last(0), DeepEquals, []string{"bc", "d", "e", "f"})
+}
+
+func (s *ParseSuite) TestTgtdControlPortArgs(c *C) {
+	c.Assert(DefaultTgtd.controlPortArgs(), DeepEquals, []string{})
+	c.Assert(NewTgtd(1).controlPortArgs(), DeepEquals, []string{"--control-port", "1"})
+}
+
+func (s *ParseSuite) TestParseLuns(c *C) {
+	luns, err := parseLuns(tgtadmShowOutput, 1)
+	c.Assert(err, IsNil)
+	c.Assert(luns, HasLen, 2)
+	c.Assert(*luns[1], Equals, Lun{
+		LUN:              1,
+		Type:             "disk",
+		Online:           false,
+		BackingStoreType: "rdwr",
+		BackingStorePath: "/var/lib/a.img",
+	})
+	luns, err = parseLuns(tgtadmShowOutput, 12)
+	c.Assert(err, IsNil)
+	c.Assert(luns, HasLen, 1)
+	c.Assert(luns[0].BackingStorePath, Equals, "/var/lib/b.img")
+	_, err = parseLuns(tgtadmShowOutput, 2)
+	c.Assert(err, NotNil)
+}
+
+func (s *ParseSuite) TestParseIfaces(c *C) {
+	output := `default tcp,<empty>,<empty>,<empty>,<empty>
+bnx2i.00:10:18:aa:bb:cc bnx2i,00:10:18:aa:bb:cc,10.0.0.5,eth2,<empty>
+`
+	ifaces := parseIfaces(output)
+	c.Assert(ifaces, HasLen, 2)
+	c.Assert(*ifaces[0], Equals, Iface{Name: IfaceDefault, Transport: TransportTCP})
+	c.Assert(*ifaces[1], Equals, Iface{
+		Name:         "bnx2i.00:10:18:aa:bb:cc",
+		Transport:    TransportBnx2i,
+		HWAddress:    "00:10:18:aa:bb:cc",
+		IPAddress:    "10.0.0.5",
+		NetIfaceName: "eth2",
+	})
+	c.Assert(IsOffloadTransport(TransportQedi), Equals, true)
+	c.Assert(IsOffloadTransport(TransportTCP), Equals, false)
+}
+
+func (s *ParseSuite) TestParseAccounts(c *C) {
+	c.Assert(parseAccounts("Account list:\n    user1\n    user2\n"), DeepEquals, []string{"user1", "user2"})
+
+	accounts, err := parseTargetAccounts(tgtadmShowOutput)
+	c.Assert(err, IsNil)
+	c.Assert(accounts, HasLen, 2)
+	c.Assert(accounts[1], HasLen, 2)
+	c.Assert(*accounts[1][0], Equals, Account{User: "user1"})
+	c.Assert(*accounts[1][1], Equals, Account{User: "user2", Outgoing: true})
+	c.Assert(accounts[12], HasLen, 0)
+}
+
+func (s *ParseSuite) TestDeviceIdentity(c *C) {
+	sid, lun, err := parseScsiDevicePath("/sys/devices/platform/host3/session12/target3:0:0/3:0:0:2")
+	c.Assert(err, IsNil)
+	c.Assert(sid, Equals, "12")
+	c.Assert(lun, Equals, 2)
+	_, _, err = parseScsiDevicePath("/sys/devices/pci0000:00/0000:00:1f.2/ata1/host0/target0:0:0/0:0:0:0")
+	c.Assert(err, NotNil)
+
+	serial, err := parseVPDSerial("\x00\x80\x00\x06beaf11")
+	c.Assert(err, IsNil)
+	c.Assert(serial, Equals, "beaf11")
+	c.Assert(serial, Equals, getDefaultLunSerial(1, 1))
+	c.Assert(serial, Not(Equals), getDefaultLunSerial(2, 1))
+	_, err = parseVPDSerial("\x00\x80\x00\x10beaf11")
+	c.Assert(err, NotNil)
+
+	c.Assert(GetLunSerial("iqn.2019-10.io.longhorn:vol1", 1), Equals, GetLunSerial("iqn.2019-10.io.longhorn:vol1", 1))
+	c.Assert(GetLunSerial("iqn.2019-10.io.longhorn:vol1", 1), Not(Equals), GetLunSerial("iqn.2019-10.io.longhorn:vol1", 2))
+	c.Assert(GetLunSerial("iqn.2019-10.io.longhorn:vol1", 1), Not(Equals), GetLunSerial("iqn.2019-10.io.longhorn:vol2", 1))
+	c.Assert(len(GetLunSerial("iqn.2019-10.io.longhorn:vol1", 1)) <= 36, Equals, true)
+}
+
+func (s *ParseSuite) TestSetScsiDeviceTimeoutValidation(c *C) {
+	dev := &util.KernelDevice{Name: "sdx"}
+	c.Assert(SetScsiDeviceTimeout(dev, 0, 0, nil), IsNil)
+	c.Assert(SetScsiDeviceTimeout(dev, 500*time.Millisecond, 0, nil), NotNil)
+	c.Assert(SetScsiDeviceTimeout(dev, 0, 500*time.Millisecond, nil), NotNil)
+	c.Assert(SetScsiDeviceTimeout(dev, 30*time.Second, 500*time.Millisecond, nil), NotNil)
+	c.Assert(ValidateScsiDeviceTimeout(30*time.Second, 10*time.Second), IsNil)
+}
@@ -0,0 +1,448 @@
+package iscsi
+
+import (
+	"bufio"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/go-iscsi-helper/util"
+)
+
+const (
+	sgResetBinary   = "sg_reset"
+	sgTursBinary    = "sg_turs"
+	sgReadcapBinary = "sg_readcap"
+	syncBinary      = "sync"
+	blockdevBinary  = "blockdev"
+	ddBinary        = "dd"
+	diskByIDDir     = "/dev/disk/by-id"
+
+	// DataVerifyBlockSize is the size of the region accessed by the data
+	// verification, the offset must be aligned to it for direct IO
+	DataVerifyBlockSize = 4096
+
+	// ScsiResetDevice resets a single LUN
+	ScsiResetDevice = "device"
+	// ScsiResetTarget resets all LUNs behind the target of the device
+	ScsiResetTarget = "target"
+	// ScsiResetBus resets the bus the device is attached to
+	ScsiResetBus = "bus"
+	// ScsiResetHost resets the SCSI host, for iSCSI this is the session
+	ScsiResetHost = "host"
+
+	ScsiDeviceStateRunning = "running"
+	ScsiDeviceStateOffline = "offline"
+)
+
+var (
+	sgResetOpts = map[string]string{
+		ScsiResetDevice: "-d",
+		ScsiResetTarget: "-t",
+		ScsiResetBus:    "-b",
+		ScsiResetHost:   "-H",
+	}
+)
+
+func getDevicePath(name string) string {
+	return filepath.Join("/dev", name)
+}
+
+func getScsiDeviceSysfsDir(name string) string {
+	return filepath.Join("/sys/block", name, "device")
+}
+
+// readSysfs reads a single value sysfs file in the namespace of ne
+func readSysfs(path string, ne *util.NamespaceExecutor) (string, error) {
+	output, err := ne.Execute("cat", []string{path})
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(output), nil
+}
+
+// writeSysfs writes value to a sysfs file in the namespace of ne
+func writeSysfs(path, value string, ne *util.NamespaceExecutor) error {
+	if _, err := ne.ExecuteWithStdin("tee", []string{path}, value); err != nil {
+		return fmt.Errorf("Failed to write %v to %v: %v", value, path, err)
+	}
+	return nil
+}
+
+// ResetScsiDevice issues a SCSI reset of the specified type toward a wedged
+// device, which aborts all the outstanding tasks covered by the reset. If
+// escalate is true, the kernel error handler is allowed to escalate to the
+// next reset level when the requested one fails.
+func ResetScsiDevice(dev *util.KernelDevice, resetType string, escalate bool, ne *util.NamespaceExecutor) error {
+	resetOpt, ok := sgResetOpts[resetType]
+	if !ok {
+		return fmt.Errorf("Invalid SCSI reset type %v", resetType)
+	}
+	opts := []string{
+		resetOpt,
+	}
+	if !escalate {
+		opts = append(opts, "-N")
+	}
+	opts = append(opts, getDevicePath(dev.Name))
+
+	logrus.Warnf("Issuing SCSI %v reset to device %v", resetType, dev.Name)
+	_, err := ne.Execute(sgResetBinary, opts)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// SetScsiDeviceState changes the state of the SCSI device via sysfs. Setting
+// a device offline fails all the pending and new IO immediately, which can be
+// used to unblock the processes stuck on the device.
+func SetScsiDeviceState(dev *util.KernelDevice, state string, ne *util.NamespaceExecutor) error {
+	if state != ScsiDeviceStateRunning && state != ScsiDeviceStateOffline {
+		return fmt.Errorf("Invalid SCSI device state %v", state)
+	}
+	return writeSysfs(filepath.Join(getScsiDeviceSysfsDir(dev.Name), "state"), state, ne)
+}
+
+// GetScsiDeviceState returns the state of the SCSI device from sysfs
+func GetScsiDeviceState(dev *util.KernelDevice, ne *util.NamespaceExecutor) (string, error) {
+	return readSysfs(filepath.Join(getScsiDeviceSysfsDir(dev.Name), "state"), ne)
+}
+
+// scsiDeviceTimeout is a timeout attribute of the SCSI device in sysfs
+type scsiDeviceTimeout struct {
+	attr  string
+	value time.Duration
+}
+
+// getScsiDeviceTimeouts returns the timeouts in the order they're set
+func getScsiDeviceTimeouts(timeout, ehTimeout time.Duration) []scsiDeviceTimeout {
+	return []scsiDeviceTimeout{
+		{"timeout", timeout},
+		{"eh_timeout", ehTimeout},
+	}
+}
+
+// ValidateScsiDeviceTimeout verifies the timeouts of SetScsiDeviceTimeout,
+// which are either 0 or at least 1s
+func ValidateScsiDeviceTimeout(timeout, ehTimeout time.Duration) error {
+	for _, t := range getScsiDeviceTimeouts(timeout, ehTimeout) {
+		if t.value != 0 && t.value < time.Second {
+			return fmt.Errorf("Invalid SCSI device %v %v, the minimum is 1s", t.attr, t.value)
+		}
+	}
+	return nil
+}
+
+// SetScsiDeviceTimeout sets the command timeout of the SCSI device, after
+// which the kernel error handler aborts the command, and the timeout of the
+// error handler commands, e.g. the aborts and TEST UNIT READY, via sysfs.
+// The timeout not set is left unchanged if it's 0. Both are validated before
+// either is set, and the command timeout is set first.
+func SetScsiDeviceTimeout(dev *util.KernelDevice, timeout, ehTimeout time.Duration, ne *util.NamespaceExecutor) error {
+	if err := ValidateScsiDeviceTimeout(timeout, ehTimeout); err != nil {
+		return err
+	}
+	sysfsDir := getScsiDeviceSysfsDir(dev.Name)
+	for _, t := range getScsiDeviceTimeouts(timeout, ehTimeout) {
+		if t.value == 0 {
+			continue
+		}
+		seconds := strconv.Itoa(int(t.value / time.Second))
+		if err := writeSysfs(filepath.Join(sysfsDir, t.attr), seconds, ne); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetScsiDeviceTimeout returns the command timeout and the error handler
+// timeout of the SCSI device from sysfs
+func GetScsiDeviceTimeout(dev *util.KernelDevice, ne *util.NamespaceExecutor) (time.Duration, time.Duration, error) {
+	sysfsDir := getScsiDeviceSysfsDir(dev.Name)
+	res := []time.Duration{}
+	for _, attr := range []string{"timeout", "eh_timeout"} {
+		output, err := readSysfs(filepath.Join(sysfsDir, attr), ne)
+		if err != nil {
+			return 0, 0, err
+		}
+		seconds, err := strconv.Atoi(output)
+		if err != nil {
+			return 0, 0, fmt.Errorf("Invalid SCSI device %v %v: %v", attr, output, err)
+		}
+		res = append(res, time.Duration(seconds)*time.Second)
+	}
+	return res[0], res[1], nil
+}
+
+// GetScsiDeviceInflight returns the number of the read and the write requests
+// issued to the device but not completed yet
+func GetScsiDeviceInflight(dev *util.KernelDevice, ne *util.NamespaceExecutor) (int, int, error) {
+	output, err := readSysfs(filepath.Join("/sys/block", dev.Name, "inflight"), ne)
+	if err != nil {
+		return 0, 0, err
+	}
+	return parseInflight(output)
+}
+
+func parseInflight(output string) (int, int, error) {
+	var reads, writes int
+	if _, err := fmt.Sscanf(output, "%d %d", &reads, &writes); err != nil {
+		return 0, 0, fmt.Errorf("Invalid inflight output %v: %v", output, err)
+	}
+	return reads, writes, nil
+}
+
+// WaitForScsiDeviceIdle waits up to timeout for the inflight requests of the
+// device to drain, and returns the number of the requests still outstanding.
+// The requests are checked once if timeout is not positive.
+func WaitForScsiDeviceIdle(dev *util.KernelDevice, timeout time.Duration, ne *util.NamespaceExecutor) (int, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		reads, writes, err := GetScsiDeviceInflight(dev, ne)
+		if err != nil {
+			return 0, err
+		}
+		if reads+writes == 0 || time.Now().After(deadline) {
+			return reads + writes, nil
+		}
+		time.Sleep(DeviceWaitPollInterval)
+	}
+}
+
+// VerifyScsiDeviceData writes a unique pattern to the scratch block at offset
+// of the device and reads it back bypassing the page cache, to prove the data
+// path to the backing store is correct. The content of the block is lost.
+func VerifyScsiDeviceData(dev *util.KernelDevice, offset int64, ne *util.NamespaceExecutor) error {
+	pattern := newDataVerifyPattern(dev.Name)
+	if err := writeDataBlock(dev, offset, pattern, ne); err != nil {
+		return err
+	}
+	data, err := readDataBlock(dev, offset, ne)
+	if err != nil {
+		return err
+	}
+	if data != pattern {
+		return fmt.Errorf("Data verification of device %v failed: the pattern written at offset %v is not read back", dev.Name, offset)
+	}
+	return nil
+}
+
+// CheckScsiDeviceSignature verifies the block at offset of the device starts
+// with signature, for the pre-populated devices which cannot be written
+func CheckScsiDeviceSignature(dev *util.KernelDevice, offset int64, signature string, ne *util.NamespaceExecutor) error {
+	if len(signature) > DataVerifyBlockSize {
+		return fmt.Errorf("Signature longer than %v bytes is not supported", DataVerifyBlockSize)
+	}
+	data, err := readDataBlock(dev, offset, ne)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(data, signature) {
+		return fmt.Errorf("Data verification of device %v failed: signature mismatch at offset %v", dev.Name, offset)
+	}
+	return nil
+}
+
+func newDataVerifyPattern(name string) string {
+	line := fmt.Sprintf("go-iscsi-helper data verification %v %v\n", name, time.Now().UnixNano())
+	pattern := strings.Repeat(line, DataVerifyBlockSize/len(line)+1)
+	return pattern[:DataVerifyBlockSize]
+}
+
+func getDataBlockIndex(offset int64) (string, error) {
+	if offset < 0 || offset%DataVerifyBlockSize != 0 {
+		return "", fmt.Errorf("Offset %v is not aligned to %v", offset, DataVerifyBlockSize)
+	}
+	return strconv.FormatInt(offset/DataVerifyBlockSize, 10), nil
+}
+
+func writeDataBlock(dev *util.KernelDevice, offset int64, data string, ne *util.NamespaceExecutor) error {
+	index, err := getDataBlockIndex(offset)
+	if err != nil {
+		return err
+	}
+	opts := []string{
+		"of=" + getDevicePath(dev.Name),
+		"bs=" + strconv.Itoa(DataVerifyBlockSize),
+		"seek=" + index,
+		"count=1",
+		"oflag=direct",
+		"conv=fsync",
+	}
+	if _, err := ne.ExecuteWithStdin(ddBinary, opts, data); err != nil {
+		return fmt.Errorf("Failed to write device %v at offset %v: %v", dev.Name, offset, err)
+	}
+	return nil
+}
+
+func readDataBlock(dev *util.KernelDevice, offset int64, ne *util.NamespaceExecutor) (string, error) {
+	index, err := getDataBlockIndex(offset)
+	if err != nil {
+		return "", err
+	}
+	opts := []string{
+		"if=" + getDevicePath(dev.Name),
+		"bs=" + strconv.Itoa(DataVerifyBlockSize),
+		"skip=" + index,
+		"count=1",
+		"iflag=direct",
+		"status=none",
+	}
+	data, err := ne.Execute(ddBinary, opts)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read device %v at offset %v: %v", dev.Name, offset, err)
+	}
+	return data, nil
+}
+
+// FlushScsiDevice writes back the dirty pages of the device. If flushBuffers
+// is true, the buffer cache of the device is invalidated as well (BLKFLSBUF).
+func FlushScsiDevice(dev *util.KernelDevice, flushBuffers bool, ne *util.NamespaceExecutor) error {
+	devPath := getDevicePath(dev.Name)
+	if _, err := ne.Execute(syncBinary, []string{devPath}); err != nil {
+		return fmt.Errorf("Failed to sync device %v: %v", dev.Name, err)
+	}
+	if !flushBuffers {
+		return nil
+	}
+	if _, err := ne.Execute(blockdevBinary, []string{"--flushbufs", devPath}); err != nil {
+		return fmt.Errorf("Failed to flush buffers of device %v: %v", dev.Name, err)
+	}
+	return nil
+}
+
+// DeleteScsiDevice removes the SCSI device from the kernel via sysfs. The
+// other LUNs of the session are not affected.
+func DeleteScsiDevice(dev *util.KernelDevice, ne *util.NamespaceExecutor) error {
+	return writeSysfs(filepath.Join(getScsiDeviceSysfsDir(dev.Name), "delete"), "1", ne)
+}
+
+// GetDeviceByIDPath returns the /dev/disk/by-id path of the device, which
+// survives the device renumbering across reconnects and reboots. The wwn-
+// links are preferred since they're derived from the LUN identity.
+func GetDeviceByIDPath(dev *util.KernelDevice, ne *util.NamespaceExecutor) (string, error) {
+	var (
+		err   error
+		paths []string
+	)
+	for i := 0; i < DeviceWaitRetryCounts; i++ {
+		// The symlinks are created by udev, which may lag behind the device
+		paths, err = findDeviceByIDPaths(dev, ne)
+		if err == nil && len(paths) != 0 {
+			break
+		}
+		time.Sleep(DeviceWaitRetryInterval)
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(paths) == 0 {
+		return "", fmt.Errorf("Cannot find by-id path for device %v", dev.Name)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if strings.HasPrefix(filepath.Base(path), "wwn-") {
+			return path, nil
+		}
+	}
+	return paths[0], nil
+}
+
+func findDeviceByIDPaths(dev *util.KernelDevice, ne *util.NamespaceExecutor) ([]string, error) {
+	opts := []string{
+		diskByIDDir,
+		"-maxdepth", "1",
+		"-lname", "*/" + dev.Name,
+	}
+	output, err := ne.Execute("find", opts)
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			paths = append(paths, line)
+		}
+	}
+	return paths, nil
+}
+
+// CheckScsiDeviceReady sends TEST UNIT READY to the device through SG_IO, and
+// READ CAPACITY as well if readCapacity is true, to verify the LUN is actually
+// servicing the commands rather than the device node merely exists
+func CheckScsiDeviceReady(dev *util.KernelDevice, readCapacity bool, ne *util.NamespaceExecutor) error {
+	devPath := getDevicePath(dev.Name)
+	if _, err := ne.Execute(sgTursBinary, []string{devPath}); err != nil {
+		return fmt.Errorf("Device %v is not ready: %v", dev.Name, err)
+	}
+	if !readCapacity {
+		return nil
+	}
+	size, err := ReadScsiCapacity(dev, ne)
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		return fmt.Errorf("Device %v is not ready: zero capacity", dev.Name)
+	}
+	return nil
+}
+
+// WaitForScsiDeviceReady retries CheckScsiDeviceReady, since the first
+// commands after login may fail with unit attention
+func WaitForScsiDeviceReady(dev *util.KernelDevice, readCapacity bool, ne *util.NamespaceExecutor) error {
+	var err error
+	for i := 0; i < DeviceWaitRetryCounts; i++ {
+		if err = CheckScsiDeviceReady(dev, readCapacity, ne); err == nil {
+			return nil
+		}
+		time.Sleep(DeviceWaitRetryInterval)
+	}
+	return err
+}
+
+// ReadScsiCapacity returns the capacity of the device in bytes using READ
+// CAPACITY
+func ReadScsiCapacity(dev *util.KernelDevice, ne *util.NamespaceExecutor) (int64, error) {
+	output, err := ne.Execute(sgReadcapBinary, []string{getDevicePath(dev.Name)})
+	if err != nil {
+		return 0, err
+	}
+	return parseReadCapacity(output)
+}
+
+func parseReadCapacity(output string) (int64, error) {
+	/* Output will looks like:
+	Read Capacity results:
+	   Last LBA=8191 (0x1fff), Number of logical blocks=8192
+	   Logical block length=512 bytes
+	Hence:
+	   Device size: 4194304 bytes, 4.0 MiB, 0.00 GB
+	*/
+	var blocks, blockLength int64 = -1, -1
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "Number of logical blocks="); i != -1 {
+			if _, err := fmt.Sscanf(line[i:], "Number of logical blocks=%d", &blocks); err != nil {
+				return 0, fmt.Errorf("Invalid READ CAPACITY output %v: %v", line, err)
+			}
+		}
+		if i := strings.Index(line, "Logical block length="); i != -1 {
+			if _, err := fmt.Sscanf(line[i:], "Logical block length=%d", &blockLength); err != nil {
+				return 0, fmt.Errorf("Invalid READ CAPACITY output %v: %v", line, err)
+			}
+		}
+	}
+	if blocks < 0 || blockLength < 0 {
+		return 0, fmt.Errorf("Cannot find capacity in READ CAPACITY output: %v", output)
+	}
+	return blocks * blockLength, nil
+}
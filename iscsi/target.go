@@ -3,13 +3,18 @@ package iscsi
 import (
 	"bufio"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/sirupsen/logrus"
+
 	"github.com/longhorn/go-iscsi-helper/util"
 )
 
@@ -22,12 +27,20 @@ const (
 	tgtBinary = "tgtadm"
 
 	maxTargetID = 4095
+
+	TargetStateReady   = "ready"
+	TargetStateOffline = "offline"
+
+	RedirectReasonTemporary = "Temporary"
+	RedirectReasonPermanent = "Permanent"
+
+	DefaultPortalPort = 3260
 )
 
 // CreateTarget will create a iSCSI target using the name specified. If name is
 // unspecified, a name will be generated. Notice the name must comply with iSCSI
 // name format.
-func CreateTarget(tid int, name string) error {
+func (t *Tgtd) CreateTarget(tid int, name string) error {
 	opts := []string{
 		"--lld", "iscsi",
 		"--op", "new",
@@ -35,7 +48,7 @@ func CreateTarget(tid int, name string) error {
 		"--tid", strconv.Itoa(tid),
 		"-T", name,
 	}
-	_, err := util.Execute(tgtBinary, opts)
+	_, err := t.execute(opts)
 	if err != nil {
 		return err
 	}
@@ -43,14 +56,14 @@ func CreateTarget(tid int, name string) error {
 }
 
 // DeleteTarget will remove a iSCSI target specified by tid
-func DeleteTarget(tid int) error {
+func (t *Tgtd) DeleteTarget(tid int) error {
 	opts := []string{
 		"--lld", "iscsi",
 		"--op", "delete",
 		"--mode", "target",
 		"--tid", strconv.Itoa(tid),
 	}
-	_, err := util.Execute(tgtBinary, opts)
+	_, err := t.execute(opts)
 	if err != nil {
 		return err
 	}
@@ -59,7 +72,7 @@ func DeleteTarget(tid int) error {
 
 // AddLunBackedByFile will add a LUN in an existing target, which backing by
 // specified file.
-func AddLunBackedByFile(tid int, lun int, backingFile string) error {
+func (t *Tgtd) AddLunBackedByFile(tid int, lun int, backingFile string) error {
 	opts := []string{
 		"--lld", "iscsi",
 		"--op", "new",
@@ -68,7 +81,7 @@ func AddLunBackedByFile(tid int, lun int, backingFile string) error {
 		"--lun", strconv.Itoa(lun),
 		"-b", backingFile,
 	}
-	_, err := util.Execute(tgtBinary, opts)
+	_, err := t.execute(opts)
 	if err != nil {
 		return err
 	}
@@ -77,8 +90,8 @@ func AddLunBackedByFile(tid int, lun int, backingFile string) error {
 
 // AddLun will add a LUN in an existing target, which backing by
 // specified file, using AIO backing-store
-func AddLun(tid int, lun int, backingFile string, bstype string, bsopts string) error {
-	if !CheckTargetForBackingStore(bstype) {
+func (t *Tgtd) AddLun(tid int, lun int, backingFile string, bstype string, bsopts string) error {
+	if !t.CheckTargetForBackingStore(bstype) {
 		return fmt.Errorf("Backing-store %s is not supported", bstype)
 	}
 	opts := []string{
@@ -93,7 +106,7 @@ func AddLun(tid int, lun int, backingFile string, bstype string, bsopts string)
 	if bsopts != "" {
 		opts = append(opts, "--bsopts", bsopts)
 	}
-	_, err := util.Execute(tgtBinary, opts)
+	_, err := t.execute(opts)
 	if err != nil {
 		return err
 	}
@@ -101,7 +114,7 @@ func AddLun(tid int, lun int, backingFile string, bstype string, bsopts string)
 }
 
 // DeleteLun will remove a LUN from an target
-func DeleteLun(tid int, lun int) error {
+func (t *Tgtd) DeleteLun(tid int, lun int) error {
 	opts := []string{
 		"--lld", "iscsi",
 		"--op", "delete",
@@ -109,16 +122,335 @@ func DeleteLun(tid int, lun int) error {
 		"--tid", strconv.Itoa(tid),
 		"--lun", strconv.Itoa(lun),
 	}
-	_, err := util.Execute(tgtBinary, opts)
+	_, err := t.execute(opts)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// UpdateTargetState will change the state of the target. The initiators see
+// a not-ready condition when the target is offline, instead of the connection
+// resets.
+func (t *Tgtd) UpdateTargetState(tid int, state string) error {
+	if state != TargetStateReady && state != TargetStateOffline {
+		return fmt.Errorf("Invalid target state %v", state)
+	}
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "update",
+		"--mode", "target",
+		"--tid", strconv.Itoa(tid),
+		"--name", "state",
+		"--value", state,
+	}
+	_, err := t.execute(opts)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetTargetState returns the state of the target
+func (t *Tgtd) GetTargetState(tid int) (string, error) {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "show",
+		"--mode", "target",
+	}
+	output, err := t.execute(opts)
+	if err != nil {
+		return "", err
+	}
+	return parseTargetState(output, tid)
+}
+
+func parseTargetState(output string, tid int) (string, error) {
+	/* Output will looks like:
+	Target 1: iqn.2016-08.com.example:a
+	    System information:
+	        Driver: iscsi
+	        State: ready
+	*/
+	targetPrefix := fmt.Sprintf("Target %d: ", tid)
+	inTarget := false
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "Target ") {
+			inTarget = strings.HasPrefix(line, targetPrefix)
+			continue
+		}
+		line = strings.TrimSpace(line)
+		if inTarget && strings.HasPrefix(line, "State: ") {
+			return strings.TrimPrefix(line, "State: "), nil
+		}
+	}
+	return "", fmt.Errorf("Cannot find the state of target %v", tid)
+}
+
+// UpdateTargetParam will update the iSCSI parameter of the target, which is
+// applied to the sessions established afterwards
+func (t *Tgtd) UpdateTargetParam(tid int, name, value string) error {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "update",
+		"--mode", "target",
+		"--tid", strconv.Itoa(tid),
+		"--name", name,
+		"--value", value,
+	}
+	_, err := t.execute(opts)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// SetTargetRedirect makes the target redirect the logins to the portal with
+// the reason, RedirectReasonTemporary or RedirectReasonPermanent. The existing
+// sessions are redirected on their next login, e.g. after the connections are
+// closed.
+func (t *Tgtd) SetTargetRedirect(tid int, ip string, port int, reason string) error {
+	if err := t.UpdateTargetParam(tid, "RedirectAddress", ip); err != nil {
+		return err
+	}
+	if err := t.UpdateTargetParam(tid, "RedirectPort", strconv.Itoa(port)); err != nil {
+		return err
+	}
+	return t.UpdateTargetParam(tid, "RedirectReason", reason)
+}
+
+// UpdateLunOnline will set the LUN online or offline, without removing it
+// from the target
+func (t *Tgtd) UpdateLunOnline(tid int, lun int, online bool) error {
+	value := "0"
+	if online {
+		value = "1"
+	}
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "update",
+		"--mode", "logicalunit",
+		"--tid", strconv.Itoa(tid),
+		"--lun", strconv.Itoa(lun),
+		"--params", "online=" + value,
+	}
+	_, err := t.execute(opts)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// LunStats is the IO statistics of a LUN accumulated by tgtd
+type LunStats struct {
+	LUN        int
+	ReadOps    int64
+	WriteOps   int64
+	ReadBytes  int64
+	WriteBytes int64
+}
+
+// GetLunStats returns the IO statistics of all the LUNs of the target from
+// the target side, which doesn't require the access to the initiator
+func (t *Tgtd) GetLunStats(tid int) ([]*LunStats, error) {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "stat",
+		"--mode", "target",
+		"--tid", strconv.Itoa(tid),
+	}
+	output, err := t.execute(opts)
+	if err != nil {
+		return nil, err
+	}
+	return parseLunStats(output)
+}
+
+func parseLunStats(output string) ([]*LunStats, error) {
+	/* Output will looks like:
+	LUN: 0
+	    Read ops: 0
+	    Write ops: 0
+	    Read bytes: 0
+	    Write bytes: 0
+	LUN: 1
+	    Read ops: 120
+	    Write ops: 36
+	    Read bytes: 491520
+	    Write bytes: 147456
+	*/
+	res := []*LunStats{}
+	var stats *LunStats
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(fields[0])
+		value, err := strconv.ParseInt(strings.TrimSpace(fields[1]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("BUG: Fail to parse %s, %v", scanner.Text(), err)
+		}
+		if key == "LUN" {
+			stats = &LunStats{LUN: int(value)}
+			res = append(res, stats)
+			continue
+		}
+		if stats == nil {
+			return nil, fmt.Errorf("BUG: Fail to parse %s, LUN is missing", scanner.Text())
+		}
+		switch key {
+		case "Read ops":
+			stats.ReadOps = value
+		case "Write ops":
+			stats.WriteOps = value
+		case "Read bytes":
+			stats.ReadBytes = value
+		case "Write bytes":
+			stats.WriteBytes = value
+		}
+	}
+	return res, nil
+}
+
+// IsLunOnline returns whether the LUN of the target is online
+func (t *Tgtd) IsLunOnline(tid int, lun int) (bool, error) {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "show",
+		"--mode", "target",
+	}
+	output, err := t.execute(opts)
+	if err != nil {
+		return false, err
+	}
+	return parseLunOnline(output, tid, lun)
+}
+
+func parseLunOnline(output string, tid int, lun int) (bool, error) {
+	/* Output will looks like:
+	Target 1: iqn.2016-08.com.example:a
+	    ...
+	    LUN information:
+	        LUN: 0
+	            Type: controller
+	            ...
+	            Online: Yes
+	        LUN: 1
+	            Type: disk
+	            ...
+	            Online: No
+	*/
+	targetPrefix := fmt.Sprintf("Target %d: ", tid)
+	lunLine := fmt.Sprintf("LUN: %d", lun)
+	inTarget := false
+	inLun := false
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "Target ") {
+			inTarget = strings.HasPrefix(line, targetPrefix)
+			inLun = false
+			continue
+		}
+		if !inTarget {
+			continue
+		}
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "LUN: ") {
+			inLun = line == lunLine
+			continue
+		}
+		if inLun && strings.HasPrefix(line, "Online: ") {
+			return strings.TrimPrefix(line, "Online: ") == "Yes", nil
+		}
+	}
+	return false, fmt.Errorf("Cannot find LUN %v of target %v", lun, tid)
+}
+
+// Lun is a LUN of a target as reported by tgtd
+type Lun struct {
+	LUN              int
+	Type             string
+	Online           bool
+	BackingStoreType string
+	BackingStorePath string
+}
+
+// GetLuns returns the LUNs of the target, including the controller LUN 0
+func (t *Tgtd) GetLuns(tid int) ([]*Lun, error) {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "show",
+		"--mode", "target",
+	}
+	output, err := t.execute(opts)
+	if err != nil {
+		return nil, err
+	}
+	return parseLuns(output, tid)
+}
+
+func parseLuns(output string, tid int) ([]*Lun, error) {
+	// See parseLunOnline for the format
+	targetPrefix := fmt.Sprintf("Target %d: ", tid)
+	inTarget := false
+	found := false
+	res := []*Lun{}
+	var lun *Lun
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "Target ") {
+			inTarget = strings.HasPrefix(line, targetPrefix)
+			found = found || inTarget
+			lun = nil
+			continue
+		}
+		if !inTarget {
+			continue
+		}
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "LUN: ") {
+			id, err := strconv.Atoi(strings.TrimPrefix(line, "LUN: "))
+			if err != nil {
+				return nil, fmt.Errorf("BUG: Fail to parse %s, %v", line, err)
+			}
+			lun = &Lun{LUN: id}
+			res = append(res, lun)
+			continue
+		}
+		if lun == nil {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(kv[1])
+		switch kv[0] {
+		case "Type":
+			lun.Type = value
+		case "Online":
+			lun.Online = value == "Yes"
+		case "Backing store type":
+			lun.BackingStoreType = value
+		case "Backing store path":
+			lun.BackingStorePath = value
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("Cannot find target %v", tid)
+	}
+	return res, nil
+}
+
 // BindInitiator will add permission to allow certain initiator(s) to connect to
 // certain target. "ALL" is a special initiator which is the wildcard
-func BindInitiator(tid int, initiator string) error {
+func (t *Tgtd) BindInitiator(tid int, initiator string) error {
 	opts := []string{
 		"--lld", "iscsi",
 		"--op", "bind",
@@ -126,7 +458,7 @@ func BindInitiator(tid int, initiator string) error {
 		"--tid", strconv.Itoa(tid),
 		"-I", initiator,
 	}
-	_, err := util.Execute(tgtBinary, opts)
+	_, err := t.execute(opts)
 	if err != nil {
 		return err
 	}
@@ -135,7 +467,7 @@ func BindInitiator(tid int, initiator string) error {
 
 // UnbindInitiator will remove permission to allow certain initiator(s) to connect to
 // certain target.
-func UnbindInitiator(tid int, initiator string) error {
+func (t *Tgtd) UnbindInitiator(tid int, initiator string) error {
 	opts := []string{
 		"--lld", "iscsi",
 		"--op", "unbind",
@@ -143,88 +475,433 @@ func UnbindInitiator(tid int, initiator string) error {
 		"--tid", strconv.Itoa(tid),
 		"-I", initiator,
 	}
-	_, err := util.Execute(tgtBinary, opts)
+	_, err := t.execute(opts)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// BindInitiatorName will add permission to allow the initiator with the
+// specified IQN to connect to certain target
+func (t *Tgtd) BindInitiatorName(tid int, initiatorName string) error {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "bind",
+		"--mode", "target",
+		"--tid", strconv.Itoa(tid),
+		"-Q", initiatorName,
+	}
+	_, err := t.execute(opts)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// UnbindInitiatorName will remove permission of the initiator with the
+// specified IQN to connect to certain target
+func (t *Tgtd) UnbindInitiatorName(tid int, initiatorName string) error {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "unbind",
+		"--mode", "target",
+		"--tid", strconv.Itoa(tid),
+		"-Q", initiatorName,
+	}
+	_, err := t.execute(opts)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Portal is an address tgtd accepts the iSCSI connections on. tgtd portals
+// are shared by all the targets and always in the portal group Tag.
+type Portal struct {
+	IP   string
+	Port string
+	Tag  int
+}
+
+// String returns the portal in the IP:Port format, which is accepted by
+// iscsiadm as well
+func (p *Portal) String() string {
+	return net.JoinHostPort(p.IP, p.Port)
+}
+
+// AddPortal will make tgtd listen on the new portal, so the targets become
+// reachable through the address before the old portal is removed
+func (t *Tgtd) AddPortal(ip string, port int) error {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "new",
+		"--mode", "portal",
+		"--param", "portal=" + net.JoinHostPort(ip, strconv.Itoa(port)),
+	}
+	_, err := t.execute(opts)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeletePortal will stop tgtd from listening on the portal. The existing
+// connections through the portal are not affected.
+func (t *Tgtd) DeletePortal(ip string, port int) error {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "delete",
+		"--mode", "portal",
+		"--param", "portal=" + net.JoinHostPort(ip, strconv.Itoa(port)),
+	}
+	_, err := t.execute(opts)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// GetPortals returns the portals tgtd is listening on
+func (t *Tgtd) GetPortals() ([]*Portal, error) {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "show",
+		"--mode", "portal",
+	}
+	output, err := t.execute(opts)
+	if err != nil {
+		return nil, err
+	}
+	return parsePortals(output)
+}
+
+func parsePortals(output string) ([]*Portal, error) {
+	/* Output will looks like:
+	Portal: 0.0.0.0:3260,1
+	Portal: [::]:3260,1
+	*/
+	res := []*Portal{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "Portal: ") {
+			continue
+		}
+		portal, err := parsePortal(strings.TrimPrefix(line, "Portal: "))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, portal)
+	}
+	return res, nil
+}
+
+// parsePortal parses the portal in the IP:Port,Tag format
+func parsePortal(s string) (*Portal, error) {
+	portal := &Portal{}
+	address := s
+	if i := strings.LastIndex(s, ","); i != -1 {
+		tag, err := strconv.Atoi(s[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse portal group tag of %v: %v", s, err)
+		}
+		portal.Tag = tag
+		address = s[:i]
+	}
+	ip, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse portal %v: %v", s, err)
+	}
+	portal.IP = ip
+	portal.Port = port
+	return portal, nil
+}
+
+// EnableISNS will register all the targets of tgtd to the iSNS server, so the
+// initiators can discover them through iSNS. If accessControl is true, the
+// iSNS server decides which initiators can discover the targets.
+func (t *Tgtd) EnableISNS(serverIP string, port int, accessControl bool) error {
+	params := [][]string{
+		{"iSNSServerIP", serverIP},
+		{"iSNSServerPort", strconv.Itoa(port)},
+		{"iSNSAccessControl", onOff(accessControl)},
+		{"iSNS", "On"},
+	}
+	for _, param := range params {
+		if err := t.updateSystemParam(param[0], param[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DisableISNS will stop tgtd from talking to the iSNS server
+func (t *Tgtd) DisableISNS() error {
+	return t.updateSystemParam("iSNS", "Off")
+}
+
+func (t *Tgtd) updateSystemParam(name, value string) error {
+	opts := []string{
+		"--op", "update",
+		"--mode", "sys",
+		"--name", name,
+		"--value", value,
+	}
+	_, err := t.execute(opts)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func onOff(on bool) string {
+	if on {
+		return "On"
+	}
+	return "Off"
+}
+
+// GetTargetPortals returns the portals the target is exported on. The tgtd
+// portals are shared by all the targets, and the wildcard portals are expanded
+// to the addresses of the host, so the result can be used by the initiators
+// directly.
+func (t *Tgtd) GetTargetPortals(name string) ([]*Portal, error) {
+	tid, err := t.GetTargetTid(name)
+	if err != nil {
+		return nil, err
+	}
+	if tid == -1 {
+		return nil, fmt.Errorf("target %v doesn't exist", name)
+	}
+	portals, err := t.GetPortals()
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	return expandPortals(portals, addrs), nil
+}
+
+func expandPortals(portals []*Portal, addrs []net.Addr) []*Portal {
+	res := []*Portal{}
+	for _, portal := range portals {
+		ip := net.ParseIP(portal.IP)
+		if ip == nil || !ip.IsUnspecified() {
+			res = append(res, portal)
+			continue
+		}
+		// tgtd listens on IPv6 only for the IPv6 wildcard
+		isIPv4 := ip.To4() != nil
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			if (ipNet.IP.To4() != nil) != isIPv4 {
+				continue
+			}
+			res = append(res, &Portal{
+				IP:   ipNet.IP.String(),
+				Port: portal.Port,
+				Tag:  portal.Tag,
+			})
+		}
+	}
+	return res
+}
+
+const (
+	tgtdBinary     = "tgtd"
+	tgtAdminBinary = "tgt-admin"
+
+	DefaultTgtdLogFile = "/var/log/tgtd.log"
+
+	startFailureLogLines = 20
+)
+
+// DaemonOptions customizes how StartDaemonWithOptions launches tgtd
+type DaemonOptions struct {
+	Debug bool
+	// Portal is the IP:Port tgtd listens on instead of the default one,
+	// which needs to differ between the tgtd instances
+	Portal string
+	// ExtraArgs are appended to the command line of tgtd
+	ExtraArgs []string
+	// ConfigDir is the directory of targets.conf, which is applied by
+	// tgt-admin after tgtd is started if it's set
+	ConfigDir string
+	// LogFile receives the output of tgtd, default to DefaultTgtdLogFile
+	LogFile string
+}
+
 // StartDaemon will start tgtd daemon, prepare for further commands
 func StartDaemon(debug bool) error {
-	if CheckTargetForBackingStore("rdwr") {
+	return DefaultTgtd.StartDaemonWithOptions(&DaemonOptions{
+		Debug: debug,
+	})
+}
+
+// StartDaemonWithOptions starts tgtd with the options if it's not running
+func (t *Tgtd) StartDaemonWithOptions(options *DaemonOptions) error {
+	if t.CheckTargetForBackingStore("rdwr") {
 		fmt.Fprintf(os.Stderr, "go-iscsi-helper: tgtd is already running\n")
 		return nil
 	}
 
-	logFile := "/var/log/tgtd.log"
+	logFile := options.LogFile
+	if logFile == "" {
+		logFile = DefaultTgtdLogFile
+	}
 	logf, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
-	go startDaemon(logf, debug)
+	// The exit of tgtd is received only while waiting for it to start up,
+	// see startDaemon
+	exited := make(chan error)
+	startup := make(chan struct{})
+	defer close(startup)
+	t.setDaemonExitError(nil)
+	go t.startDaemon(logf, options, exited, startup)
 
 	// Wait until daemon is up
 	daemonIsRunning := false
 	for i := 0; i < TgtdRetryCounts; i++ {
-		if CheckTargetForBackingStore("rdwr") {
+		select {
+		case err := <-exited:
+			return fmt.Errorf("Fail to start tgtd daemon: %v, recent logs:\n%v",
+				err, strings.Join(t.GetDaemonLogs(startFailureLogLines), "\n"))
+		default:
+		}
+		if t.CheckTargetForBackingStore("rdwr") {
 			daemonIsRunning = true
 			break
 		}
 		time.Sleep(TgtdRetryInterval)
 	}
 	if !daemonIsRunning {
-		return fmt.Errorf("Fail to start tgtd daemon")
+		return fmt.Errorf("Fail to start tgtd daemon, recent logs:\n%v",
+			strings.Join(t.GetDaemonLogs(startFailureLogLines), "\n"))
+	}
+
+	if options.ConfigDir != "" {
+		configFile := filepath.Join(options.ConfigDir, "targets.conf")
+		if _, err := util.Execute(tgtAdminBinary, append(t.controlPortArgs(), "--execute", "--conf", configFile)); err != nil {
+			return fmt.Errorf("Fail to apply tgtd config %v: %v", configFile, err)
+		}
 	}
 	return nil
 }
 
-func startDaemon(logf *os.File, debug bool) {
+// startDaemon runs tgtd until it exits. If it exits while
+// StartDaemonWithOptions is still waiting for it, the error is sent to exited
+// so the failure is reported on startup, otherwise the error is logged and
+// kept for GetDaemonExitError once startup is closed, since the targets are
+// gone with tgtd.
+func (t *Tgtd) startDaemon(logf *os.File, options *DaemonOptions, exited chan<- error, startup <-chan struct{}) {
 	defer logf.Close()
 
 	opts := []string{
 		"-f",
 	}
-	if debug {
+	opts = append(opts, t.controlPortArgs()...)
+	if options.Portal != "" {
+		opts = append(opts, "--iscsi", "portal="+options.Portal)
+	}
+	if options.Debug {
 		opts = append(opts, "-d", "1")
 	}
-	cmd := exec.Command("tgtd", opts...)
-	mw := io.MultiWriter(os.Stderr, logf)
+	opts = append(opts, options.ExtraArgs...)
+	cmd := exec.Command(tgtdBinary, opts...)
+	mw := io.MultiWriter(os.Stderr, logf, t.logs)
 	cmd.Stdout = mw
 	cmd.Stderr = mw
 	if err := cmd.Run(); err != nil {
-		if CheckTargetForBackingStore("rdwr") {
+		if t.CheckTargetForBackingStore("rdwr") {
 			fmt.Fprintf(mw, "go-iscsi-helper: tgtd is already running\n")
 			return
 		}
 		fmt.Fprintf(mw, "go-iscsi-helper: command failed: %v\n", err)
-		panic(err)
+		select {
+		case exited <- err:
+		case <-startup:
+			logrus.Errorf("go-iscsi-helper: tgtd exited unexpectedly: %v", err)
+			t.setDaemonExitError(err)
+		}
+		return
 	}
 	fmt.Fprintln(mw, "go-iscsi-helper: done")
+	select {
+	case exited <- fmt.Errorf("tgtd exited"):
+	case <-startup:
+	}
 }
 
-func CheckTargetForBackingStore(name string) bool {
+func (t *Tgtd) CheckTargetForBackingStore(name string) bool {
 	opts := []string{
 		"--lld", "iscsi",
 		"--op", "show",
 		"--mode", "system",
 	}
-	output, err := util.Execute(tgtBinary, opts)
+	output, err := t.execute(opts)
 	if err != nil {
 		return false
 	}
 	return strings.Contains(output, " "+name)
 }
 
+// GetBackingStores returns the backing stores supported by the running tgtd
+func (t *Tgtd) GetBackingStores() ([]string, error) {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "show",
+		"--mode", "system",
+	}
+	output, err := t.execute(opts)
+	if err != nil {
+		return nil, err
+	}
+	/* Output will looks like:
+	System:
+	    State: ready
+	    debug: off
+	Backing stores:
+	    rdwr (bsoflags sync:direct)
+	    aio
+	    longhorn
+	Device types:
+	    ...
+	*/
+	res := []string{}
+	inBackingStores := false
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t") {
+			inBackingStores = strings.HasPrefix(line, "Backing stores:")
+			continue
+		}
+		if inBackingStores {
+			if fields := strings.Fields(line); len(fields) != 0 {
+				res = append(res, fields[0])
+			}
+		}
+	}
+	return res, nil
+}
+
 // GetTargetTid If returned TID is -1, then target doesn't exist, but we won't
 // return error
-func GetTargetTid(name string) (int, error) {
+func (t *Tgtd) GetTargetTid(name string) (int, error) {
 	opts := []string{
 		"--lld", "iscsi",
 		"--op", "show",
 		"--mode", "target",
 	}
-	output, err := util.Execute(tgtBinary, opts)
+	output, err := t.execute(opts)
 	if err != nil {
 		return -1, err
 	}
@@ -251,26 +928,69 @@ func GetTargetTid(name string) (int, error) {
 	return tid, nil
 }
 
-func ShutdownTgtd() error {
+// GetTargets returns the names of all the targets of tgtd indexed by TID
+func (t *Tgtd) GetTargets() (map[int]string, error) {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "show",
+		"--mode", "target",
+	}
+	output, err := t.execute(opts)
+	if err != nil {
+		return nil, err
+	}
+	return parseTargets(output)
+}
+
+func parseTargets(output string) (map[int]string, error) {
+	/* Output will looks like:
+	Target 1: iqn.2016-08.com.example:a
+		System information:
+		...
+	Target 2: iqn.2016-08.com.example:b
+		System information:
+		...
+	*/
+	res := map[int]string{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		if !strings.HasPrefix(scanner.Text(), "Target ") {
+			continue
+		}
+		fields := strings.SplitN(scanner.Text(), ": ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("BUG: Fail to parse %s", scanner.Text())
+		}
+		tidString := strings.TrimPrefix(fields[0], "Target ")
+		tid, err := strconv.Atoi(tidString)
+		if err != nil {
+			return nil, fmt.Errorf("BUG: Fail to parse %s, %v", tidString, err)
+		}
+		res[tid] = strings.TrimSpace(fields[1])
+	}
+	return res, nil
+}
+
+func (t *Tgtd) ShutdownTgtd() error {
 	opts := []string{
 		"--op", "delete",
 		"--mode", "system",
 	}
-	_, err := util.Execute(tgtBinary, opts)
+	_, err := t.execute(opts)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func GetTargetConnections(tid int) (map[string][]string, error) {
+func (t *Tgtd) GetTargetConnections(tid int) (map[string][]string, error) {
 	opts := []string{
 		"--lld", "iscsi",
 		"--op", "show",
 		"--mode", "conn",
 		"--tid", strconv.Itoa(tid),
 	}
-	output, err := util.Execute(tgtBinary, opts)
+	output, err := t.execute(opts)
 	if err != nil {
 		return nil, err
 	}
@@ -324,7 +1044,79 @@ func GetTargetConnections(tid int) (map[string][]string, error) {
 	return res, nil
 }
 
-func CloseConnection(tid int, sid, cid string) error {
+// TargetSession is an initiator session connected to a target
+type TargetSession struct {
+	SID         string
+	Initiator   string
+	IPAddresses []string
+	CIDs        []string
+}
+
+// GetTargetSessions returns the sessions connected to the target, along with
+// the initiators of them
+func (t *Tgtd) GetTargetSessions(tid int) ([]*TargetSession, error) {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "show",
+		"--mode", "conn",
+		"--tid", strconv.Itoa(tid),
+	}
+	output, err := t.execute(opts)
+	if err != nil {
+		return nil, err
+	}
+	return parseTargetSessions(output)
+}
+
+func parseTargetSessions(output string) ([]*TargetSession, error) {
+	/* Output will looks like:
+	Session: 11
+	    Connection: 0
+	        Initiator: iqn.2016-08.com.example:a alias: node-a
+	        IP Address: 192.168.0.1
+	*/
+	res := []*TargetSession{}
+	var session *TargetSession
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		fields := strings.SplitN(line, ": ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		key, value := fields[0], strings.TrimSpace(fields[1])
+		if key == "Session" {
+			if _, err := strconv.Atoi(value); err != nil {
+				return nil, fmt.Errorf("failed to parse and get session id from line %v", line)
+			}
+			session = &TargetSession{
+				SID:         value,
+				IPAddresses: []string{},
+				CIDs:        []string{},
+			}
+			res = append(res, session)
+			continue
+		}
+		if session == nil {
+			continue
+		}
+		switch key {
+		case "Connection":
+			if _, err := strconv.Atoi(value); err != nil {
+				return nil, fmt.Errorf("failed to parse and get connection id from line %v", line)
+			}
+			session.CIDs = append(session.CIDs, value)
+		case "Initiator":
+			// The initiator name may be followed by its alias
+			session.Initiator = strings.Fields(value)[0]
+		case "IP Address":
+			session.IPAddresses = append(session.IPAddresses, value)
+		}
+	}
+	return res, nil
+}
+
+func (t *Tgtd) CloseConnection(tid int, sid, cid string) error {
 	opts := []string{
 		"--lld", "iscsi",
 		"--op", "delete",
@@ -333,21 +1125,46 @@ func CloseConnection(tid int, sid, cid string) error {
 		"--sid", sid,
 		"--cid", cid,
 	}
-	_, err := util.Execute(tgtBinary, opts)
+	_, err := t.execute(opts)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func FindNextAvailableTargetID() (int, error) {
+// FindTargetIDForName derives the TID from the hash of the target name, so a
+// target gets the same TID across the restarts. The following TIDs are probed
+// in case of collision, skipping the ones taken by the other targets.
+func (t *Tgtd) FindTargetIDForName(name string) (int, error) {
+	targets, err := t.GetTargets()
+	if err != nil {
+		return -1, err
+	}
+	return hashTargetID(name, targets)
+}
+
+func hashTargetID(name string, existing map[int]string) (int, error) {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	start := int(h.Sum32() % uint32(maxTargetID))
+	for i := 0; i < maxTargetID; i++ {
+		// TID 0 is reserved by tgtd
+		tid := (start+i)%maxTargetID + 1
+		if other, exists := existing[tid]; !exists || other == name {
+			return tid, nil
+		}
+	}
+	return -1, fmt.Errorf("Cannot find available target ID for %v", name)
+}
+
+func (t *Tgtd) FindNextAvailableTargetID() (int, error) {
 	existingTids := map[int]struct{}{}
 	opts := []string{
 		"--lld", "iscsi",
 		"--op", "show",
 		"--mode", "target",
 	}
-	output, err := util.Execute(tgtBinary, opts)
+	output, err := t.execute(opts)
 	if err != nil {
 		return -1, err
 	}
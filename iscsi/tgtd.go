@@ -0,0 +1,242 @@
+package iscsi
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/longhorn/go-iscsi-helper/util"
+)
+
+// Tgtd is a tgtd instance managed through its control port. Running more
+// than one instance isolates the targets, e.g. of the noisy tenants or the
+// tests, from the main daemon on the same node, as long as each instance
+// listens on its own portal, see DaemonOptions.Portal.
+type Tgtd struct {
+	// ControlPort is passed to tgtd and tgtadm by --control-port, the
+	// default instance uses 0
+	ControlPort int
+
+	logs *lineBuffer
+
+	daemonLock *sync.Mutex
+	// daemonErr is why the tgtd started by the instance exited after the
+	// startup, see GetDaemonExitError
+	daemonErr error
+}
+
+// DefaultTgtd is the instance managed by the package-level functions
+var DefaultTgtd = NewTgtd(0)
+
+func NewTgtd(controlPort int) *Tgtd {
+	return &Tgtd{
+		ControlPort: controlPort,
+		logs:        newLineBuffer(),
+		daemonLock:  &sync.Mutex{},
+	}
+}
+
+// GetDaemonExitError returns the error tgtd started by the instance exited
+// with after its startup, in which case the targets are gone. It returns nil
+// if tgtd is running, exited normally e.g. by ShutdownTgtd, or wasn't
+// started by the instance.
+func (t *Tgtd) GetDaemonExitError() error {
+	t.daemonLock.Lock()
+	defer t.daemonLock.Unlock()
+	return t.daemonErr
+}
+
+func (t *Tgtd) setDaemonExitError(err error) {
+	t.daemonLock.Lock()
+	defer t.daemonLock.Unlock()
+	t.daemonErr = err
+}
+
+func (t *Tgtd) controlPortArgs() []string {
+	if t.ControlPort == 0 {
+		return []string{}
+	}
+	return []string{"--control-port", strconv.Itoa(t.ControlPort)}
+}
+
+func (t *Tgtd) execute(opts []string) (string, error) {
+	return util.Execute(tgtBinary, append(t.controlPortArgs(), opts...))
+}
+
+// The functions below manage DefaultTgtd, see the methods of Tgtd for the
+// details.
+
+func GetDaemonLogs(n int) []string {
+	return DefaultTgtd.GetDaemonLogs(n)
+}
+
+func CreateTarget(tid int, name string) error {
+	return DefaultTgtd.CreateTarget(tid, name)
+}
+
+func DeleteTarget(tid int) error {
+	return DefaultTgtd.DeleteTarget(tid)
+}
+
+func AddLunBackedByFile(tid int, lun int, backingFile string) error {
+	return DefaultTgtd.AddLunBackedByFile(tid, lun, backingFile)
+}
+
+func AddLun(tid int, lun int, backingFile string, bstype string, bsopts string) error {
+	return DefaultTgtd.AddLun(tid, lun, backingFile, bstype, bsopts)
+}
+
+func DeleteLun(tid int, lun int) error {
+	return DefaultTgtd.DeleteLun(tid, lun)
+}
+
+func UpdateTargetState(tid int, state string) error {
+	return DefaultTgtd.UpdateTargetState(tid, state)
+}
+
+func GetTargetState(tid int) (string, error) {
+	return DefaultTgtd.GetTargetState(tid)
+}
+
+func UpdateTargetParam(tid int, name, value string) error {
+	return DefaultTgtd.UpdateTargetParam(tid, name, value)
+}
+
+func SetTargetRedirect(tid int, ip string, port int, reason string) error {
+	return DefaultTgtd.SetTargetRedirect(tid, ip, port, reason)
+}
+
+func UpdateLunOnline(tid int, lun int, online bool) error {
+	return DefaultTgtd.UpdateLunOnline(tid, lun, online)
+}
+
+func SetLunSerial(tid int, lun int, serial string) error {
+	return DefaultTgtd.SetLunSerial(tid, lun, serial)
+}
+
+func GetLunStats(tid int) ([]*LunStats, error) {
+	return DefaultTgtd.GetLunStats(tid)
+}
+
+func IsLunOnline(tid int, lun int) (bool, error) {
+	return DefaultTgtd.IsLunOnline(tid, lun)
+}
+
+func GetLuns(tid int) ([]*Lun, error) {
+	return DefaultTgtd.GetLuns(tid)
+}
+
+func BindInitiator(tid int, initiator string) error {
+	return DefaultTgtd.BindInitiator(tid, initiator)
+}
+
+func UnbindInitiator(tid int, initiator string) error {
+	return DefaultTgtd.UnbindInitiator(tid, initiator)
+}
+
+func BindInitiatorName(tid int, initiatorName string) error {
+	return DefaultTgtd.BindInitiatorName(tid, initiatorName)
+}
+
+func UnbindInitiatorName(tid int, initiatorName string) error {
+	return DefaultTgtd.UnbindInitiatorName(tid, initiatorName)
+}
+
+func CreateAccount(user, password string) error {
+	return DefaultTgtd.CreateAccount(user, password)
+}
+
+func DeleteAccount(user string) error {
+	return DefaultTgtd.DeleteAccount(user)
+}
+
+func UpdateAccountPassword(user, password string) error {
+	return DefaultTgtd.UpdateAccountPassword(user, password)
+}
+
+func ListAccounts() ([]string, error) {
+	return DefaultTgtd.ListAccounts()
+}
+
+func BindAccount(tid int, user string, outgoing bool) error {
+	return DefaultTgtd.BindAccount(tid, user, outgoing)
+}
+
+func UnbindAccount(tid int, user string, outgoing bool) error {
+	return DefaultTgtd.UnbindAccount(tid, user, outgoing)
+}
+
+func GetTargetAccounts(tid int) ([]*Account, error) {
+	return DefaultTgtd.GetTargetAccounts(tid)
+}
+
+func AddPortal(ip string, port int) error {
+	return DefaultTgtd.AddPortal(ip, port)
+}
+
+func DeletePortal(ip string, port int) error {
+	return DefaultTgtd.DeletePortal(ip, port)
+}
+
+func GetPortals() ([]*Portal, error) {
+	return DefaultTgtd.GetPortals()
+}
+
+func EnableISNS(serverIP string, port int, accessControl bool) error {
+	return DefaultTgtd.EnableISNS(serverIP, port, accessControl)
+}
+
+func DisableISNS() error {
+	return DefaultTgtd.DisableISNS()
+}
+
+func GetTargetPortals(name string) ([]*Portal, error) {
+	return DefaultTgtd.GetTargetPortals(name)
+}
+
+func StartDaemonWithOptions(options *DaemonOptions) error {
+	return DefaultTgtd.StartDaemonWithOptions(options)
+}
+
+func CheckTargetForBackingStore(name string) bool {
+	return DefaultTgtd.CheckTargetForBackingStore(name)
+}
+
+func GetBackingStores() ([]string, error) {
+	return DefaultTgtd.GetBackingStores()
+}
+
+func GetTargetTid(name string) (int, error) {
+	return DefaultTgtd.GetTargetTid(name)
+}
+
+func GetTargets() (map[int]string, error) {
+	return DefaultTgtd.GetTargets()
+}
+
+func ShutdownTgtd() error {
+	return DefaultTgtd.ShutdownTgtd()
+}
+
+func GetTargetConnections(tid int) (map[string][]string, error) {
+	return DefaultTgtd.GetTargetConnections(tid)
+}
+
+func GetTargetSessions(tid int) ([]*TargetSession, error) {
+	return DefaultTgtd.GetTargetSessions(tid)
+}
+
+func CloseConnection(tid int, sid, cid string) error {
+	return DefaultTgtd.CloseConnection(tid, sid, cid)
+}
+
+func FindTargetIDForName(name string) (int, error) {
+	return DefaultTgtd.FindTargetIDForName(name)
+}
+
+func FindNextAvailableTargetID() (int, error) {
+	return DefaultTgtd.FindNextAvailableTargetID()
+}
+
+func SetTargetNegotiationParams(tid int, params *NegotiationParams) error {
+	return DefaultTgtd.SetTargetNegotiationParams(tid, params)
+}
@@ -0,0 +1,119 @@
+package iscsi
+
+import (
+	"regexp"
+
+	"github.com/longhorn/go-iscsi-helper/util"
+)
+
+const (
+	EventDeviceAdded         = "device-added"
+	EventDeviceRemoved       = "device-removed"
+	EventDeviceChanged       = "device-changed"
+	EventSessionAdded        = "session-added"
+	EventSessionRemoved      = "session-removed"
+	EventSessionStateChanged = "session-state-changed"
+	EventPathChanged         = "path-changed"
+)
+
+var (
+	sessionRegex = regexp.MustCompile(`/(session[0-9]+)(/|$)`)
+)
+
+// Event is a change of the iSCSI sessions or the devices attached through
+// them
+type Event struct {
+	Type string
+	// Device is the kernel device name for the device events, e.g. sdb
+	Device string
+	// Session is the iSCSI session the event belongs to, e.g. session3
+	Session string
+	Uevent  *util.Uevent
+}
+
+// Watch returns a channel of the iSCSI events sourced from the kernel uevents,
+// so the consumers can react to the attachment changes without polling. The
+// channel is closed after stopCh is closed, or the monitoring fails.
+func Watch(stopCh <-chan struct{}) (<-chan *Event, error) {
+	monitor, err := util.NewUeventMonitor()
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan *Event)
+	go func() {
+		defer close(events)
+		defer monitor.Close()
+		for {
+			select {
+			case uevent, ok := <-monitor.Events():
+				if !ok {
+					return
+				}
+				event := convertUevent(uevent)
+				if event == nil {
+					continue
+				}
+				select {
+				case events <- event:
+				case <-stopCh:
+					return
+				}
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// convertUevent returns nil if the uevent is not related to iSCSI
+func convertUevent(uevent *util.Uevent) *Event {
+	// The iSCSI objects are all under the session in sysfs, e.g.
+	// /devices/platform/host3/session1/target3:0:0/3:0:0:1/block/sdb
+	matches := sessionRegex.FindStringSubmatch(uevent.DevPath)
+	if matches == nil {
+		return nil
+	}
+	event := &Event{
+		Session: matches[1],
+		Uevent:  uevent,
+	}
+	switch uevent.Subsystem {
+	case "block":
+		if uevent.Env["DEVTYPE"] != "disk" {
+			return nil
+		}
+		event.Device = uevent.DevName
+		switch uevent.Action {
+		case util.UeventActionAdd:
+			event.Type = EventDeviceAdded
+		case util.UeventActionRemove:
+			event.Type = EventDeviceRemoved
+		case util.UeventActionChange:
+			event.Type = EventDeviceChanged
+		default:
+			return nil
+		}
+	case "iscsi_session":
+		switch uevent.Action {
+		case util.UeventActionAdd:
+			event.Type = EventSessionAdded
+		case util.UeventActionRemove:
+			event.Type = EventSessionRemoved
+		case util.UeventActionChange:
+			event.Type = EventSessionStateChanged
+		default:
+			return nil
+		}
+	case "iscsi_connection":
+		// A connection is a path of the session
+		if uevent.Action != util.UeventActionAdd && uevent.Action != util.UeventActionRemove {
+			return nil
+		}
+		event.Type = EventPathChanged
+	default:
+		return nil
+	}
+	return event
+}
@@ -0,0 +1,117 @@
+package iscsidev
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/types"
+)
+
+const (
+	BackingStoreFaultOffline  = "offline"
+	BackingStoreFaultMissing  = "missing"
+	BackingStoreFaultReadOnly = "read-only"
+	BackingStoreFaultIO       = "io-error"
+
+	backingStoreProbeSize = 4096
+)
+
+// ErrBackingStore is wrapped by BackingStoreError, so the target side faults
+// can be told apart from the initiator side ones with errors.Is
+var ErrBackingStore = errors.New("backing store fault")
+
+// BackingStoreError is a fault of the backing store of a LUN found on the
+// target side, which fails the IO of all the initiators of the target
+type BackingStoreError struct {
+	Target string
+	LUN    int
+	Path   string
+	// Fault is one of BackingStoreFault*
+	Fault  string
+	Detail string
+}
+
+func (e *BackingStoreError) Error() string {
+	return fmt.Sprintf("backing store %v of LUN %v of target %v is %v: %v", e.Path, e.LUN, e.Target, e.Fault, e.Detail)
+}
+
+func (e *BackingStoreError) Unwrap() error {
+	return ErrBackingStore
+}
+
+// CheckBackingStores inspects the backing stores of all the LUNs of the target
+// in tgtd, and returns the faults found. The error is only returned if the
+// check itself fails.
+func (dev *Device) CheckBackingStores() ([]*BackingStoreError, error) {
+	if dev.Backend == types.TargetBackendSPDK {
+		return nil, fmt.Errorf("Backing store check is not supported by %v backend", dev.Backend)
+	}
+	tgtd, tid, err := dev.getExportedTid()
+	if err != nil {
+		return nil, err
+	}
+	return checkBackingStores(tgtd, tid, dev.Target)
+}
+
+func checkBackingStores(tgtd *iscsi.Tgtd, tid int, target string) ([]*BackingStoreError, error) {
+	luns, err := tgtd.GetLuns(tid)
+	if err != nil {
+		return nil, err
+	}
+	res := []*BackingStoreError{}
+	for _, lun := range luns {
+		// LUN 0 is the controller LUN created by tgtd
+		if lun.LUN == 0 {
+			continue
+		}
+		if fault, detail := checkBackingStore(lun); fault != "" {
+			res = append(res, &BackingStoreError{
+				Target: target,
+				LUN:    lun.LUN,
+				Path:   lun.BackingStorePath,
+				Fault:  fault,
+				Detail: detail,
+			})
+		}
+	}
+	return res, nil
+}
+
+// checkBackingStore returns the fault and its detail, or "" if it's healthy
+func checkBackingStore(lun *iscsi.Lun) (string, string) {
+	if !lun.Online {
+		return BackingStoreFaultOffline, "LUN is offline in tgtd"
+	}
+	if _, err := os.Stat(lun.BackingStorePath); err != nil {
+		return BackingStoreFaultMissing, err.Error()
+	}
+	// Only the file based backing stores are probed, the others, e.g. the
+	// longhorn socket, are served by another process
+	if lun.BackingStoreType != "rdwr" && lun.BackingStoreType != "aio" {
+		return "", ""
+	}
+
+	var stat unix.Statfs_t
+	if err := unix.Statfs(lun.BackingStorePath, &stat); err != nil {
+		return BackingStoreFaultIO, err.Error()
+	}
+	if stat.Flags&unix.ST_RDONLY != 0 {
+		return BackingStoreFaultReadOnly, "filesystem is mounted read-only"
+	}
+
+	f, err := os.Open(lun.BackingStorePath)
+	if err != nil {
+		return BackingStoreFaultIO, err.Error()
+	}
+	defer f.Close()
+	buf := make([]byte, backingStoreProbeSize)
+	if _, err := f.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return BackingStoreFaultIO, err.Error()
+	}
+	return "", ""
+}
@@ -0,0 +1,274 @@
+package iscsidev
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/util"
+)
+
+// StartInitiators attaches the devices exported on the local portals together.
+// Each portal is discovered once, the targets are logged in concurrently, and
+// the devices are resolved in one pass of the sessions, instead of repeating
+// StartInitator per device. The targets already logged in are only resolved.
+// It returns the errors of the failed devices indexed by the target names, the
+// devices not in it are attached.
+func StartInitiators(devs []*Device, config *Config) (map[string]error, error) {
+	lock := config.newLock()
+	if err := lock.Lock(); err != nil {
+		return nil, fmt.Errorf("Fail to lock: %v", err)
+	}
+	defer lock.Unlock()
+
+	ne, err := config.newHostExecutor()
+	if err != nil {
+		return nil, err
+	}
+	if err := iscsi.CheckForInitiatorExistence(ne); err != nil {
+		return nil, err
+	}
+	if err := config.checkInitiatorTransport(ne); err != nil {
+		return nil, err
+	}
+	localIP, err := util.GetIPToHost()
+	if err != nil {
+		return nil, err
+	}
+
+	failures := map[string]error{}
+	ops := []*deviceOperation{}
+	defer func() {
+		for _, op := range ops {
+			op.end(failures[op.dev.Target])
+		}
+	}()
+	started := []*Device{}
+	for _, dev := range devs {
+		op, err := dev.beginOperation(startInitiatorTransition)
+		if err != nil {
+			failures[dev.Target] = err
+			continue
+		}
+		ops = append(ops, op)
+		started = append(started, dev)
+	}
+	devs = []*Device{}
+	// The sessions left by the previous attachments are reused as they are,
+	// the same as StartInitator
+	attached := map[string]struct{}{}
+	for _, dev := range started {
+		if iscsi.IsTargetLoggedIn(localIP, dev.Target, ne) {
+			logrus.Infof("go-iscsi-helper: target %v is already logged in", dev.Target)
+			attached[dev.Target] = struct{}{}
+			continue
+		}
+		devs = append(devs, dev)
+	}
+
+	// The devices pinned to the tgtd instances listening on the custom
+	// ports are discovered through their own portals
+	portalDevs := map[string][]*Device{}
+	for _, dev := range devs {
+		portal, err := dev.getPortalAddress(localIP)
+		if err != nil {
+			failures[dev.Target] = err
+			continue
+		}
+		portalDevs[portal] = append(portalDevs[portal], dev)
+	}
+	for portal, devs := range portalDevs {
+		// The node records created without SendTargets discovery are
+		// per target anyway
+		if config.StaticNodeRecord || config.ISNSServer != "" {
+			for _, dev := range devs {
+				dev.discoverTarget(localIP, portal, ne, config, nil)
+				if !iscsi.IsTargetDiscovered(localIP, dev.Target, ne) {
+					failures[dev.Target] = fmt.Errorf("Cannot discover target %v on %v", dev.Target, portal)
+				}
+			}
+			continue
+		}
+		pending := discoverTargets(portal, devs, ne, config)
+		for _, dev := range devs {
+			if _, ok := pending[dev.Target]; ok {
+				failures[dev.Target] = fmt.Errorf("Cannot discover target %v on %v", dev.Target, portal)
+			}
+		}
+	}
+
+	var (
+		wg        sync.WaitGroup
+		loginLock sync.Mutex
+	)
+	loggedIn := []*Device{}
+	for _, dev := range started {
+		if _, ok := attached[dev.Target]; ok {
+			loggedIn = append(loggedIn, dev)
+		}
+	}
+	for _, dev := range devs {
+		if _, failed := failures[dev.Target]; failed {
+			continue
+		}
+		wg.Add(1)
+		go func(dev *Device) {
+			defer wg.Done()
+			loginErr := loginTarget(localIP, dev, ne, config)
+			loginLock.Lock()
+			defer loginLock.Unlock()
+			if loginErr != nil {
+				failures[dev.Target] = loginErr
+				return
+			}
+			loggedIn = append(loggedIn, dev)
+		}(dev)
+	}
+	wg.Wait()
+
+	for target, err := range resolveDevices(localIP, loggedIn, ne, config) {
+		failures[target] = err
+	}
+	// The failed devices leave neither the sessions nor the node records
+	// created here, whichever step they failed in
+	isLoggedIn := map[string]struct{}{}
+	for _, dev := range loggedIn {
+		isLoggedIn[dev.Target] = struct{}{}
+	}
+	for _, dev := range devs {
+		if _, failed := failures[dev.Target]; !failed {
+			continue
+		}
+		if _, ok := isLoggedIn[dev.Target]; ok {
+			dev.rollbackLogin(localIP, ne, nil)
+		}
+		dev.cleanupNodeRecords(localIP, ne)
+	}
+	return failures, nil
+}
+
+// cleanupNodeRecords deletes the node record of the failed device, and the
+// empty entries left by the broken discovery
+func (dev *Device) cleanupNodeRecords(ip string, ne *util.NamespaceExecutor) {
+	if iscsi.IsTargetDiscovered(ip, dev.Target, ne) {
+		if err := iscsi.DeleteDiscoveredTarget(ip, dev.Target, ne); err != nil {
+			logrus.Warnf("Fail to delete node record of %v on %v: %v", dev.Target, ip, err)
+		}
+	}
+	if err := iscsi.CleanupScsiNodes(dev.Target, ne); err != nil {
+		logrus.Warnf("Fail to cleanup nodes for %v: %v", dev.Target, err)
+	}
+}
+
+// discoverTargets discovers all the targets of the portal at once, and returns
+// the targets still not discovered after retries
+func discoverTargets(ip string, devs []*Device, ne *util.NamespaceExecutor, config *Config) map[string]struct{} {
+	pending := map[string]struct{}{}
+	for _, dev := range devs {
+		pending[dev.Target] = struct{}{}
+	}
+	for i := 0; i < config.RetryCounts; i++ {
+		if err := iscsi.DiscoverTargetWithIface(ip, "", config.InitiatorIface, ne); err != nil {
+			logrus.Warnf("FAIL to discover portal %v due to %v", ip, err)
+		}
+		for target := range pending {
+			if iscsi.IsTargetDiscovered(ip, target, ne) {
+				delete(pending, target)
+			}
+		}
+		if len(pending) == 0 {
+			break
+		}
+		for target := range pending {
+			if err := iscsi.CleanupScsiNodes(target, ne); err != nil {
+				logrus.Warnf("Fail to cleanup nodes for %v: %v", target, err)
+			}
+		}
+		time.Sleep(config.RetryIntervalSCSI)
+	}
+	return pending
+}
+
+func loginTarget(ip string, dev *Device, ne *util.NamespaceExecutor, config *Config) error {
+	if dev.NegotiationParams != nil {
+		if err := iscsi.SetNodeNegotiationParams(ip, dev.Target, dev.NegotiationParams, ne); err != nil {
+			return err
+		}
+	}
+	return iscsi.LoginTargetWithIface(ip, dev.Target, config.InitiatorIface, ne)
+}
+
+// resolveDevices waits for the devices of all the LUNs to show up, then sets
+// them up the same as StartInitator. It returns the errors of the devices not
+// found in time or failed to set up.
+func resolveDevices(ip string, devs []*Device, ne *util.NamespaceExecutor, config *Config) map[string]error {
+	failures := map[string]error{}
+	if len(devs) == 0 {
+		return failures
+	}
+	targets := []string{}
+	for _, dev := range devs {
+		targets = append(targets, dev.Target)
+	}
+
+	monitor, err := util.NewUeventMonitor()
+	if err != nil {
+		logrus.Debugf("Cannot monitor uevents, fall back to polling: %v", err)
+	} else {
+		defer monitor.Close()
+	}
+	isBlockDeviceAdded := func(event *util.Uevent) bool {
+		return event.Subsystem == "block" && event.Action == util.UeventActionAdd
+	}
+
+	var (
+		devices map[string]map[int]*util.KernelDevice
+		listErr error
+	)
+	timeout := time.Duration(iscsi.DeviceWaitRetryCounts) * iscsi.DeviceWaitRetryInterval
+	util.WaitForCondition(timeout, iscsi.DeviceWaitPollInterval, monitor, isBlockDeviceAdded, func() bool {
+		if devices, listErr = iscsi.ListDevices(ip, targets, ne); listErr != nil {
+			return false
+		}
+		for _, dev := range devs {
+			if devices[dev.Target][config.TargetLunID] == nil {
+				return false
+			}
+			for _, disk := range dev.Disks {
+				if devices[dev.Target][disk.LunID] == nil {
+					return false
+				}
+			}
+		}
+		return true
+	})
+
+	for _, dev := range devs {
+		if devices == nil || devices[dev.Target][config.TargetLunID] == nil {
+			failures[dev.Target] = fmt.Errorf("Cannot find iscsi device of target %v: %v", dev.Target, listErr)
+			continue
+		}
+		missing := false
+		for _, disk := range dev.Disks {
+			if devices[dev.Target][disk.LunID] == nil {
+				failures[dev.Target] = fmt.Errorf("Cannot find iscsi device of LUN %v for target %v: %v", disk.LunID, dev.Target, listErr)
+				missing = true
+				break
+			}
+		}
+		if missing {
+			continue
+		}
+		dev.KernelDevice = devices[dev.Target][config.TargetLunID]
+		for _, disk := range dev.Disks {
+			disk.KernelDevice = devices[dev.Target][disk.LunID]
+		}
+		if err := dev.setupDevices(ne, config, nil); err != nil {
+			failures[dev.Target] = err
+		}
+	}
+	return failures
+}
@@ -0,0 +1,223 @@
+package iscsidev
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/spdk"
+	"github.com/longhorn/go-iscsi-helper/util"
+)
+
+// Config carries the settings of the devices, so the devices created with
+// different configs can coexist in one process. It's set when the device is
+// constructed and must not be modified afterwards, since the operations of the
+// device read it without locking.
+type Config struct {
+	LockFile    string
+	LockTimeout time.Duration
+	// StaleLockCheckInterval is how long to wait for the lock before
+	// checking whether its holder is dead, disabled if 0
+	StaleLockCheckInterval time.Duration
+
+	TargetLunID int
+
+	RetryCounts           int
+	RetryIntervalSCSI     time.Duration
+	RetryIntervalTargetID time.Duration
+	// TargetIDAllocation is how the TIDs are allocated,
+	// TargetIDAllocationHash derives the TID from the target name so it's
+	// stable across restarts
+	TargetIDAllocation string
+	LogoutPollInterval time.Duration
+
+	HostProc string
+	// HostChroot makes the commands in the host namespace run chrooted into
+	// the host root filesystem, see util.NewNamespaceExecutorWithChroot
+	HostChroot bool
+
+	// TgtdOptions customizes how tgtd is launched if it's not running, the
+	// default options are used if nil
+	TgtdOptions *iscsi.DaemonOptions
+	// TgtdInstances are the tgtd instances besides the default one indexed
+	// by name, see Device.TgtdInstance
+	TgtdInstances map[string]*TgtdInstance
+
+	// NodeDatabaseBackupDir is the directory in the host namespace to backup
+	// the node database before the destructive cleanups, disabled if empty
+	NodeDatabaseBackupDir string
+
+	// DeviceNodeAttributes are applied to the device nodes in the host /dev
+	// once they are attached, disabled if nil
+	DeviceNodeAttributes *util.DeviceNodeAttributes
+	// ThrottleCgroup is the cgroup v2 directory in the host namespace the
+	// IOLimits of the devices are set in, e.g. the parent cgroup of all the
+	// consumers of the devices. Throttling is disabled if empty.
+	ThrottleCgroup string
+
+	// InitiatorIface is the iscsiadm iface to discover and login the targets
+	// through, see iscsi.SetupIface. The default iface is used if empty.
+	InitiatorIface string
+	// InitiatorTransport is the transport of InitiatorIface, e.g.
+	// iscsi.TransportBnx2i for the offload NICs, see
+	// iscsi.SetupOffloadIface. The offload transport is verified before the
+	// targets are discovered.
+	InitiatorTransport string
+	// InitiatorNetNS is the network namespace the initiator operations run
+	// in instead of the one of the host, e.g. /var/run/netns/storage for the
+	// storage traffic isolated into a dedicated network namespace. The path
+	// is the one seen by the caller rather than the host, e.g.
+	// /host/var/run/netns/storage in a container. iscsid must run in the
+	// same network namespace, since iscsiadm talks to it through an abstract
+	// socket. The mount namespace of the host is used regardless. It's
+	// verified by Validate.
+	InitiatorNetNS string
+
+	// ScsiDeviceTimeout and ScsiDeviceEHTimeout are set to the SCSI devices
+	// of the attachments once they show up, see iscsi.SetScsiDeviceTimeout.
+	// The kernel defaults, 30s and 10s, are kept if 0, otherwise the minimum
+	// is 1s, which is verified by Validate. The command timeout
+	// should be longer than node.session.timeo.replacement_timeout,
+	// otherwise the commands time out and retry before the session recovery
+	// fails them fast.
+	ScsiDeviceTimeout   time.Duration
+	ScsiDeviceEHTimeout time.Duration
+
+	// VerifyDeviceReady makes StartInitator verify the device is servicing
+	// IO with TEST UNIT READY, and READ CAPACITY if VerifyDeviceCapacity
+	VerifyDeviceReady    bool
+	VerifyDeviceCapacity bool
+
+	// DataVerifyMode makes StartInitator verify the data path after the
+	// device is ready, by writing and reading back a pattern at
+	// DataVerifyOffset, or by checking DataVerifySignature at the offset
+	DataVerifyMode      string
+	DataVerifyOffset    int64
+	DataVerifySignature string
+
+	// ISNSServer is the address of the iSNS server in the IP:Port format.
+	// If it's set, the targets are registered to the iSNS server and the
+	// initiators discover them through it instead of SendTargets.
+	ISNSServer string
+
+	// StaticNodeRecord makes StartInitator create the node record directly
+	// instead of discovering the target, see iscsi.CreateNodeRecord
+	StaticNodeRecord bool
+
+	// FlushBuffersOnLogout makes the logout invalidate the buffer cache of
+	// the devices after syncing them
+	FlushBuffersOnLogout bool
+	// InflightIOTimeout is how long the logout waits in total for the
+	// inflight IO of all the devices of the target to drain
+	InflightIOTimeout time.Duration
+
+	SPDKSocketPath        string
+	SPDKPortalGroupTag    int
+	SPDKInitiatorGroupTag int
+	// SPDKPortal is the portal of the SPDK iSCSI target application. The
+	// port must differ from the ones tgtd listens on, since both can run on
+	// the same node and tgtd takes 0.0.0.0:3260 by default.
+	SPDKPortal spdk.Portal
+}
+
+// DefaultConfig returns a new config with the default settings. The settings
+// predating Config are taken from the package-level variables.
+func DefaultConfig() *Config {
+	return &Config{
+		LockFile:               LockFile,
+		LockTimeout:            LockTimeout,
+		StaleLockCheckInterval: 10 * time.Second,
+
+		TargetLunID: TargetLunID,
+
+		RetryCounts:           RetryCounts,
+		RetryIntervalSCSI:     RetryIntervalSCSI,
+		RetryIntervalTargetID: RetryIntervalTargetID,
+		TargetIDAllocation:    TargetIDAllocationFirstFree,
+		LogoutPollInterval:    500 * time.Millisecond,
+
+		HostProc: HostProc,
+
+		TgtdInstances: map[string]*TgtdInstance{},
+
+		DataVerifyMode: DataVerifyModeDisabled,
+
+		InflightIOTimeout: 10 * time.Second,
+
+		SPDKSocketPath:        spdk.DefaultSocketPath,
+		SPDKPortalGroupTag:    1,
+		SPDKInitiatorGroupTag: 1,
+		SPDKPortal: spdk.Portal{
+			Host: "0.0.0.0",
+			Port: strconv.Itoa(DefaultSPDKPortalPort),
+		},
+	}
+}
+
+func (c *Config) getTgtdOptions() *iscsi.DaemonOptions {
+	if c.TgtdOptions == nil {
+		return &iscsi.DaemonOptions{}
+	}
+	return c.TgtdOptions
+}
+
+// checkInitiatorTransport verifies the offload transport of the initiator
+// iface is ready, so the login won't fall back to or hang on the software
+// transport
+func (c *Config) checkInitiatorTransport(ne *util.NamespaceExecutor) error {
+	if c.InitiatorTransport == "" || c.InitiatorTransport == iscsi.TransportTCP {
+		return nil
+	}
+	if c.InitiatorIface == "" {
+		return fmt.Errorf("Initiator iface is required by the offload transport %v", c.InitiatorTransport)
+	}
+	return iscsi.CheckOffloadTransport(c.InitiatorTransport, ne)
+}
+
+// Validate verifies the config once it's set, so the operations don't verify
+// it every time. It's called by NewDeviceWithConfig, the callers passing the
+// config to the functions of the package directly should call it beforehand.
+func (c *Config) Validate() error {
+	if err := iscsi.ValidateScsiDeviceTimeout(c.ScsiDeviceTimeout, c.ScsiDeviceEHTimeout); err != nil {
+		return err
+	}
+	if c.InitiatorNetNS != "" {
+		if err := util.ValidateNetworkNamespace(c.InitiatorNetNS); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewHostExecutor returns the executor of the initiator operations, in the
+// namespaces of the host, or InitiatorNetNS if it's set
+func (c *Config) NewHostExecutor() (*util.NamespaceExecutor, error) {
+	return c.newHostExecutor()
+}
+
+func (c *Config) newHostExecutor() (*util.NamespaceExecutor, error) {
+	var (
+		ne  *util.NamespaceExecutor
+		err error
+	)
+	if c.HostChroot {
+		ne, err = util.NewNamespaceExecutorWithChroot(util.GetHostNamespacePath(c.HostProc))
+	} else {
+		ne, err = util.NewNamespaceExecutor(util.GetHostNamespacePath(c.HostProc))
+	}
+	if err != nil {
+		return nil, err
+	}
+	ne.SetNetworkNamespace(c.InitiatorNetNS)
+	return ne, nil
+}
+
+// getConfig returns the config the device is constructed with, or a new
+// DefaultConfig for the device not created by the constructors
+func (dev *Device) getConfig() *Config {
+	if dev.config == nil {
+		return DefaultConfig()
+	}
+	return dev.config
+}
@@ -0,0 +1,308 @@
+package iscsidev
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/types"
+	"github.com/longhorn/go-iscsi-helper/util"
+)
+
+// Disk is an additional LUN exported by the target of the device, e.g. the
+// metadata or the journal device of the volume. It shares the session with
+// the main LUN.
+type Disk struct {
+	LunID        int                `json:"lunID"`
+	BackingFile  string             `json:"backingFile"`
+	BSType       string             `json:"bsType"`
+	BSOpts       string             `json:"bsOpts"`
+	KernelDevice *util.KernelDevice `json:"kernelDevice,omitempty"`
+}
+
+func (dev *Device) getDisk(lun int) *Disk {
+	for _, disk := range dev.Disks {
+		if disk.LunID == lun {
+			return disk
+		}
+	}
+	return nil
+}
+
+func (dev *Device) nextDiskLunID() int {
+	lun := dev.getConfig().TargetLunID
+	for _, disk := range dev.Disks {
+		if disk.LunID > lun {
+			lun = disk.LunID
+		}
+	}
+	return lun + 1
+}
+
+// AddDisk exports the backing file as a new LUN of the existing target. If the
+// target is already logged in, the session is rescanned and the device of the
+// new LUN is waited for, the other LUNs are not interrupted.
+func (dev *Device) AddDisk(backingFile, bsType, bsOpts string) (*Disk, error) {
+	var disk *Disk
+	err := dev.runOperation(updateTargetTransition, func() (err error) {
+		disk, err = dev.addDisk(backingFile, bsType, bsOpts)
+		return err
+	})
+	return disk, err
+}
+
+func (dev *Device) addDisk(backingFile, bsType, bsOpts string) (*Disk, error) {
+	if dev.Backend == types.TargetBackendSPDK {
+		return nil, fmt.Errorf("Multiple disks are not supported by %v backend", dev.Backend)
+	}
+	if err := validateBackingStore(backingFile, bsType, bsOpts); err != nil {
+		return nil, err
+	}
+	tgtd, tid, err := dev.getExportedTid()
+	if err != nil {
+		return nil, err
+	}
+
+	disk := &Disk{
+		LunID:       dev.nextDiskLunID(),
+		BackingFile: backingFile,
+		BSType:      bsType,
+		BSOpts:      bsOpts,
+	}
+	if err := dev.addLun(tgtd, tid, disk.LunID, disk.BackingFile, disk.BSType, disk.BSOpts); err != nil {
+		return nil, err
+	}
+	dev.Disks = append(dev.Disks, disk)
+	logrus.Infof("go-iscsi-helper: added disk %v as LUN %v of target %v", backingFile, disk.LunID, dev.Target)
+
+	if err := dev.attachDisk(disk); err != nil {
+		dev.rollbackDisk(tgtd, tid, disk)
+		return nil, err
+	}
+	return disk, nil
+}
+
+// rollbackDisk removes the disk failed to attach, so the LUN doesn't linger
+// on the target without being tracked by the device
+func (dev *Device) rollbackDisk(tgtd *iscsi.Tgtd, tid int, disk *Disk) {
+	if err := dev.detachDisk(disk); err != nil {
+		logrus.Warnf("Failed to delete device of LUN %v for target %v during rollback: %v", disk.LunID, dev.Target, err)
+	}
+	if err := tgtd.DeleteLun(tid, disk.LunID); err != nil {
+		logrus.Warnf("Failed to delete LUN %v of target %v during rollback: %v", disk.LunID, dev.Target, err)
+	}
+	dev.removeDisk(disk.LunID)
+	logrus.Infof("go-iscsi-helper: rolled back disk %v of LUN %v from target %v", disk.BackingFile, disk.LunID, dev.Target)
+}
+
+func (dev *Device) attachDisk(disk *Disk) error {
+	config := dev.getConfig()
+
+	lock := config.newLock()
+	if err := lock.Lock(); err != nil {
+		return fmt.Errorf("Fail to lock: %v", err)
+	}
+	defer lock.Unlock()
+
+	ne, err := config.newHostExecutor()
+	if err != nil {
+		return err
+	}
+	ip, err := util.GetIPToHost()
+	if err != nil {
+		return err
+	}
+	if !iscsi.IsTargetLoggedIn(ip, dev.Target, ne) {
+		return nil
+	}
+
+	if err := iscsi.RescanTarget(ip, dev.Target, ne); err != nil {
+		return fmt.Errorf("Failed to rescan target %v for LUN %v: %v", dev.Target, disk.LunID, err)
+	}
+	if disk.KernelDevice, err = iscsi.GetDevice(ip, dev.Target, disk.LunID, ne); err != nil {
+		return err
+	}
+	if err := dev.verifyLunIdentity(disk.KernelDevice, disk.LunID, ne); err != nil {
+		return err
+	}
+	if err := dev.applyScsiDeviceTimeout(ne, config); err != nil {
+		return err
+	}
+	if err := util.ApplyDeviceNodeAttributesInNamespace("/dev/"+disk.KernelDevice.Name, config.DeviceNodeAttributes, ne); err != nil {
+		return err
+	}
+	if dev.IOLimits != nil && config.ThrottleCgroup != "" {
+		if err := util.SetDeviceIOLimits(config.ThrottleCgroup, disk.KernelDevice, dev.IOLimits, ne); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("go-iscsi-helper: attached LUN %v of target %v as %v", disk.LunID, dev.Target, disk.KernelDevice.Name)
+	return nil
+}
+
+// RemoveDisk removes the disk from a live attachment. The SCSI device of the
+// LUN is flushed and deleted on the initiator before the LUN is removed from
+// the target, then the other LUNs are verified to be still attached. It fails
+// with util.DeviceInUseError and keeps the disk if the device is in use.
+func (dev *Device) RemoveDisk(lun int) error {
+	return dev.runOperation(updateTargetTransition, func() error {
+		return dev.deleteDisk(lun)
+	})
+}
+
+func (dev *Device) deleteDisk(lun int) error {
+	disk := dev.getDisk(lun)
+	if disk == nil {
+		return fmt.Errorf("Cannot find disk of LUN %v for target %v", lun, dev.Target)
+	}
+	tgtd, tid, err := dev.getExportedTid()
+	if err != nil {
+		return err
+	}
+
+	if err := dev.detachDisk(disk); err != nil {
+		return err
+	}
+	if err := tgtd.DeleteLun(tid, lun); err != nil {
+		return err
+	}
+	dev.removeDisk(lun)
+	logrus.Infof("go-iscsi-helper: removed disk %v of LUN %v from target %v", disk.BackingFile, lun, dev.Target)
+
+	return dev.verifyDisksAttached()
+}
+
+func (dev *Device) detachDisk(disk *Disk) error {
+	config := dev.getConfig()
+
+	lock := config.newLock()
+	if err := lock.Lock(); err != nil {
+		return fmt.Errorf("Fail to lock: %v", err)
+	}
+	defer lock.Unlock()
+
+	ne, err := config.newHostExecutor()
+	if err != nil {
+		return err
+	}
+	ip, err := util.GetIPToHost()
+	if err != nil {
+		return err
+	}
+	if !iscsi.IsTargetLoggedIn(ip, dev.Target, ne) {
+		return nil
+	}
+
+	kernelDevice, err := iscsi.FindDevice(ip, dev.Target, disk.LunID, ne)
+	if err != nil {
+		// The device is not attached, e.g. it's removed already
+		logrus.Warnf("Cannot find device of LUN %v for target %v: %v", disk.LunID, dev.Target, err)
+		return nil
+	}
+	// The LUN stays exported if the device is busy, see util.DeviceInUseError
+	if err := util.CheckDeviceInUse(kernelDevice, ne); err != nil {
+		return err
+	}
+	if err := iscsi.FlushScsiDevice(kernelDevice, config.FlushBuffersOnLogout, ne); err != nil {
+		return err
+	}
+	if config.ThrottleCgroup != "" {
+		if err := util.SetDeviceIOLimits(config.ThrottleCgroup, kernelDevice, nil, ne); err != nil {
+			logrus.Warnf("Failed to clear IO limits of device %v of LUN %v for target %v: %v", kernelDevice.Name, disk.LunID, dev.Target, err)
+		}
+	}
+	if err := iscsi.DeleteScsiDevice(kernelDevice, ne); err != nil {
+		return err
+	}
+	disk.KernelDevice = nil
+	logrus.Infof("go-iscsi-helper: deleted device %v of LUN %v for target %v", kernelDevice.Name, disk.LunID, dev.Target)
+	return nil
+}
+
+// verifyDisksAttached checks the devices of the remaining LUNs are unchanged
+func (dev *Device) verifyDisksAttached() error {
+	config := dev.getConfig()
+	if dev.KernelDevice == nil {
+		return nil
+	}
+
+	ne, err := config.newHostExecutor()
+	if err != nil {
+		return err
+	}
+	ip, err := util.GetIPToHost()
+	if err != nil {
+		return err
+	}
+	expected := map[int]*util.KernelDevice{
+		config.TargetLunID: dev.KernelDevice,
+	}
+	for _, disk := range dev.Disks {
+		if disk.KernelDevice != nil {
+			expected[disk.LunID] = disk.KernelDevice
+		}
+	}
+	for lun, kernelDevice := range expected {
+		found, err := iscsi.FindDevice(ip, dev.Target, lun, ne)
+		if err != nil {
+			return fmt.Errorf("LUN %v of target %v is lost after removing disk: %v", lun, dev.Target, err)
+		}
+		if found.Name != kernelDevice.Name {
+			return fmt.Errorf("LUN %v of target %v changed from device %v to %v after removing disk",
+				lun, dev.Target, kernelDevice.Name, found.Name)
+		}
+	}
+	return nil
+}
+
+func (dev *Device) removeDisk(lun int) {
+	disks := []*Disk{}
+	for _, disk := range dev.Disks {
+		if disk.LunID != lun {
+			disks = append(disks, disk)
+		}
+	}
+	dev.Disks = disks
+}
+
+// GetDiskDevicePaths returns the device paths of the disks indexed by LUN.
+// The disks not attached by the initiator are omitted.
+func (dev *Device) GetDiskDevicePaths() map[int]string {
+	paths := map[int]string{}
+	for _, disk := range dev.Disks {
+		if disk.KernelDevice != nil {
+			paths[disk.LunID] = "/dev/" + disk.KernelDevice.Name
+		}
+	}
+	return paths
+}
+
+func (dev *Device) addDiskLuns(tgtd *iscsi.Tgtd, tid int) error {
+	for _, disk := range dev.Disks {
+		if err := dev.addLun(tgtd, tid, disk.LunID, disk.BackingFile, disk.BSType, disk.BSOpts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dev *Device) deleteDiskLuns(tgtd *iscsi.Tgtd, tid int) error {
+	for _, disk := range dev.Disks {
+		if err := tgtd.DeleteLun(tid, disk.LunID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dev *Device) getDiskDevices(ip string, ne *util.NamespaceExecutor) error {
+	for _, disk := range dev.Disks {
+		kernelDevice, err := iscsi.GetDevice(ip, dev.Target, disk.LunID, ne)
+		if err != nil {
+			return err
+		}
+		disk.KernelDevice = kernelDevice
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package iscsidev
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+)
+
+const (
+	DrainResultGraceful = "graceful"
+	DrainResultForced   = "forced"
+	DrainResultFailed   = "failed"
+)
+
+var DefaultDrainParallelism = 4
+
+// DrainOptions controls DrainNode
+type DrainOptions struct {
+	// Parallelism bounds the targets detached concurrently, default to
+	// DefaultDrainParallelism if 0
+	Parallelism int
+	// Timeout bounds the graceful detach of each target, which waits
+	// indefinitely if 0
+	Timeout time.Duration
+	// Force escalates to the forced detach if the graceful detach fails or
+	// times out, e.g. the devices are still in use
+	Force bool
+	// DeleteTargets deletes the targets exported on the node as well
+	DeleteTargets bool
+}
+
+// DrainTargetResult is how a target was detached by DrainNode
+type DrainTargetResult struct {
+	Target string
+	// Result is one of DrainResult*
+	Result string
+	// Escalations are the forced detach steps taken, see EscalationStep*
+	Escalations []string
+	Errors      []string
+}
+
+// DrainReport is the aggregate result of DrainNode indexed by the targets
+type DrainReport struct {
+	Targets map[string]*DrainTargetResult
+}
+
+// Failed returns the targets failed to detach
+func (r *DrainReport) Failed() []string {
+	res := []string{}
+	for target, result := range r.Targets {
+		if result.Result == DrainResultFailed {
+			res = append(res, target)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+type drainTarget struct {
+	name     string
+	loggedIn bool
+	tgtd     *iscsi.Tgtd
+	tid      int
+}
+
+// DrainNode detaches all the devices of the node, found by the sessions and
+// optionally the targets with TargetNamePrefix, instead of stopping them one
+// by one. The operation lock is held during the drain.
+func DrainNode(options *DrainOptions, config *Config) (*DrainReport, error) {
+	lock, err := config.acquireLock(0)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	targets, err := findDrainTargets(options, config)
+	if err != nil {
+		return nil, err
+	}
+
+	parallelism := options.Parallelism
+	if parallelism <= 0 {
+		parallelism = DefaultDrainParallelism
+	}
+	report := &DrainReport{
+		Targets: map[string]*DrainTargetResult{},
+	}
+	var (
+		wg         sync.WaitGroup
+		reportLock sync.Mutex
+	)
+	sem := make(chan struct{}, parallelism)
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target *drainTarget) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			result := target.drain(options, config)
+			reportLock.Lock()
+			report.Targets[target.name] = result
+			reportLock.Unlock()
+		}(target)
+	}
+	wg.Wait()
+
+	failed := report.Failed()
+	logrus.Infof("go-iscsi-helper: drained %v targets, %v failed", len(report.Targets), len(failed))
+	if len(failed) != 0 {
+		return report, fmt.Errorf("Failed to drain targets %v", strings.Join(failed, ", "))
+	}
+	return report, nil
+}
+
+func findDrainTargets(options *DrainOptions, config *Config) (map[string]*drainTarget, error) {
+	ne, err := config.newHostExecutor()
+	if err != nil {
+		return nil, err
+	}
+	if err := iscsi.CheckForInitiatorExistence(ne); err != nil {
+		return nil, err
+	}
+	sessions, err := iscsi.ListSessions(ne)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := map[string]*drainTarget{}
+	getTarget := func(name string) *drainTarget {
+		if targets[name] == nil {
+			targets[name] = &drainTarget{name: name}
+		}
+		return targets[name]
+	}
+	for _, session := range sessions {
+		if strings.HasPrefix(session.Target, TargetNamePrefix) {
+			getTarget(session.Target).loggedIn = true
+		}
+	}
+	if !options.DeleteTargets {
+		return targets, nil
+	}
+	for _, tgtd := range config.getAllTgtds() {
+		exported, err := tgtd.GetTargets()
+		if err != nil {
+			// tgtd may not be running on the node
+			logrus.Debugf("Skipped the targets of tgtd on control port %v: %v", tgtd.ControlPort, err)
+			continue
+		}
+		for tid, name := range exported {
+			if strings.HasPrefix(name, TargetNamePrefix) {
+				target := getTarget(name)
+				target.tgtd = tgtd
+				target.tid = tid
+			}
+		}
+	}
+	return targets, nil
+}
+
+func (t *drainTarget) drain(options *DrainOptions, config *Config) *DrainTargetResult {
+	escalation := &Escalation{
+		Name:    "target " + t.name,
+		Timeout: options.Timeout,
+		Force:   options.Force,
+		Steps:   []*EscalationStep{},
+	}
+	if t.tgtd != nil {
+		escalation.Unblock = &EscalationStep{
+			Name: EscalationStepCloseConnections,
+			Run: func() error {
+				return closeTargetConnections(t.tgtd, t.tid)
+			},
+		}
+	}
+	// DrainNode holds the operation lock, the logout doesn't take it
+	if t.loggedIn {
+		escalation.Steps = append(escalation.Steps, &EscalationStep{
+			Name: EscalationStepForceLogout,
+			Run: func() error {
+				_, err := logoutTarget(t.name, config, nil)
+				return err
+			},
+		})
+	}
+	if t.tgtd != nil {
+		escalation.Steps = append(escalation.Steps, &EscalationStep{
+			Name: EscalationStepDeleteTarget,
+			Run: func() error {
+				return purgeTarget(t.tgtd, t.tid)
+			},
+		})
+	}
+
+	res, err := escalation.Run(func(fence *Fence) error {
+		return t.detach(config, fence)
+	})
+	result := &DrainTargetResult{
+		Target:      t.name,
+		Escalations: res.Escalations,
+		Errors:      res.Errors,
+	}
+	switch {
+	case err != nil:
+		result.Result = DrainResultFailed
+	case res.Graceful:
+		result.Result = DrainResultGraceful
+	default:
+		result.Result = DrainResultForced
+	}
+	return result
+}
+
+// detach logs out and deletes the target, refusing to logout the devices in
+// use. It stops before the next step once the fence is set.
+func (t *drainTarget) detach(config *Config, fence *Fence) error {
+	if t.loggedIn {
+		if err := checkDevicesInUse(t.name, config); err != nil {
+			return err
+		}
+		if err := fence.Check(); err != nil {
+			return err
+		}
+		if _, err := logoutTarget(t.name, config, nil); err != nil {
+			return err
+		}
+	}
+	if t.tgtd != nil {
+		if err := fence.Check(); err != nil {
+			return err
+		}
+		return purgeTarget(t.tgtd, t.tid)
+	}
+	return nil
+}
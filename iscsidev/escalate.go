@@ -0,0 +1,159 @@
+package iscsidev
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The forced teardown steps taken by ShutdownWithOptions of longhorndev and
+// DrainNode, in the order they are taken
+const (
+	EscalationStepCloseConnections = "close-connections"
+	EscalationStepRemoveDevice     = "remove-device"
+	EscalationStepForceLogout      = "force-logout"
+	EscalationStepDeleteTarget     = "delete-target"
+)
+
+// EscalationWait is how long the forced teardown waits for the graceful path
+// to complete after it's unblocked, see Escalation.Unblock
+var EscalationWait = 5 * time.Second
+
+// ErrFenced is returned by Fence.Check once the graceful path is abandoned
+var ErrFenced = errors.New("graceful path abandoned by the forced teardown")
+
+// Fence stops the graceful path left running by the forced teardown from
+// taking further steps, e.g. deleting the target by name after it's recreated.
+// The graceful path checks it before each step with side effects. The methods
+// are no-op on a nil fence.
+type Fence struct {
+	fenced int32
+}
+
+// Check returns ErrFenced if the graceful path is abandoned
+func (f *Fence) Check() error {
+	if f != nil && atomic.LoadInt32(&f.fenced) != 0 {
+		return ErrFenced
+	}
+	return nil
+}
+
+// Fence abandons the graceful path, it's called before the forced teardown
+// takes over
+func (f *Fence) Fence() {
+	if f == nil {
+		return
+	}
+	atomic.StoreInt32(&f.fenced, 1)
+}
+
+// EscalationStep is a step of the forced teardown
+type EscalationStep struct {
+	// Name is one of EscalationStep*
+	Name string
+	Run  func() error
+}
+
+// Escalation runs the graceful teardown of a device or a target bounded by
+// Timeout, and escalates to the forced one if it fails or times out
+type Escalation struct {
+	// Name is the device or the target in the logs
+	Name string
+	// Timeout bounds the graceful path, which waits indefinitely if 0
+	Timeout time.Duration
+	// Force escalates to the forced teardown instead of returning the error
+	// of the graceful path
+	Force bool
+	// Unblock is the first forced step if set, e.g. closing the connections
+	// of the target to fail the IO a hung logout waits for. The graceful path
+	// is given EscalationWait to complete after it.
+	Unblock *EscalationStep
+	// Steps are the rest of the forced teardown, taken after the graceful
+	// path is fenced
+	Steps []*EscalationStep
+}
+
+// EscalationResult tells how the teardown went
+type EscalationResult struct {
+	// Graceful is true if the graceful path completed without escalation
+	Graceful bool
+	// Escalations are the forced steps taken, see EscalationStep*
+	Escalations []string
+	// Errors are the failures of the graceful path and the forced steps
+	Errors []string
+}
+
+// Run runs graceful and escalates if needed. It returns an error if the
+// graceful path failed without Force, or any forced step failed. The graceful
+// path given up on may still be running, but the fence passed to it is set
+// before the forced steps or the return.
+func (e *Escalation) Run(graceful func(fence *Fence) error) (*EscalationResult, error) {
+	result := &EscalationResult{
+		Escalations: []string{},
+		Errors:      []string{},
+	}
+
+	fence := &Fence{}
+	done := make(chan error, 1)
+	go func() {
+		done <- graceful(fence)
+	}()
+	var timeout <-chan time.Time
+	if e.Timeout != 0 {
+		timeout = time.After(e.Timeout)
+	}
+
+	var err error
+	select {
+	case err = <-done:
+	case <-timeout:
+		err = fmt.Errorf("graceful teardown timed out after %v", e.Timeout)
+	}
+	if err == nil {
+		result.Graceful = true
+		return result, nil
+	}
+	result.Errors = append(result.Errors, err.Error())
+	if !e.Force {
+		fence.Fence()
+		return result, err
+	}
+
+	logrus.Warnf("go-iscsi-helper: %v: escalating to forced teardown: %v", e.Name, err)
+	failed := false
+	step := func(s *EscalationStep) {
+		result.Escalations = append(result.Escalations, s.Name)
+		if err := s.Run(); err != nil {
+			failed = true
+			result.Errors = append(result.Errors, fmt.Sprintf("%v: %v", s.Name, err))
+			logrus.Warnf("go-iscsi-helper: %v: forced teardown step %v failed: %v", e.Name, s.Name, err)
+		}
+	}
+
+	if e.Unblock != nil {
+		step(e.Unblock)
+		select {
+		case err := <-done:
+			if err == nil {
+				logrus.Infof("go-iscsi-helper: %v: graceful teardown completed after %v", e.Name, e.Unblock.Name)
+				return result, nil
+			}
+		case <-time.After(EscalationWait):
+			logrus.Warnf("go-iscsi-helper: %v: graceful teardown still hangs after %v", e.Name, e.Unblock.Name)
+		}
+	}
+	fence.Fence()
+
+	for _, s := range e.Steps {
+		step(s)
+	}
+	if failed {
+		return result, fmt.Errorf("Forced teardown failed: %v", strings.Join(result.Errors, "; "))
+	}
+	logrus.Infof("go-iscsi-helper: %v: torn down forcefully, steps %v", e.Name, result.Escalations)
+	return result, nil
+}
@@ -0,0 +1,38 @@
+package iscsidev
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+)
+
+// GarbageCollectNodes removes the garbage records of the targets created by
+// the devices from the node database of the host, which is a known cause of
+// the discovery failures. It holds the operation lock so no attachment is in
+// progress meanwhile.
+func GarbageCollectNodes(config *Config) ([]string, error) {
+	lock := config.newLock()
+	if err := lock.Lock(); err != nil {
+		return nil, fmt.Errorf("Fail to lock: %v", err)
+	}
+	defer lock.Unlock()
+
+	ne, err := config.newHostExecutor()
+	if err != nil {
+		return nil, err
+	}
+	if config.NodeDatabaseBackupDir != "" {
+		backupFile := iscsi.GetScsiNodeDatabaseBackupName(config.NodeDatabaseBackupDir)
+		if _, err := iscsi.BackupScsiNodeDatabase(backupFile, ne); err != nil {
+			return nil, err
+		}
+		logrus.Infof("go-iscsi-helper: backed up node database to %v before garbage collection", backupFile)
+	}
+	removed, err := iscsi.GarbageCollectScsiNodes(TargetNamePrefix, ne)
+	for _, record := range removed {
+		logrus.Infof("go-iscsi-helper: removed garbage node record %v", record)
+	}
+	return removed, err
+}
@@ -0,0 +1,130 @@
+package iscsidev
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+)
+
+var (
+	RequiredKernelModules = []string{
+		"scsi_transport_iscsi",
+		"libiscsi",
+		"iscsi_tcp",
+	}
+)
+
+// NodeHealth is an aggregated health report of the node, for the readiness
+// probes and the support bundles
+type NodeHealth struct {
+	TgtdRunning       bool
+	IscsiadmAvailable bool
+	IscsidRunning     bool
+	KernelModules     map[string]bool
+	// LockAvailable is false if the operation lock is held longer than the
+	// LockTimeout of the config, which fails the operations waiting for it
+	LockAvailable bool
+	// LockHeldTime is how long the operation lock has been held, 0 if it's
+	// not held
+	LockHeldTime time.Duration
+
+	Targets  int
+	Sessions int
+	Devices  int
+
+	// BackingStoreErrors are the target side faults of the targets, which
+	// are reported separately since they fail the volumes instead of the
+	// node, and are not counted by Healthy
+	BackingStoreErrors []*BackingStoreError
+
+	Errors []string
+}
+
+// Healthy returns true if all the components are available
+func (h *NodeHealth) Healthy() bool {
+	for _, loaded := range h.KernelModules {
+		if !loaded {
+			return false
+		}
+	}
+	return h.TgtdRunning && h.IscsiadmAvailable && h.IscsidRunning && h.LockAvailable && len(h.Errors) == 0
+}
+
+// GetNodeHealth collects the health of the node. It never fails, the errors
+// encountered are recorded in the report instead. Only the targets and the
+// sessions created by the devices are counted. It doesn't take the operation
+// lock, so it can be called while the operations are in progress.
+func GetNodeHealth(config *Config) *NodeHealth {
+	h := &NodeHealth{
+		KernelModules:      map[string]bool{},
+		BackingStoreErrors: []*BackingStoreError{},
+		Errors:             []string{},
+	}
+	addError := func(format string, args ...interface{}) {
+		h.Errors = append(h.Errors, fmt.Sprintf(format, args...))
+	}
+
+	if targets, err := iscsi.GetTargets(); err != nil {
+		addError("Failed to get tgtd targets: %v", err)
+		if exitErr := iscsi.DefaultTgtd.GetDaemonExitError(); exitErr != nil {
+			addError("Tgtd exited unexpectedly: %v", exitErr)
+		}
+	} else {
+		h.TgtdRunning = true
+		for tid, name := range targets {
+			if !strings.HasPrefix(name, TargetNamePrefix) {
+				continue
+			}
+			h.Targets++
+			faults, err := checkBackingStores(iscsi.DefaultTgtd, tid, name)
+			if err != nil {
+				addError("Failed to check backing stores of target %v: %v", name, err)
+				continue
+			}
+			h.BackingStoreErrors = append(h.BackingStoreErrors, faults...)
+		}
+	}
+
+	ne, err := config.newHostExecutor()
+	if err != nil {
+		addError("Failed to enter host namespace: %v", err)
+		return h
+	}
+	// The lock is inspected instead of taken, so the probes never delay the
+	// operations
+	if h.LockHeldTime, err = config.getLockHeldTime(); err != nil {
+		addError("Failed to check operation lock: %v", err)
+	} else {
+		h.LockAvailable = h.LockHeldTime <= config.LockTimeout
+	}
+	for _, module := range RequiredKernelModules {
+		_, err := ne.Execute("ls", []string{"/sys/module/" + module})
+		h.KernelModules[module] = err == nil
+	}
+	if _, err := ne.Execute("pgrep", []string{"-x", "iscsid"}); err == nil {
+		h.IscsidRunning = true
+	}
+	if err := iscsi.CheckForInitiatorExistence(ne); err != nil {
+		addError("Iscsiadm is not available: %v", err)
+		return h
+	}
+	h.IscsiadmAvailable = true
+
+	sessions, err := iscsi.ListSessions(ne)
+	if err != nil {
+		addError("Failed to list sessions: %v", err)
+		return h
+	}
+	for _, session := range sessions {
+		if !strings.HasPrefix(session.Target, TargetNamePrefix) {
+			continue
+		}
+		h.Sessions++
+		if _, err := iscsi.FindDevice(session.Portal.IP, session.Target, config.TargetLunID, ne); err == nil {
+			h.Devices++
+		}
+	}
+	return h
+}
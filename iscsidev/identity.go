@@ -0,0 +1,47 @@
+package iscsidev
+
+import (
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/types"
+	"github.com/longhorn/go-iscsi-helper/util"
+)
+
+// addLun adds the LUN to the target with the serial verified once it's
+// attached, see verifyDeviceIdentity
+func (dev *Device) addLun(tgtd *iscsi.Tgtd, tid, lun int, backingFile, bsType, bsOpts string) error {
+	if err := tgtd.AddLun(tid, lun, backingFile, bsType, bsOpts); err != nil {
+		return err
+	}
+	return tgtd.SetLunSerial(tid, lun, iscsi.GetLunSerial(dev.Target, lun))
+}
+
+// verifyDeviceIdentity verifies the devices of all the LUNs are the ones of
+// the target before handing them to the caller
+func (dev *Device) verifyDeviceIdentity(ne *util.NamespaceExecutor, config *Config) error {
+	if err := dev.verifyLunIdentity(dev.KernelDevice, config.TargetLunID, ne); err != nil {
+		return err
+	}
+	for _, disk := range dev.Disks {
+		if disk.KernelDevice == nil {
+			continue
+		}
+		if err := dev.verifyLunIdentity(disk.KernelDevice, disk.LunID, ne); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dev *Device) verifyLunIdentity(kernelDevice *util.KernelDevice, lun int, ne *util.NamespaceExecutor) error {
+	// The serials of the SPDK LUNs are not managed by the library
+	if dev.Backend == types.TargetBackendSPDK {
+		return iscsi.VerifyDeviceIdentity(kernelDevice, dev.Target, lun, 0, "", ne)
+	}
+	// The default serial of tgtd is only known for the target exported on
+	// this node
+	tid := 0
+	if _, exportedTid, err := dev.getExportedTid(); err == nil {
+		tid = exportedTid
+	}
+	return iscsi.VerifyDeviceIdentity(kernelDevice, dev.Target, lun, tid, iscsi.GetLunSerial(dev.Target, lun), ne)
+}
@@ -2,16 +2,35 @@ package iscsidev
 
 import (
 	"fmt"
+	"net"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
-	"github.com/yasker/nsfilelock"
 
 	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/types"
 	"github.com/longhorn/go-iscsi-helper/util"
 )
 
+const (
+	// TargetNamePrefix is the prefix of the names of all the targets created
+	// by the devices
+	TargetNamePrefix = "iqn.2019-10.io.longhorn:"
+
+	TargetIDAllocationFirstFree = "first-free"
+	TargetIDAllocationHash      = "hash"
+
+	DataVerifyModeDisabled  = ""
+	DataVerifyModePattern   = "pattern"
+	DataVerifyModeSignature = "signature"
+)
+
+// The defaults of the settings of Config predating it, kept for the
+// consumers setting them. The other settings only exist in Config, see
+// DefaultConfig.
 var (
 	LockFile    = "/var/run/longhorn-iscsi.lock"
 	LockTimeout = 120 * time.Second
@@ -28,148 +47,581 @@ var (
 type Device struct {
 	Target       string
 	KernelDevice *util.KernelDevice
+	ByIDPath     string
 	BackingFile  string
 	BSType       string
 	BSOpts       string
+	// Backend is the target implementation, default to tgt if empty
+	Backend string
+	// Shared allows the target to be connected by multiple initiators, which
+	// must be allowed explicitly by AllowInitiator
+	Shared bool
+	// MultiWriter allows the shared target to be attached by multiple
+	// initiators at the same time, which is only safe if the writers
+	// coordinate, e.g. using a cluster filesystem
+	MultiWriter bool
+	// MaxSessions limits the number of the initiator sessions of the target,
+	// 0 means unlimited. See EnforceSessionLimit.
+	MaxSessions int
+	// NegotiationParams are applied to both the target and the initiator if
+	// it's set
+	NegotiationParams *iscsi.NegotiationParams
+	// Disks are the additional LUNs of the target, see AddDisk
+	Disks []*Disk
+	// TgtdInstance pins the target to the named tgtd instance of the
+	// config, the default instance is used if empty
+	TgtdInstance string
+	// IOLimits throttle the devices of the attachment in the ThrottleCgroup
+	// of the config, see SetIOLimits
+	IOLimits *util.IOLimits
 
 	targetID int
+	config   *Config
+
+	// initiatorsLock guards allowedInitiators, see GetAllowedInitiators
+	initiatorsLock    sync.Mutex
+	allowedInitiators map[string]struct{}
+
+	reportLock sync.Mutex
+	lastReport *OperationReport
+
+	// stateLock guards the state machine of the device, see GetState
+	stateLock    sync.Mutex
+	state        string
+	operation    *deviceOperation
+	operationSeq int
 }
 
 func NewDevice(name, backingFile, bsType, bsOpts string) (*Device, error) {
+	return NewDeviceWithConfig(name, backingFile, bsType, bsOpts, DefaultConfig())
+}
+
+func NewDeviceWithConfig(name, backingFile, bsType, bsOpts string, config *Config) (*Device, error) {
+	if err := util.ValidateArgument("volume name", name); err != nil {
+		return nil, err
+	}
+	if err := validateBackingStore(backingFile, bsType, bsOpts); err != nil {
+		return nil, err
+	}
 	dev := &Device{
 		Target:      GetTargetName(name),
 		BackingFile: backingFile,
 		BSType:      bsType,
 		BSOpts:      bsOpts,
+		config:      config,
+		state:       DeviceStateCreated,
+	}
+	if dev.config == nil {
+		dev.config = DefaultConfig()
+	}
+	if err := dev.config.Validate(); err != nil {
+		return nil, err
 	}
 	return dev, nil
 }
 
+func validateBackingStore(backingFile, bsType, bsOpts string) error {
+	if err := util.ValidateArgument("backing file", backingFile); err != nil {
+		return err
+	}
+	if err := util.ValidateArgument("backing store type", bsType); err != nil {
+		return err
+	}
+	return util.ValidateArgument("backing store options", bsOpts)
+}
+
 func Volume2ISCSIName(name string) string {
 	return strings.Replace(name, "_", ":", -1)
 }
 
 func GetTargetName(name string) string {
-	return "iqn.2019-10.io.longhorn:" + Volume2ISCSIName(name)
+	return TargetNamePrefix + Volume2ISCSIName(name)
 }
 
-func (dev *Device) CreateTarget() (err error) {
+// GetVolumeName returns the volume name of the target created by the devices,
+// or "" if the target is not created by this package
+func GetVolumeName(target string) string {
+	if !strings.HasPrefix(target, TargetNamePrefix) {
+		return ""
+	}
+	return strings.Replace(strings.TrimPrefix(target, TargetNamePrefix), ":", "_", -1)
+}
+
+func (dev *Device) CreateTarget() error {
+	return dev.runOperation(createTargetTransition, dev.createTarget)
+}
+
+func (dev *Device) createTarget() (err error) {
+	config := dev.getConfig()
+
+	if dev.Backend == types.TargetBackendSPDK {
+		return dev.createSPDKTarget()
+	}
+
+	tgtd, err := dev.getTgtd()
+	if err != nil {
+		return err
+	}
+	tgtdOptions, err := dev.getTgtdOptions()
+	if err != nil {
+		return err
+	}
+
 	// Start tgtd daemon if it's not already running
-	if err := iscsi.StartDaemon(false); err != nil {
+	if err := tgtd.StartDaemonWithOptions(tgtdOptions); err != nil {
 		return err
 	}
+	if config.ISNSServer != "" {
+		if err := enableISNS(tgtd, config); err != nil {
+			return err
+		}
+	}
 
 	tid := 0
-	for i := 0; i < RetryCounts; i++ {
-		if tid, err = iscsi.FindNextAvailableTargetID(); err != nil {
+	for i := 0; i < config.RetryCounts; i++ {
+		if config.TargetIDAllocation == TargetIDAllocationHash {
+			tid, err = tgtd.FindTargetIDForName(dev.Target)
+		} else {
+			tid, err = tgtd.FindNextAvailableTargetID()
+		}
+		if err != nil {
 			return err
 		}
 		logrus.Infof("go-iscsi-helper: found available target id %v", tid)
-		err = iscsi.CreateTarget(tid, dev.Target)
+		err = tgtd.CreateTarget(tid, dev.Target)
 		if err == nil {
 			dev.targetID = tid
 			break
 		}
 		logrus.Infof("go-iscsi-helper: failed to use target id %v, retrying with a new target ID: err %v", tid, err)
-		time.Sleep(RetryIntervalTargetID)
+		time.Sleep(config.RetryIntervalTargetID)
 		continue
 	}
 	if err != nil {
 		return err
 	}
+	// The device stays created if it fails, so it mustn't leave the target
+	defer func() {
+		if err != nil {
+			dev.rollbackTarget(tgtd)
+		}
+	}()
 
-	if err := iscsi.AddLun(dev.targetID, TargetLunID, dev.BackingFile, dev.BSType, dev.BSOpts); err != nil {
+	if err := dev.addLun(tgtd, dev.targetID, config.TargetLunID, dev.BackingFile, dev.BSType, dev.BSOpts); err != nil {
 		return err
 	}
-	if err := iscsi.BindInitiator(dev.targetID, "ALL"); err != nil {
+	if err := dev.addDiskLuns(tgtd, dev.targetID); err != nil {
 		return err
 	}
+	if dev.NegotiationParams != nil {
+		if err := tgtd.SetTargetNegotiationParams(dev.targetID, dev.NegotiationParams); err != nil {
+			return err
+		}
+	}
+	if dev.MaxSessions != 0 {
+		// Disallow multiple connections per session as well, otherwise a
+		// session can still be shared
+		if err := tgtd.UpdateTargetParam(dev.targetID, "MaxConnections", "1"); err != nil {
+			return err
+		}
+	}
+	// Bind the names first, so the target is never open to all the
+	// initiators in between
+	addresses, names := dev.getInitiatorACLs()
+	for _, initiator := range names {
+		if err := tgtd.BindInitiatorName(dev.targetID, initiator); err != nil {
+			return err
+		}
+	}
+	for _, address := range addresses {
+		if err := tgtd.BindInitiator(dev.targetID, address); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+func enableISNS(tgtd *iscsi.Tgtd, config *Config) error {
+	host, portString, err := net.SplitHostPort(config.ISNSServer)
+	if err != nil {
+		return fmt.Errorf("Invalid iSNS server %v: %v", config.ISNSServer, err)
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return fmt.Errorf("Invalid iSNS server %v: %v", config.ISNSServer, err)
+	}
+	return tgtd.EnableISNS(host, port, false)
+}
+
+// StartInitator records its OperationReport, see GetLastOperationReport
 func (dev *Device) StartInitator() error {
-	lock := nsfilelock.NewLockWithTimeout(util.GetHostNamespacePath(HostProc), LockFile, LockTimeout)
-	if err := lock.Lock(); err != nil {
-		return fmt.Errorf("Fail to lock: %v", err)
+	return dev.startInitiatorWithReport(0)
+}
+
+// TryStartInitiator is StartInitator returning ErrBusy if the operation lock
+// cannot be taken in timeout, so the caller can reschedule. Taking even an
+// uncontended lock spawns the flock process in the host namespace, so a
+// timeout much shorter than DefaultTryLockTimeout may fail spuriously on a
+// loaded node.
+func (dev *Device) TryStartInitiator(timeout time.Duration) error {
+	if timeout <= 0 {
+		return fmt.Errorf("Invalid lock timeout %v", timeout)
+	}
+	return dev.startInitiatorWithReport(timeout)
+}
+
+func (dev *Device) startInitiatorWithReport(tryTimeout time.Duration) error {
+	return dev.runOperation(startInitiatorTransition, func() error {
+		report := newOperationReport("start-initiator")
+		err := dev.startInitiator(tryTimeout, report)
+		report.finish(err)
+		dev.setLastOperationReport(report)
+		return err
+	})
+}
+
+// rollbackTarget deletes the target failed to be set up after it's created
+func (dev *Device) rollbackTarget(tgtd *iscsi.Tgtd) {
+	if err := purgeTarget(tgtd, dev.targetID); err != nil {
+		logrus.Warnf("Failed to delete target %v during rollback: %v", dev.Target, err)
+		return
+	}
+	logrus.Infof("go-iscsi-helper: rolled back target %v of TID %v", dev.Target, dev.targetID)
+	dev.targetID = 0
+}
+
+func (dev *Device) startInitiator(tryTimeout time.Duration, report *OperationReport) (err error) {
+	config := dev.getConfig()
+
+	endPhase := report.startPhase("lock")
+	lock, err := config.acquireLock(tryTimeout)
+	if err != nil {
+		return err
 	}
 	defer lock.Unlock()
+	endPhase()
 
-	ne, err := util.NewNamespaceExecutor(util.GetHostNamespacePath(HostProc))
+	ne, err := config.newHostExecutor()
 	if err != nil {
 		return err
 	}
+	report.watch(ne)
 
 	if err := iscsi.CheckForInitiatorExistence(ne); err != nil {
 		return err
 	}
+	if err := config.checkInitiatorTransport(ne); err != nil {
+		return err
+	}
 
 	localIP, err := util.GetIPToHost()
 	if err != nil {
 		return err
 	}
+	portal, err := dev.getPortalAddress(localIP)
+	if err != nil {
+		return err
+	}
 
-	// Setup initiator
-	err = nil
-	for i := 0; i < RetryCounts; i++ {
-		err = iscsi.DiscoverTarget(localIP, dev.Target, ne)
+	// The session left by a previous attachment is reused as it is, and
+	// isn't rolled back since it's not created here
+	if iscsi.IsTargetLoggedIn(localIP, dev.Target, ne) {
+		logrus.Infof("go-iscsi-helper: target %v is already logged in", dev.Target)
+	} else {
+		// Setup initiator
+		endPhase = report.startPhase("discovery")
+		dev.discoverTarget(localIP, portal, ne, config, report)
+		endPhase()
+
+		endPhase = report.startPhase("login")
+		if err := loginTarget(localIP, dev, ne, config); err != nil {
+			return err
+		}
+		endPhase()
+		// The device stays exported if it fails, so it mustn't leave the session
+		defer func() {
+			if err != nil {
+				dev.rollbackLogin(localIP, ne, report)
+			}
+		}()
+	}
+
+	endPhase = report.startPhase("device")
+	if dev.KernelDevice, err = iscsi.GetDevice(localIP, dev.Target, config.TargetLunID, ne); err != nil {
+		return err
+	}
+	if err := dev.getDiskDevices(localIP, ne); err != nil {
+		return err
+	}
+	endPhase()
+
+	return dev.setupDevices(ne, config, report)
+}
+
+// discoverTarget creates the node record of the target on portal, retrying
+// after cleaning up the broken records. The failure is left to the login.
+func (dev *Device) discoverTarget(localIP, portal string, ne *util.NamespaceExecutor, config *Config, report *OperationReport) {
+	var err error
+	for i := 0; i < config.RetryCounts; i++ {
+		if config.StaticNodeRecord {
+			err = iscsi.CreateNodeRecord(portal, dev.Target, config.InitiatorIface, ne)
+		} else if config.ISNSServer != "" {
+			err = iscsi.DiscoverTargetISNSWithIface(config.ISNSServer, dev.Target, config.InitiatorIface, ne)
+		} else {
+			err = iscsi.DiscoverTargetWithIface(portal, dev.Target, config.InitiatorIface, ne)
+		}
 		if iscsi.IsTargetDiscovered(localIP, dev.Target, ne) {
-			break
+			return
 		}
 
-		logrus.Warnf("FAIL to discover due to %v", err)
+		report.warnf("FAIL to discover due to %v", err)
+		report.retry()
 		// This is a trick to recover from the case. Remove the
 		// empty entries in /etc/iscsi/nodes/<target_name>. If one of the entry
 		// is empty it will triggered the issue.
 		if err := iscsi.CleanupScsiNodes(dev.Target, ne); err != nil {
-			logrus.Warnf("Fail to cleanup nodes for %v: %v", dev.Target, err)
+			report.warnf("Fail to cleanup nodes for %v: %v", dev.Target, err)
 		} else {
 			logrus.Warnf("Nodes cleaned up for %v", dev.Target)
 		}
 
-		time.Sleep(RetryIntervalSCSI)
+		time.Sleep(config.RetryIntervalSCSI)
+	}
+}
+
+// setupDevices verifies and configures the devices of the attachment once
+// they're resolved after login. It's shared by StartInitator and
+// StartInitiators, so the devices attached either way are the same.
+func (dev *Device) setupDevices(ne *util.NamespaceExecutor, config *Config, report *OperationReport) error {
+	var err error
+
+	endPhase := report.startPhase("identity")
+	if err := dev.verifyDeviceIdentity(ne, config); err != nil {
+		return err
+	}
+	if err := dev.applyScsiDeviceTimeout(ne, config); err != nil {
+		return err
+	}
+	endPhase()
+
+	endPhase = report.startPhase("verify")
+	if config.VerifyDeviceReady {
+		if err := iscsi.WaitForScsiDeviceReady(dev.KernelDevice, config.VerifyDeviceCapacity, ne); err != nil {
+			return err
+		}
+	}
+	if err := verifyDeviceData(dev.KernelDevice, ne, config); err != nil {
+		return err
 	}
-	if err := iscsi.LoginTarget(localIP, dev.Target, ne); err != nil {
+	endPhase()
+
+	if err := dev.applyDeviceNodeAttributes(ne, config); err != nil {
 		return err
 	}
-	if dev.KernelDevice, err = iscsi.GetDevice(localIP, dev.Target, TargetLunID, ne); err != nil {
+	if err := dev.applyIOLimits(ne, config); err != nil {
 		return err
 	}
 
+	// The by-id path is a convenience for the consumers, don't fail the
+	// attachment if udev didn't create it
+	if dev.ByIDPath, err = iscsi.GetDeviceByIDPath(dev.KernelDevice, ne); err != nil {
+		report.warnf("Failed to get by-id path for device %v: %v", dev.KernelDevice.Name, err)
+	}
+	return nil
+}
+
+// rollbackLogin logs out the target failed to attach after login, so the
+// session doesn't linger while the device is no longer considered attached
+func (dev *Device) rollbackLogin(ip string, ne *util.NamespaceExecutor, report *OperationReport) {
+	if err := iscsi.LogoutTarget(ip, dev.Target, ne); err != nil {
+		report.warnf("Failed to logout target %v after the failed attachment: %v", dev.Target, err)
+	} else {
+		logrus.Infof("go-iscsi-helper: logged out target %v after the failed attachment", dev.Target)
+	}
+	dev.KernelDevice = nil
+	dev.ByIDPath = ""
+	for _, disk := range dev.Disks {
+		disk.KernelDevice = nil
+	}
+}
+
+func (dev *Device) applyDeviceNodeAttributes(ne *util.NamespaceExecutor, config *Config) error {
+	if config.DeviceNodeAttributes == nil {
+		return nil
+	}
+	for _, kernelDevice := range dev.getKernelDevices() {
+		if err := util.ApplyDeviceNodeAttributesInNamespace("/dev/"+kernelDevice.Name, config.DeviceNodeAttributes, ne); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// applyScsiDeviceTimeout sets the timeouts of the config to the devices of
+// the attachment, which are recreated with the kernel defaults by every login
+func (dev *Device) applyScsiDeviceTimeout(ne *util.NamespaceExecutor, config *Config) error {
+	if config.ScsiDeviceTimeout == 0 && config.ScsiDeviceEHTimeout == 0 {
+		return nil
+	}
+	for _, kernelDevice := range dev.getKernelDevices() {
+		if err := iscsi.SetScsiDeviceTimeout(kernelDevice, config.ScsiDeviceTimeout, config.ScsiDeviceEHTimeout, ne); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func verifyDeviceData(kernelDevice *util.KernelDevice, ne *util.NamespaceExecutor, config *Config) error {
+	switch config.DataVerifyMode {
+	case DataVerifyModeDisabled:
+		return nil
+	case DataVerifyModePattern:
+		return iscsi.VerifyScsiDeviceData(kernelDevice, config.DataVerifyOffset, ne)
+	case DataVerifyModeSignature:
+		return iscsi.CheckScsiDeviceSignature(kernelDevice, config.DataVerifyOffset, config.DataVerifySignature, ne)
+	}
+	return fmt.Errorf("Invalid data verify mode %v", config.DataVerifyMode)
+}
+
+// StopInitiator fails with util.DeviceInUseError if the devices of the target
+// are still mounted or held open, see StopInitiatorWithReport
 func (dev *Device) StopInitiator() error {
-	lock := nsfilelock.NewLockWithTimeout(util.GetHostNamespacePath(HostProc), LockFile, LockTimeout)
-	if err := lock.Lock(); err != nil {
-		return fmt.Errorf("Fail to lock: %v", err)
+	_, err := dev.StopInitiatorWithReport(false)
+	return err
+}
+
+// TryStopInitiator is StopInitiator returning ErrBusy if the operation lock
+// cannot be taken in timeout, see TryStartInitiator
+func (dev *Device) TryStopInitiator(timeout time.Duration) error {
+	if timeout <= 0 {
+		return fmt.Errorf("Invalid lock timeout %v", timeout)
+	}
+	return dev.runOperation(stopInitiatorTransition, func() error {
+		report := newOperationReport("stop-initiator")
+		_, err := dev.stopInitiator(false, timeout, report)
+		report.finish(err)
+		dev.setLastOperationReport(report)
+		return err
+	})
+}
+
+// LogoutReport tells whether the logout cut off the active IO
+type LogoutReport struct {
+	// OutstandingIO is the number of the inflight requests of the devices
+	// indexed by the device names, which didn't drain in InflightIOTimeout
+	OutstandingIO map[string]int
+}
+
+// Clean returns true if there was no outstanding IO at the logout
+func (r *LogoutReport) Clean() bool {
+	return len(r.OutstandingIO) == 0
+}
+
+// StopInitiatorWithReport is StopInitiator returning the report of the logout.
+// If force is true, the target is logged out even if the devices are in use,
+// and it takes over the hanging stop of the device if any. It records its
+// OperationReport, see GetLastOperationReport.
+func (dev *Device) StopInitiatorWithReport(force bool) (*LogoutReport, error) {
+	transition := stopInitiatorTransition
+	if force {
+		transition = forceStopInitiatorTransition
+	}
+	var logoutReport *LogoutReport
+	err := dev.runOperation(transition, func() (err error) {
+		report := newOperationReport("stop-initiator")
+		logoutReport, err = dev.stopInitiator(force, 0, report)
+		report.finish(err)
+		dev.setLastOperationReport(report)
+		return err
+	})
+	return logoutReport, err
+}
+
+// ForceLogout is StopInitiatorWithReport(true) without taking the operation
+// lock, for the forced teardown of the device whose hanging graceful logout
+// holds the lock. The caller must ensure nothing else is attaching the target
+// in the meantime.
+func (dev *Device) ForceLogout() (*LogoutReport, error) {
+	var logoutReport *LogoutReport
+	err := dev.runOperation(forceStopInitiatorTransition, func() (err error) {
+		report := newOperationReport("force-logout")
+		endPhase := report.startPhase("logout")
+		if logoutReport, err = logoutTarget(dev.Target, dev.getConfig(), report); err != nil {
+			err = fmt.Errorf("Fail to logout target: %v", err)
+		} else {
+			endPhase()
+		}
+		report.finish(err)
+		dev.setLastOperationReport(report)
+		return err
+	})
+	return logoutReport, err
+}
+
+func (dev *Device) stopInitiator(force bool, tryTimeout time.Duration, report *OperationReport) (*LogoutReport, error) {
+	config := dev.getConfig()
+
+	endPhase := report.startPhase("lock")
+	lock, err := config.acquireLock(tryTimeout)
+	if err != nil {
+		return nil, err
 	}
 	defer lock.Unlock()
+	endPhase()
 
-	if err := LogoutTarget(dev.Target); err != nil {
-		return fmt.Errorf("Fail to logout target: %v", err)
+	if !force {
+		endPhase = report.startPhase("check-in-use")
+		if err := checkDevicesInUse(dev.Target, config); err != nil {
+			return nil, err
+		}
+		endPhase()
 	}
-	return nil
+
+	endPhase = report.startPhase("logout")
+	logoutReport, err := logoutTarget(dev.Target, config, report)
+	if err != nil {
+		return nil, fmt.Errorf("Fail to logout target: %v", err)
+	}
+	endPhase()
+	return logoutReport, nil
 }
 
 func LogoutTarget(target string) error {
-	ne, err := util.NewNamespaceExecutor(util.GetHostNamespacePath(HostProc))
+	return LogoutTargetWithConfig(target, DefaultConfig())
+}
+
+func LogoutTargetWithConfig(target string, config *Config) error {
+	_, err := logoutTarget(target, config, nil)
+	return err
+}
+
+// logoutTarget records the commands, the retries and the warnings to op if
+// it's not nil
+func logoutTarget(target string, config *Config, op *OperationReport) (*LogoutReport, error) {
+	report := &LogoutReport{
+		OutstandingIO: map[string]int{},
+	}
+
+	ne, err := config.newHostExecutor()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	op.watch(ne)
 	ip, err := util.GetIPToHost()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if err := iscsi.CheckForInitiatorExistence(ne); err != nil {
-		return err
+		return nil, err
 	}
 	if iscsi.IsTargetLoggedIn(ip, target, ne) {
 		var err error
 		loggingOut := false
 
 		logrus.Infof("Shutdown SCSI device for %v:%v", ip, target)
-		for i := 0; i < RetryCounts; i++ {
+		deleteDevices(ip, target, ne, config, report, op)
+		for i := 0; i < config.RetryCounts; i++ {
 			err = iscsi.LogoutTarget(ip, target, ne)
 			// Ignore Not Found error
 			if err == nil || strings.Contains(err.Error(), "exit status 21") {
@@ -182,21 +634,18 @@ func LogoutTarget(target string) error {
 				loggingOut = true
 				break
 			}
-			time.Sleep(RetryIntervalSCSI)
+			op.retry()
+			time.Sleep(config.RetryIntervalSCSI)
 		}
 		// Wait for device to logout
 		if loggingOut {
-			logrus.Infof("Logout SCSI device timeout, waiting for logout complete")
-			for i := 0; i < RetryCounts; i++ {
-				if !iscsi.IsTargetLoggedIn(ip, target, ne) {
-					err = nil
-					break
-				}
-				time.Sleep(RetryIntervalSCSI)
+			op.warnf("Logout SCSI device timeout, waiting for logout complete")
+			if waitForLogout(ip, target, ne, config) {
+				err = nil
 			}
 		}
 		if err != nil {
-			return fmt.Errorf("Failed to logout target: %v", err)
+			return nil, fmt.Errorf("Failed to logout target: %v", err)
 		}
 		/*
 		 * Immediately delete target after logout may result in error:
@@ -209,7 +658,7 @@ func LogoutTarget(target string) error {
 		 * Retry to workaround this issue. Also treat "exit status
 		 * 21"(no record found) as valid result
 		 */
-		for i := 0; i < RetryCounts; i++ {
+		for i := 0; i < config.RetryCounts; i++ {
 			if !iscsi.IsTargetDiscovered(ip, target, ne) {
 				err = nil
 				break
@@ -221,42 +670,151 @@ func LogoutTarget(target string) error {
 				err = nil
 				break
 			}
-			time.Sleep(RetryIntervalSCSI)
+			op.retry()
+			time.Sleep(config.RetryIntervalSCSI)
 		}
 		if err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// checkDevicesInUse returns util.DeviceInUseError for the first device of the
+// target in use
+func checkDevicesInUse(target string, config *Config) error {
+	ne, err := config.newHostExecutor()
+	if err != nil {
+		return err
+	}
+	ip, err := util.GetIPToHost()
+	if err != nil {
+		return err
+	}
+	return checkTargetDevicesInUse(ip, target, ne)
+}
+
+func checkTargetDevicesInUse(ip, target string, ne *util.NamespaceExecutor) error {
+	devices, err := iscsi.GetDevices(ip, target, ne)
+	if err != nil {
+		return err
+	}
+	for _, dev := range devices {
+		if err := util.CheckDeviceInUse(dev, ne); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// deleteDevices flushes and deletes the SCSI devices of the target before
+// logout, so the kernel won't log the IO errors of the disappearing LUNs or
+// leave the device nodes dangling. It's best effort, the logout removes the
+// devices anyway. The inflight IO not drained in time is recorded in report.
+// All the devices share one InflightIOTimeout, so the logout of a target with
+// many LUNs isn't delayed by the timeout of each of them.
+func deleteDevices(ip, target string, ne *util.NamespaceExecutor, config *Config, report *LogoutReport, op *OperationReport) {
+	devices, err := iscsi.GetDevices(ip, target, ne)
+	if err != nil {
+		op.warnf("Failed to get devices of %v:%v before logout: %v", ip, target, err)
+		return
+	}
+	deadline := time.Now().Add(config.InflightIOTimeout)
+	for lun, dev := range devices {
+		outstanding, err := iscsi.WaitForScsiDeviceIdle(dev, time.Until(deadline), ne)
+		if err != nil {
+			op.warnf("Failed to get inflight IO of device %v of LUN %v before logout: %v", dev.Name, lun, err)
+		} else if outstanding != 0 {
+			op.warnf("Device %v of LUN %v still has %v inflight requests, logging out anyway", dev.Name, lun, outstanding)
+			report.OutstandingIO[dev.Name] = outstanding
+		}
+		if err := iscsi.FlushScsiDevice(dev, config.FlushBuffersOnLogout, ne); err != nil {
+			op.warnf("Failed to flush device %v of LUN %v before logout: %v", dev.Name, lun, err)
+		}
+		// The io.max entry outlives the device, and would throttle the next
+		// device reusing its number
+		if config.ThrottleCgroup != "" {
+			if err := util.SetDeviceIOLimits(config.ThrottleCgroup, dev, nil, ne); err != nil {
+				op.warnf("Failed to clear IO limits of device %v of LUN %v before logout: %v", dev.Name, lun, err)
+			}
+		}
+		if err := iscsi.DeleteScsiDevice(dev, ne); err != nil {
+			op.warnf("Failed to delete device %v of LUN %v before logout: %v", dev.Name, lun, err)
+		}
+	}
+}
+
+// waitForLogout waits for the session to be gone. It's woken up by the removal
+// uevents of the session, and falls back to poll every LogoutPollInterval.
+func waitForLogout(ip, target string, ne *util.NamespaceExecutor, config *Config) bool {
+	monitor, err := util.NewUeventMonitor()
+	if err != nil {
+		logrus.Debugf("Cannot monitor uevents, fall back to polling: %v", err)
+	} else {
+		defer monitor.Close()
+	}
+	isRemoved := func(event *util.Uevent) bool {
+		return event.Action == util.UeventActionRemove
+	}
+	timeout := time.Duration(config.RetryCounts) * config.RetryIntervalSCSI
+	return util.WaitForCondition(timeout, config.LogoutPollInterval, monitor, isRemoved, func() bool {
+		return !iscsi.IsTargetLoggedIn(ip, target, ne)
+	})
+}
+
 func (dev *Device) DeleteTarget() error {
-	if tid, err := iscsi.GetTargetTid(dev.Target); err == nil && tid != -1 {
+	return dev.runOperation(deleteTargetTransition, dev.deleteTarget)
+}
+
+func (dev *Device) deleteTarget() error {
+	config := dev.getConfig()
+
+	if dev.Backend == types.TargetBackendSPDK {
+		return dev.deleteSPDKTarget()
+	}
+
+	tgtd, err := dev.getTgtd()
+	if err != nil {
+		return err
+	}
+
+	if tid, err := tgtd.GetTargetTid(dev.Target); err == nil && tid != -1 {
 		if tid != dev.targetID && dev.targetID != 0 {
 			logrus.Errorf("BUG: Invalid TID %v found for %v, was %v", tid, dev.Target, dev.targetID)
 		}
 		logrus.Infof("Shutdown SCSI target %v", dev.Target)
-		if err := iscsi.UnbindInitiator(tid, "ALL"); err != nil {
-			return err
+		addresses, names := dev.getInitiatorACLs()
+		for _, address := range addresses {
+			if err := tgtd.UnbindInitiator(tid, address); err != nil {
+				return err
+			}
+		}
+		for _, initiator := range names {
+			if err := tgtd.UnbindInitiatorName(tid, initiator); err != nil {
+				return err
+			}
 		}
 
-		sessionConnectionsMap, err := iscsi.GetTargetConnections(tid)
+		sessionConnectionsMap, err := tgtd.GetTargetConnections(tid)
 		if err != nil {
 			return err
 		}
 		for sid, cidList := range sessionConnectionsMap {
 			for _, cid := range cidList {
-				if err := iscsi.CloseConnection(tid, sid, cid); err != nil {
+				if err := tgtd.CloseConnection(tid, sid, cid); err != nil {
 					return err
 				}
 			}
 		}
 
-		if err := iscsi.DeleteLun(tid, TargetLunID); err != nil {
+		if err := dev.deleteDiskLuns(tgtd, tid); err != nil {
+			return err
+		}
+		if err := tgtd.DeleteLun(tid, config.TargetLunID); err != nil {
 			return err
 		}
 
-		if err := iscsi.DeleteTarget(tid); err != nil {
+		if err := tgtd.DeleteTarget(tid); err != nil {
 			return err
 		}
 	}
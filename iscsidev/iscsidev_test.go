@@ -0,0 +1,66 @@
+package iscsidev
+
+import (
+	"testing"
+	"time"
+
+	"github.com/longhorn/go-iscsi-helper/types"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TestSuite struct {
+}
+
+var _ = Suite(&TestSuite{})
+
+func (s *TestSuite) TestGetInitiatorACLs(c *C) {
+	dev := &Device{Target: "iqn.2019-10.io.longhorn:vol1"}
+	addresses, names := dev.getInitiatorACLs()
+	c.Assert(addresses, DeepEquals, []string{"ALL"})
+	c.Assert(names, HasLen, 0)
+
+	// The shared target rejects all the initiators until one is allowed
+	dev.Shared = true
+	addresses, names = dev.getInitiatorACLs()
+	c.Assert(addresses, HasLen, 0)
+	c.Assert(names, HasLen, 0)
+
+	dev.allowedInitiators = map[string]struct{}{
+		"iqn.2016-08.com.example:node2": {},
+		"iqn.2016-08.com.example:node1": {},
+	}
+	addresses, names = dev.getInitiatorACLs()
+	c.Assert(addresses, DeepEquals, []string{"ALL"})
+	c.Assert(names, DeepEquals, []string{"iqn.2016-08.com.example:node1", "iqn.2016-08.com.example:node2"})
+}
+
+func (s *TestSuite) TestParseLockHolder(c *C) {
+	holder, err := parseLockHolder("pid=2371 hostname=node-a time=2019-10-01T08:00:00Z\n")
+	c.Assert(err, IsNil)
+	c.Assert(holder.PID, Equals, 2371)
+	c.Assert(holder.Hostname, Equals, "node-a")
+	c.Assert(holder.Time.Equal(time.Date(2019, 10, 1, 8, 0, 0, 0, time.UTC)), Equals, true)
+
+	again, err := parseLockHolder(holder.String())
+	c.Assert(err, IsNil)
+	c.Assert(*again, Equals, *holder)
+
+	_, err = parseLockHolder("pid=x hostname=node-a time=2019-10-01T08:00:00Z")
+	c.Assert(err, NotNil)
+	_, err = parseLockHolder("pid=2371 hostname=node-a")
+	c.Assert(err, NotNil)
+}
+
+func (s *TestSuite) TestValidateSPDKDevice(c *C) {
+	dev := &Device{Target: "iqn.2019-10.io.longhorn:vol1", Backend: types.TargetBackendSPDK}
+	c.Assert(dev.validateSPDKDevice(), IsNil)
+
+	dev.Shared = true
+	dev.MaxSessions = 1
+	err := dev.validateSPDKDevice()
+	c.Assert(err, NotNil)
+	c.Assert(err, ErrorMatches, "Shared, MaxSessions of target .* are not supported by spdk backend")
+}
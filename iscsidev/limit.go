@@ -0,0 +1,123 @@
+package iscsidev
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+)
+
+// SessionLimitReport reports the sessions of the target when enforcing the
+// session limit
+type SessionLimitReport struct {
+	MaxSessions int
+	// Sessions are the sessions kept
+	Sessions []*iscsi.TargetSession
+	// Closed are the sessions exceeding the limit and closed
+	Closed []*iscsi.TargetSession
+	// Initiators are the initiators the target is restricted to, empty if
+	// the limit is not exceeded
+	Initiators []string
+}
+
+// EnforceSessionLimit closes the sessions exceeding MaxSessions, so a target
+// intended for one consumer cannot be silently attached by another node. The
+// oldest sessions are kept. It's no-op if MaxSessions is 0.
+//
+// Closing the sessions alone doesn't stop iscsid from logging back in, so the
+// target is restricted to the initiators of the kept sessions by the initiator
+// name ACL first, or the other initiators are disallowed if the target is
+// shared. The restriction stays until the target is recreated. The sessions
+// exceeding the limit from a kept initiator cannot be fenced by the ACL, and
+// are only closed.
+func (dev *Device) EnforceSessionLimit() (*SessionLimitReport, error) {
+	report := &SessionLimitReport{
+		MaxSessions: dev.MaxSessions,
+		Sessions:    []*iscsi.TargetSession{},
+		Closed:      []*iscsi.TargetSession{},
+		Initiators:  []string{},
+	}
+
+	tgtd, tid, err := dev.getExportedTid()
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := tgtd.GetTargetSessions(tid)
+	if err != nil {
+		return nil, err
+	}
+	// tgtd allocates the session IDs incrementally
+	sort.Slice(sessions, func(i, j int) bool {
+		a, _ := strconv.Atoi(sessions[i].SID)
+		b, _ := strconv.Atoi(sessions[j].SID)
+		return a < b
+	})
+	if dev.MaxSessions == 0 || len(sessions) <= dev.MaxSessions {
+		report.Sessions = sessions
+		return report, nil
+	}
+
+	report.Sessions = sessions[:dev.MaxSessions]
+	kept := map[string]struct{}{}
+	for _, session := range report.Sessions {
+		if _, exists := kept[session.Initiator]; exists {
+			continue
+		}
+		kept[session.Initiator] = struct{}{}
+		report.Initiators = append(report.Initiators, session.Initiator)
+	}
+	if err := dev.restrictInitiators(tgtd, tid, kept, sessions[dev.MaxSessions:]); err != nil {
+		return report, err
+	}
+
+	for _, session := range sessions[dev.MaxSessions:] {
+		if _, exists := kept[session.Initiator]; exists {
+			logrus.Warnf("go-iscsi-helper: target %v exceeds session limit %v, closing session %v from kept initiator %v %v, which may log back in",
+				dev.Target, dev.MaxSessions, session.SID, session.Initiator, session.IPAddresses)
+		} else {
+			logrus.Warnf("go-iscsi-helper: target %v exceeds session limit %v, closing session %v from initiator %v %v",
+				dev.Target, dev.MaxSessions, session.SID, session.Initiator, session.IPAddresses)
+		}
+		for _, cid := range session.CIDs {
+			if err := tgtd.CloseConnection(tid, session.SID, cid); err != nil {
+				return report, err
+			}
+		}
+		report.Closed = append(report.Closed, session)
+	}
+	return report, nil
+}
+
+// restrictInitiators stops the initiators of the exceeding sessions from
+// logging back in. tgtd accepts any initiator name if the name ACL of the
+// target is empty, so binding the kept initiators rejects all the others.
+// The shared target is already restricted to the allowed initiators, so the
+// exceeding ones are unbound instead, while the wildcard address stays bound
+// for the kept ones, see getInitiatorACLs.
+func (dev *Device) restrictInitiators(tgtd *iscsi.Tgtd, tid int, kept map[string]struct{}, exceeding []*iscsi.TargetSession) error {
+	if dev.Shared {
+		for _, session := range exceeding {
+			if _, exists := kept[session.Initiator]; exists || !dev.isInitiatorAllowed(session.Initiator) {
+				continue
+			}
+			if err := dev.unbindAllowedInitiator(tgtd, tid, session.Initiator); err != nil {
+				return err
+			}
+			dev.initiatorsLock.Lock()
+			delete(dev.allowedInitiators, session.Initiator)
+			dev.initiatorsLock.Unlock()
+			logrus.Infof("go-iscsi-helper: initiator %v is disallowed to attach shared target %v due to session limit %v",
+				session.Initiator, dev.Target, dev.MaxSessions)
+		}
+		return nil
+	}
+	for initiator := range kept {
+		if err := tgtd.BindInitiatorName(tid, initiator); err != nil {
+			return err
+		}
+		logrus.Infof("go-iscsi-helper: target %v is restricted to initiator %v due to session limit %v", dev.Target, initiator, dev.MaxSessions)
+	}
+	return nil
+}
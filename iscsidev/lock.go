@@ -0,0 +1,254 @@
+package iscsidev
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/yasker/nsfilelock"
+
+	"github.com/longhorn/go-iscsi-helper/util"
+)
+
+const (
+	lockHolderSuffix = ".holder"
+
+	// DefaultTryLockTimeout is the suggested timeout of the non-blocking
+	// operations, see TryStartInitiator
+	DefaultTryLockTimeout = 500 * time.Millisecond
+)
+
+// ErrBusy is returned by the non-blocking operations if the operation lock is
+// held by another operation
+var ErrBusy = errors.New("operation lock is busy")
+
+// operationLock is the nsfilelock of the operations, which records its holder
+// next to the lock file. The flock process started by nsfilelock normally
+// exits with its owner due to Pdeathsig, but the signal is sent once the
+// thread started it exits, so the process can outlive a crashed owner and
+// keep the lock until the timeout. The lock is broken in that case, see
+// breakStaleLock.
+type operationLock struct {
+	*nsfilelock.NSFileLock
+	config *Config
+}
+
+func (c *Config) newLock() *operationLock {
+	// nsfilelock redirects to the path in the script of "bash -c"
+	return &operationLock{
+		NSFileLock: nsfilelock.NewLockWithTimeout(util.GetHostNamespacePath(c.HostProc), util.ShellQuote(c.LockFile), c.LockTimeout),
+		config:     c,
+	}
+}
+
+// acquireLock takes the operation lock. If tryTimeout is positive, it returns
+// ErrBusy if the lock cannot be taken in tryTimeout, otherwise it waits for
+// LockTimeout.
+func (c *Config) acquireLock(tryTimeout time.Duration) (*operationLock, error) {
+	lock := c.newLock()
+	if tryTimeout <= 0 {
+		if err := lock.Lock(); err != nil {
+			return nil, fmt.Errorf("Fail to lock: %v", err)
+		}
+		return lock, nil
+	}
+
+	lock.Timeout = tryTimeout
+	if err := lock.Lock(); err != nil {
+		if isLockTimeout(err) {
+			return nil, ErrBusy
+		}
+		return nil, fmt.Errorf("Fail to lock: %v", err)
+	}
+	return lock, nil
+}
+
+func isLockTimeout(err error) bool {
+	return strings.Contains(err.Error(), "Timeout waiting for lock")
+}
+
+// Lock checks whether the lock is stale after StaleLockCheckInterval, and
+// breaks it once if so, before waiting for the rest of the timeout
+func (l *operationLock) Lock() error {
+	timeout := l.Timeout
+	probe := l.config.StaleLockCheckInterval
+	if probe <= 0 || probe >= timeout {
+		return l.lock()
+	}
+	defer func() {
+		l.Timeout = timeout
+	}()
+
+	l.Timeout = probe
+	err := l.lock()
+	if err == nil || !isLockTimeout(err) {
+		return err
+	}
+	if err := l.breakStaleLock(); err != nil {
+		logrus.Warnf("go-iscsi-helper: failed to check stale lock %v: %v", l.config.LockFile, err)
+	}
+	l.Timeout = timeout - probe
+	return l.lock()
+}
+
+func (l *operationLock) lock() error {
+	if err := l.NSFileLock.Lock(); err != nil {
+		return err
+	}
+	l.recordHolder()
+	return nil
+}
+
+// lockHolder is recorded next to the lock file by its holder. PID is in the
+// PID namespace of HostProc, and 0 if the holder isn't visible there.
+type lockHolder struct {
+	PID      int
+	Hostname string
+	Time     time.Time
+}
+
+func (h *lockHolder) String() string {
+	return fmt.Sprintf("pid=%v hostname=%v time=%v", h.PID, h.Hostname, h.Time.Format(time.RFC3339))
+}
+
+func parseLockHolder(output string) (*lockHolder, error) {
+	h := &lockHolder{}
+	for _, field := range strings.Fields(output) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		var err error
+		switch kv[0] {
+		case "pid":
+			h.PID, err = strconv.Atoi(kv[1])
+		case "hostname":
+			h.Hostname = kv[1]
+		case "time":
+			h.Time, err = time.Parse(time.RFC3339, kv[1])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid lock holder %v: %v", strings.TrimSpace(output), err)
+		}
+	}
+	if h.Time.IsZero() {
+		return nil, fmt.Errorf("Invalid lock holder %v", strings.TrimSpace(output))
+	}
+	return h, nil
+}
+
+// getHostPath returns the path of the file in the mount namespace the lock is
+// taken in, so it can be accessed without entering the namespace
+func (c *Config) getHostPath(file string) string {
+	ns := util.GetHostNamespacePath(c.HostProc)
+	return filepath.Join(filepath.Dir(filepath.Clean(ns)), "root", file)
+}
+
+// recordHolder leaves the holder next to the lock file, see lockHolder
+func (l *operationLock) recordHolder() {
+	h := &lockHolder{
+		Time: time.Now(),
+	}
+	h.Hostname, _ = os.Hostname()
+	if self, err := os.Readlink(filepath.Join(l.config.HostProc, "self")); err == nil {
+		h.PID, _ = strconv.Atoi(self)
+	}
+	if err := ioutil.WriteFile(l.config.getHostPath(l.config.LockFile+lockHolderSuffix), []byte(h.String()+"\n"), 0644); err != nil {
+		logrus.Debugf("go-iscsi-helper: failed to record lock holder: %v", err)
+	}
+}
+
+func (c *Config) getLockHolder() (*lockHolder, error) {
+	data, err := ioutil.ReadFile(c.getHostPath(c.LockFile + lockHolderSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the holder of lock %v: %v", c.LockFile, err)
+	}
+	return parseLockHolder(string(data))
+}
+
+// getLockInode returns 0 if the lock file doesn't exist, it's created by the
+// first lock
+func (c *Config) getLockInode() (uint64, error) {
+	info, err := os.Stat(c.getHostPath(c.LockFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("Cannot get inode of %v", c.LockFile)
+	}
+	return stat.Ino, nil
+}
+
+// breakStaleLock kills the flock processes holding the lock if the recorded
+// holder is dead. The holder is read again before that, in case the lock was
+// taken by a new holder in between. It's skipped if the caller isn't in the
+// PID namespace of HostProc, since the PIDs cannot be checked then.
+func (l *operationLock) breakStaleLock() error {
+	self, err := os.Readlink(filepath.Join(l.config.HostProc, "self"))
+	if err != nil || self != strconv.Itoa(os.Getpid()) {
+		return fmt.Errorf("Cannot check lock holder outside of the PID namespace of %v", l.config.HostProc)
+	}
+	holder, err := l.config.getLockHolder()
+	if err != nil {
+		return err
+	}
+	if holder.PID == 0 {
+		return fmt.Errorf("Unknown PID of lock holder %v", holder)
+	}
+	if _, err := os.Stat(filepath.Join(l.config.HostProc, strconv.Itoa(holder.PID))); err == nil {
+		logrus.Infof("go-iscsi-helper: lock %v is held by %v", l.config.LockFile, holder)
+		return nil
+	}
+
+	inode, err := l.config.getLockInode()
+	if err != nil || inode == 0 {
+		return err
+	}
+	pids, err := util.GetFlockHolders(l.config.HostProc, inode)
+	if err != nil || len(pids) == 0 {
+		return err
+	}
+	current, err := l.config.getLockHolder()
+	if err != nil {
+		return err
+	}
+	if *current != *holder {
+		return nil
+	}
+	logrus.Warnf("go-iscsi-helper: breaking stale lock %v held by processes %v, the holder %v is dead", l.config.LockFile, pids, holder)
+	for _, pid := range pids {
+		if err := syscall.Kill(pid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("Failed to kill stale lock process %v: %v", pid, err)
+		}
+	}
+	return nil
+}
+
+// getLockHeldTime returns how long the operation lock has been held by the
+// current holder, or 0 if it's not held, without taking it
+func (c *Config) getLockHeldTime() (time.Duration, error) {
+	inode, err := c.getLockInode()
+	if err != nil || inode == 0 {
+		return 0, err
+	}
+	locked, err := util.IsFlocked(inode)
+	if err != nil || !locked {
+		return 0, err
+	}
+	holder, err := c.getLockHolder()
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(holder.Time), nil
+}
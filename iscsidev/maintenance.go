@@ -0,0 +1,169 @@
+package iscsidev
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/util"
+)
+
+// ErrNotMounted is returned by QuiesceDuring without running fn if no
+// filesystem of the device is mounted, so the caller decides whether to run it
+// unquiesced
+var ErrNotMounted = errors.New("no filesystem of the device is mounted")
+
+// getExportedTid returns the tgtd instance of the target along with the TID
+func (dev *Device) getExportedTid() (*iscsi.Tgtd, int, error) {
+	tgtd, err := dev.getTgtd()
+	if err != nil {
+		return nil, -1, err
+	}
+	tid, err := tgtd.GetTargetTid(dev.Target)
+	if err != nil {
+		return nil, -1, err
+	}
+	if tid == -1 {
+		return nil, -1, fmt.Errorf("target %v doesn't exist", dev.Target)
+	}
+	return tgtd, tid, nil
+}
+
+// EnterMaintenance sets the target offline without deleting it, so the
+// backing store can be maintained while the initiators see a not-ready
+// condition instead of losing the connections
+func (dev *Device) EnterMaintenance() error {
+	tgtd, tid, err := dev.getExportedTid()
+	if err != nil {
+		return err
+	}
+	if err := tgtd.UpdateTargetState(tid, iscsi.TargetStateOffline); err != nil {
+		return err
+	}
+	logrus.Infof("go-iscsi-helper: target %v entered maintenance", dev.Target)
+	return nil
+}
+
+// ExitMaintenance sets the target back to ready
+func (dev *Device) ExitMaintenance() error {
+	tgtd, tid, err := dev.getExportedTid()
+	if err != nil {
+		return err
+	}
+	if err := tgtd.UpdateTargetState(tid, iscsi.TargetStateReady); err != nil {
+		return err
+	}
+	logrus.Infof("go-iscsi-helper: target %v exited maintenance", dev.Target)
+	return nil
+}
+
+// InMaintenance returns whether the target is offline
+func (dev *Device) InMaintenance() (bool, error) {
+	tgtd, tid, err := dev.getExportedTid()
+	if err != nil {
+		return false, err
+	}
+	state, err := tgtd.GetTargetState(tid)
+	if err != nil {
+		return false, err
+	}
+	return state == iscsi.TargetStateOffline, nil
+}
+
+// SetLunOnline sets the LUN of the target online or offline without deleting
+// it, so the sessions are kept while the LUN reports not ready, e.g. during
+// the consistency check of the backing file
+func (dev *Device) SetLunOnline(lun int, online bool) error {
+	tgtd, tid, err := dev.getExportedTid()
+	if err != nil {
+		return err
+	}
+	if err := tgtd.UpdateLunOnline(tid, lun, online); err != nil {
+		return err
+	}
+	logrus.Infof("go-iscsi-helper: set LUN %v of target %v online %v", lun, dev.Target, online)
+	return nil
+}
+
+// SetOnline sets all the LUNs of the device online or offline
+func (dev *Device) SetOnline(online bool) error {
+	if err := dev.SetLunOnline(dev.getConfig().TargetLunID, online); err != nil {
+		return err
+	}
+	for _, disk := range dev.Disks {
+		if err := dev.SetLunOnline(disk.LunID, online); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsLunOnline returns whether the LUN of the target is online
+func (dev *Device) IsLunOnline(lun int) (bool, error) {
+	tgtd, tid, err := dev.getExportedTid()
+	if err != nil {
+		return false, err
+	}
+	return tgtd.IsLunOnline(tid, lun)
+}
+
+// CloseConnections closes all the connections to the target without deleting
+// it, which fails the pending IO of the initiators, e.g. to unblock a logout
+// hanging on the unresponsive backing store
+func (dev *Device) CloseConnections() error {
+	tgtd, tid, err := dev.getExportedTid()
+	if err != nil {
+		return err
+	}
+	if err := closeTargetConnections(tgtd, tid); err != nil {
+		return err
+	}
+	logrus.Infof("go-iscsi-helper: closed all connections of target %v", dev.Target)
+	return nil
+}
+
+// QuiesceDuring freezes the filesystems mounted on the device in the host
+// namespace while fn is running, e.g. swapping the backing store or taking a
+// snapshot, so the data is at a consistent point. The filesystems are thawed
+// after maxFreeze even if fn is still running, see
+// util.FreezeFilesystemsDuring. The mounts are found by the major:minor of the
+// device and its holders. fn isn't run if nothing is mounted, which returns
+// ErrNotMounted, or if a filesystem is only mounted in another mount namespace
+// and cannot be frozen from the host.
+func (dev *Device) QuiesceDuring(maxFreeze time.Duration, fn func() error) error {
+	if dev.KernelDevice == nil {
+		return fmt.Errorf("Cannot quiesce target %v since it's not attached", dev.Target)
+	}
+	ne, err := dev.getConfig().newHostExecutor()
+	if err != nil {
+		return err
+	}
+	mounts, err := util.GetDeviceMounts(dev.KernelDevice, ne)
+	if err != nil {
+		return err
+	}
+	if len(mounts) == 0 {
+		return ErrNotMounted
+	}
+	// Freezing one mount point freezes the filesystem of the device
+	mountpoints := []string{}
+	frozen := map[string]struct{}{}
+	for _, m := range mounts {
+		if _, exists := frozen[m.Device]; exists || !m.Local {
+			continue
+		}
+		frozen[m.Device] = struct{}{}
+		mountpoints = append(mountpoints, m.MountPoint)
+	}
+	for _, m := range mounts {
+		if _, exists := frozen[m.Device]; !exists {
+			return fmt.Errorf("Cannot quiesce target %v since device %v is only mounted at %v in another mount namespace",
+				dev.Target, m.Device, m.MountPoint)
+		}
+	}
+	logrus.Infof("go-iscsi-helper: quiescing filesystems %v of target %v", mountpoints, dev.Target)
+	return util.FreezeFilesystemsDuring(mountpoints, maxFreeze, fn, ne)
+}
@@ -0,0 +1,138 @@
+package iscsidev
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/types"
+	"github.com/longhorn/go-iscsi-helper/util"
+)
+
+// MigrateTargetPortal moves the attachment of the device to the same target
+// exported on another node at newPortal, in the IP:Port format. The new
+// target must be exported with the same backing data before calling it.
+//
+// The initiator of this node logs in the new portal and then logs out the old
+// sessions, which replaces the kernel device of the attachment, see
+// Device.KernelDevice. It's disruptive to the users of the old device, so it
+// fails with util.DeviceInUseError if the devices of the old sessions are
+// still mounted or held open. Migrating under the users would need multipath
+// across the old and the new portal, which this doesn't set up. If the target
+// is exported on this node, it redirects the logins to the new portal and
+// closes the connections, so the initiators of the other nodes follow it.
+func (dev *Device) MigrateTargetPortal(newPortal string) error {
+	return dev.runOperation(updateTargetTransition, func() error {
+		return dev.migrateTargetPortal(newPortal)
+	})
+}
+
+func (dev *Device) migrateTargetPortal(newPortal string) error {
+	if dev.Backend == types.TargetBackendSPDK {
+		return fmt.Errorf("Target portal migration is not supported by %v backend", dev.Backend)
+	}
+	host, portString, err := net.SplitHostPort(newPortal)
+	if err != nil {
+		return fmt.Errorf("Invalid portal %v: %v", newPortal, err)
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return fmt.Errorf("Invalid portal %v: %v", newPortal, err)
+	}
+
+	config := dev.getConfig()
+	lock, err := config.acquireLock(0)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	ne, err := config.newHostExecutor()
+	if err != nil {
+		return err
+	}
+	sessions, err := iscsi.ListSessions(ne)
+	if err != nil {
+		return err
+	}
+	oldIPs := map[string]struct{}{}
+	for _, session := range sessions {
+		if session.Target == dev.Target && session.Portal.IP != host {
+			oldIPs[session.Portal.IP] = struct{}{}
+		}
+	}
+
+	for ip := range oldIPs {
+		if err := checkTargetDevicesInUse(ip, dev.Target, ne); err != nil {
+			return err
+		}
+	}
+
+	if len(oldIPs) != 0 {
+		if err := iscsi.CreateNodeRecord(newPortal, dev.Target, config.InitiatorIface, ne); err != nil {
+			return fmt.Errorf("Failed to create node record of %v for target %v: %v", newPortal, dev.Target, err)
+		}
+		if err := iscsi.LoginTargetWithIface(host, dev.Target, config.InitiatorIface, ne); err != nil {
+			return fmt.Errorf("Failed to login target %v on %v: %v", dev.Target, newPortal, err)
+		}
+		if err := dev.attachMigratedDevices(host, ne, config); err != nil {
+			return err
+		}
+		logrus.Infof("go-iscsi-helper: target %v is attached through %v as %v", dev.Target, newPortal, dev.KernelDevice.Name)
+	}
+
+	if tgtd, tid, err := dev.getExportedTid(); err == nil {
+		if err := tgtd.SetTargetRedirect(tid, host, port, iscsi.RedirectReasonPermanent); err != nil {
+			return fmt.Errorf("Failed to redirect target %v to %v: %v", dev.Target, newPortal, err)
+		}
+		if err := dev.CloseConnections(); err != nil {
+			return err
+		}
+		logrus.Infof("go-iscsi-helper: target %v is redirected to %v", dev.Target, newPortal)
+	}
+
+	for ip := range oldIPs {
+		deleteDevices(ip, dev.Target, ne, config, &LogoutReport{OutstandingIO: map[string]int{}}, nil)
+		if err := iscsi.LogoutTarget(ip, dev.Target, ne); err != nil {
+			return fmt.Errorf("Failed to logout target %v on %v: %v", dev.Target, ip, err)
+		}
+		if err := iscsi.DeleteDiscoveredTarget(ip, dev.Target, ne); err != nil {
+			logrus.Warnf("Failed to delete node record of target %v on %v: %v", dev.Target, ip, err)
+		}
+	}
+	return nil
+}
+
+// attachMigratedDevices sets up the devices of the new session on ip. If it
+// fails, the new session is logged out and the devices of the old sessions
+// are kept.
+func (dev *Device) attachMigratedDevices(ip string, ne *util.NamespaceExecutor, config *Config) (err error) {
+	kernelDevice := dev.KernelDevice
+	byIDPath := dev.ByIDPath
+	diskDevices := map[int]*util.KernelDevice{}
+	for _, disk := range dev.Disks {
+		diskDevices[disk.LunID] = disk.KernelDevice
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		dev.rollbackLogin(ip, ne, nil)
+		dev.KernelDevice = kernelDevice
+		dev.ByIDPath = byIDPath
+		for _, disk := range dev.Disks {
+			disk.KernelDevice = diskDevices[disk.LunID]
+		}
+	}()
+
+	if dev.KernelDevice, err = iscsi.GetDevice(ip, dev.Target, config.TargetLunID, ne); err != nil {
+		return err
+	}
+	if err := dev.getDiskDevices(ip, ne); err != nil {
+		return err
+	}
+	return dev.setupDevices(ne, config, nil)
+}
@@ -0,0 +1,132 @@
+package iscsidev
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/types"
+)
+
+// getPortalPort returns the port the target of the device is exported on,
+// which is the port of the SPDK portal or the tgtd instance of the device
+func (dev *Device) getPortalPort() (int, error) {
+	if dev.Backend == types.TargetBackendSPDK {
+		port, err := strconv.Atoi(dev.getConfig().SPDKPortal.Port)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid SPDK portal port %v: %v", dev.getConfig().SPDKPortal.Port, err)
+		}
+		return port, nil
+	}
+	if dev.TgtdInstance == "" {
+		return iscsi.DefaultPortalPort, nil
+	}
+	instance, err := dev.getConfig().getTgtdInstance(dev.TgtdInstance)
+	if err != nil {
+		return 0, err
+	}
+	if instance.PortalPort == 0 {
+		return iscsi.DefaultPortalPort, nil
+	}
+	return instance.PortalPort, nil
+}
+
+// AddPortal makes the live target of the device reachable on ip as well,
+// e.g. the node gains an address on a new storage VLAN, without recreating
+// the target. tgtd has no per-target portals, so the portal is added to the
+// tgtd instance of the device and applies to every target of the instance.
+// If rediscover is true, the initiator of this node discovers the target
+// through the new portal, so it learns the new path.
+func (dev *Device) AddPortal(ip string, rediscover bool) error {
+	if dev.Backend == types.TargetBackendSPDK {
+		return fmt.Errorf("Runtime portal update is not supported by %v backend", dev.Backend)
+	}
+	tgtd, _, err := dev.getExportedTid()
+	if err != nil {
+		return err
+	}
+	port, err := dev.getPortalPort()
+	if err != nil {
+		return err
+	}
+	portal := net.JoinHostPort(ip, strconv.Itoa(port))
+	if err := tgtd.AddPortal(ip, port); err != nil {
+		return fmt.Errorf("Failed to add portal %v: %v", portal, err)
+	}
+	logrus.Infof("go-iscsi-helper: target %v is exported on portal %v", dev.Target, portal)
+	if !rediscover {
+		return nil
+	}
+
+	config := dev.getConfig()
+	lock, err := config.acquireLock(0)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	ne, err := config.newHostExecutor()
+	if err != nil {
+		return err
+	}
+	if err := iscsi.DiscoverTargetWithIface(portal, dev.Target, config.InitiatorIface, ne); err != nil {
+		return fmt.Errorf("Failed to discover target %v on %v: %v", dev.Target, portal, err)
+	}
+	return nil
+}
+
+// RemovePortal stops the tgtd instance of the device from listening on ip,
+// which applies to every target of the instance like AddPortal. The existing
+// connections through it are not affected. If rediscover is true, the node record of the
+// target on ip is deleted from the initiator of this node, unless a session
+// is still using it, so the initiator stops trying the removed path.
+func (dev *Device) RemovePortal(ip string, rediscover bool) error {
+	if dev.Backend == types.TargetBackendSPDK {
+		return fmt.Errorf("Runtime portal update is not supported by %v backend", dev.Backend)
+	}
+	tgtd, _, err := dev.getExportedTid()
+	if err != nil {
+		return err
+	}
+	port, err := dev.getPortalPort()
+	if err != nil {
+		return err
+	}
+	portal := net.JoinHostPort(ip, strconv.Itoa(port))
+	if err := tgtd.DeletePortal(ip, port); err != nil {
+		return fmt.Errorf("Failed to delete portal %v: %v", portal, err)
+	}
+	logrus.Infof("go-iscsi-helper: target %v is no longer exported on portal %v", dev.Target, portal)
+	if !rediscover {
+		return nil
+	}
+
+	config := dev.getConfig()
+	lock, err := config.acquireLock(0)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	ne, err := config.newHostExecutor()
+	if err != nil {
+		return err
+	}
+	sessions, err := iscsi.ListSessions(ne)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if session.Target == dev.Target && session.Portal.IP == ip {
+			logrus.Warnf("go-iscsi-helper: keep the node record of target %v on %v used by session %v", dev.Target, ip, session.SID)
+			return nil
+		}
+	}
+	if !iscsi.IsTargetDiscovered(ip, dev.Target, ne) {
+		return nil
+	}
+	return iscsi.DeleteDiscoveredTarget(ip, dev.Target, ne)
+}
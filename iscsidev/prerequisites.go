@@ -0,0 +1,103 @@
+package iscsidev
+
+import (
+	"path/filepath"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/util"
+)
+
+// PrerequisiteCheck is the result of a single check of CheckPrerequisites
+type PrerequisiteCheck struct {
+	Name   string
+	Passed bool
+	Error  string
+	// Guidance tells how to fix the failed check
+	Guidance string
+}
+
+// PrerequisitesReport is the result of CheckPrerequisites
+type PrerequisitesReport struct {
+	Passed bool
+	Checks []*PrerequisiteCheck
+}
+
+func (r *PrerequisitesReport) add(name string, err error, guidance string) {
+	check := &PrerequisiteCheck{
+		Name:   name,
+		Passed: err == nil,
+	}
+	if err != nil {
+		check.Error = err.Error()
+		check.Guidance = guidance
+		r.Passed = false
+	}
+	r.Checks = append(r.Checks, check)
+}
+
+// CheckPrerequisites verifies everything needed by the devices is in place
+// before any operation, so the installers can fail early with clear guidance.
+// Unlike GetNodeHealth, it checks what can be set up on demand, e.g. whether
+// the kernel modules can be loaded rather than whether they're loaded.
+func CheckPrerequisites(config *Config) *PrerequisitesReport {
+	r := &PrerequisitesReport{
+		Passed: true,
+		Checks: []*PrerequisiteCheck{},
+	}
+
+	local, _ := util.NewNamespaceExecutor("")
+	_, err := local.Execute("tgtadm", []string{"--version"})
+	r.add("tgtadm", err, "Install tgt (scsi-target-utils) in the container running the targets")
+
+	_, err = util.GetIPToHost()
+	r.add("host-ip", err, "Make sure the container has a network interface reachable from the host")
+
+	ne, err := config.newHostExecutor()
+	r.add("host-namespace", err, "Mount the host /proc to "+config.HostProc+" and run the container privileged")
+	if err != nil {
+		return r
+	}
+
+	err = iscsi.CheckForInitiatorExistence(ne)
+	r.add("iscsiadm", err, "Install open-iscsi (iscsi-initiator-utils) on the host")
+
+	err = checkIscsidManageable(ne)
+	r.add("iscsid", err, "Install open-iscsi on the host and enable the iscsid service")
+
+	if config.InitiatorTransport != "" && config.InitiatorTransport != iscsi.TransportTCP {
+		err = config.checkInitiatorTransport(ne)
+		r.add("offload-transport", err, "Load the "+config.InitiatorTransport+" driver, setup the iface with iscsi.SetupOffloadIface, and start iscsiuio for bnx2i and qedi")
+	}
+
+	for _, module := range RequiredKernelModules {
+		err := checkKernelModuleLoadable(module, ne)
+		r.add("kernel-module-"+module, err, "Install the kernel modules package of the running kernel on the host")
+	}
+
+	_, err = ne.Execute("test", []string{"-w", filepath.Dir(config.LockFile)})
+	r.add("lock-directory", err, "Make "+filepath.Dir(config.LockFile)+" writable on the host")
+
+	return r
+}
+
+// checkIscsidManageable succeeds if iscsid is running, or it can be started by
+// systemd on demand
+func checkIscsidManageable(ne *util.NamespaceExecutor) error {
+	if _, err := ne.Execute("pgrep", []string{"-x", "iscsid"}); err == nil {
+		return nil
+	}
+	if _, err := ne.Execute("systemctl", []string{"cat", "iscsid.socket"}); err == nil {
+		return nil
+	}
+	_, err := ne.Execute("systemctl", []string{"cat", "iscsid.service"})
+	return err
+}
+
+func checkKernelModuleLoadable(module string, ne *util.NamespaceExecutor) error {
+	if _, err := ne.Execute("ls", []string{"/sys/module/" + module}); err == nil {
+		return nil
+	}
+	// Dry run, the module is not loaded
+	_, err := ne.Execute("modprobe", []string{"-n", "-q", module})
+	return err
+}
@@ -0,0 +1,173 @@
+package iscsidev
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/spdk"
+)
+
+// PurgeReport lists the resources removed by PurgeAll
+type PurgeReport struct {
+	// Sessions are the targets logged out
+	Sessions []string
+	// NodeRecords are the node record directories removed
+	NodeRecords []string
+	// Targets are the targets deleted from tgtd or the SPDK iSCSI target
+	Targets []string
+	// Errors are the failures PurgeAll continued after
+	Errors []string
+}
+
+// PurgeAll tears down every session, SCSI device, node record and target of
+// tgtd or the SPDK iSCSI target whose IQN starts with prefix on the node, for
+// the node decommission and the recovery from a corrupted state. The same as
+// StopInitiator, the sessions with the devices in use are left alone, and so
+// are their node records and targets. It continues after the failures and
+// returns an error if any resource failed to be removed or was in use.
+func PurgeAll(prefix string, config *Config) (*PurgeReport, error) {
+	if !strings.HasPrefix(prefix, "iqn.") {
+		return nil, fmt.Errorf("Invalid IQN prefix %v", prefix)
+	}
+	report := &PurgeReport{
+		Sessions:    []string{},
+		NodeRecords: []string{},
+		Targets:     []string{},
+		Errors:      []string{},
+	}
+	addError := func(format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		logrus.Warnf("go-iscsi-helper: purge: %v", msg)
+		report.Errors = append(report.Errors, msg)
+	}
+
+	lock := config.newLock()
+	if err := lock.Lock(); err != nil {
+		return nil, fmt.Errorf("Fail to lock: %v", err)
+	}
+	defer lock.Unlock()
+
+	ne, err := config.newHostExecutor()
+	if err != nil {
+		return nil, err
+	}
+
+	// The targets in use on the node are kept entirely
+	inUse := map[string]struct{}{}
+	if err := iscsi.CheckForInitiatorExistence(ne); err != nil {
+		addError("Skipped the initiator: %v", err)
+	} else {
+		sessions, err := iscsi.ListSessions(ne)
+		if err != nil {
+			addError("Failed to list sessions: %v", err)
+		}
+		for _, session := range sessions {
+			if !strings.HasPrefix(session.Target, prefix) {
+				continue
+			}
+			if err := checkTargetDevicesInUse(session.Portal.IP, session.Target, ne); err != nil {
+				inUse[session.Target] = struct{}{}
+				addError("Skipped %v of %v: %v", session.Target, session.Portal.IP, err)
+				continue
+			}
+			deleteDevices(session.Portal.IP, session.Target, ne, config, &LogoutReport{OutstandingIO: map[string]int{}}, nil)
+			if err := iscsi.LogoutTarget(session.Portal.IP, session.Target, ne); err != nil && !strings.Contains(err.Error(), "exit status 21") {
+				addError("Failed to logout %v of %v: %v", session.Target, session.Portal.IP, err)
+				continue
+			}
+			report.Sessions = append(report.Sessions, session.Target)
+		}
+
+		// The node records of the sessions left are kept by the garbage
+		// collection
+		removed, err := iscsi.GarbageCollectScsiNodes(prefix, ne)
+		report.NodeRecords = append(report.NodeRecords, removed...)
+		if err != nil {
+			addError("Failed to remove node records: %v", err)
+		}
+	}
+
+	for _, tgtd := range config.getAllTgtds() {
+		targets, err := tgtd.GetTargets()
+		if err != nil {
+			// tgtd may not be running on the node
+			addError("Skipped the targets of tgtd on control port %v: %v", tgtd.ControlPort, err)
+			continue
+		}
+		for tid, target := range targets {
+			if !strings.HasPrefix(target, prefix) {
+				continue
+			}
+			if _, exists := inUse[target]; exists {
+				continue
+			}
+			if err := purgeTarget(tgtd, tid); err != nil {
+				addError("Failed to delete target %v: %v", target, err)
+				continue
+			}
+			report.Targets = append(report.Targets, target)
+		}
+	}
+
+	purgeSPDKTargets(prefix, inUse, config, report, addError)
+
+	logrus.Infof("go-iscsi-helper: purged %v sessions, %v node records and %v targets with prefix %v",
+		len(report.Sessions), len(report.NodeRecords), len(report.Targets), prefix)
+	if len(report.Errors) != 0 {
+		return report, fmt.Errorf("Failed to purge all resources with prefix %v: %v", prefix, strings.Join(report.Errors, "; "))
+	}
+	return report, nil
+}
+
+// purgeSPDKTargets deletes the SPDK targets with prefix and their bdevs. The
+// SPDK iSCSI target is optional, it's skipped if its socket doesn't exist.
+func purgeSPDKTargets(prefix string, inUse map[string]struct{}, config *Config, report *PurgeReport, addError func(string, ...interface{})) {
+	if _, err := os.Stat(config.SPDKSocketPath); err != nil {
+		return
+	}
+	client := spdk.NewClient(config.SPDKSocketPath)
+	nodes, err := client.GetTargetNodes()
+	if err != nil {
+		addError("Skipped the SPDK targets: %v", err)
+		return
+	}
+	for _, node := range nodes {
+		if !strings.HasPrefix(node.Name, prefix) {
+			continue
+		}
+		if _, exists := inUse[node.Name]; exists {
+			continue
+		}
+		if err := deleteSPDKTargetNode(client, &node); err != nil {
+			addError("Failed to delete SPDK target %v: %v", node.Name, err)
+			continue
+		}
+		report.Targets = append(report.Targets, node.Name)
+	}
+}
+
+func purgeTarget(tgtd *iscsi.Tgtd, tid int) error {
+	if err := closeTargetConnections(tgtd, tid); err != nil {
+		return err
+	}
+	return tgtd.DeleteTarget(tid)
+}
+
+func closeTargetConnections(tgtd *iscsi.Tgtd, tid int) error {
+	sessionConnectionsMap, err := tgtd.GetTargetConnections(tid)
+	if err != nil {
+		return err
+	}
+	for sid, cidList := range sessionConnectionsMap {
+		for _, cid := range cidList {
+			if err := tgtd.CloseConnection(tid, sid, cid); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
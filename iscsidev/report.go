@@ -0,0 +1,121 @@
+package iscsidev
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/go-iscsi-helper/util"
+)
+
+// OperationPhase is a timed step of an operation
+type OperationPhase struct {
+	Name     string
+	Duration time.Duration
+}
+
+// OperationReport describes a completed operation of the device, so the
+// callers can log and alert on the slow or flaky attachments. The methods are
+// no-op on a nil report.
+type OperationReport struct {
+	Operation string
+	StartedAt time.Time
+	Duration  time.Duration
+	Phases    []*OperationPhase
+	// Retries is the number of the retried steps
+	Retries int
+	// Commands are the command lines executed in the host namespace
+	Commands []string
+	Warnings []string
+	Error    string
+
+	lock sync.Mutex
+}
+
+func newOperationReport(operation string) *OperationReport {
+	return &OperationReport{
+		Operation: operation,
+		StartedAt: time.Now(),
+		Phases:    []*OperationPhase{},
+		Commands:  []string{},
+		Warnings:  []string{},
+	}
+}
+
+// startPhase returns the function to end the phase
+func (r *OperationReport) startPhase(name string) func() {
+	start := time.Now()
+	return func() {
+		if r == nil {
+			return
+		}
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.Phases = append(r.Phases, &OperationPhase{
+			Name:     name,
+			Duration: time.Since(start),
+		})
+	}
+}
+
+func (r *OperationReport) retry() {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Retries++
+}
+
+// warnf logs the warning and records it in the report
+func (r *OperationReport) warnf(format string, args ...interface{}) {
+	logrus.Warnf(format, args...)
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+func (r *OperationReport) recordCommand(cmd string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Commands = append(r.Commands, cmd)
+}
+
+// watch records the commands executed by ne
+func (r *OperationReport) watch(ne *util.NamespaceExecutor) {
+	if r == nil {
+		return
+	}
+	ne.SetCommandRecorder(r.recordCommand)
+}
+
+func (r *OperationReport) finish(err error) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Duration = time.Since(r.StartedAt)
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+// GetLastOperationReport returns the report of the last StartInitator,
+// StopInitiator or UpdateSessionParams of the device, nil if none completed
+func (dev *Device) GetLastOperationReport() *OperationReport {
+	dev.reportLock.Lock()
+	defer dev.reportLock.Unlock()
+	return dev.lastReport
+}
+
+func (dev *Device) setLastOperationReport(r *OperationReport) {
+	dev.reportLock.Lock()
+	defer dev.reportLock.Unlock()
+	dev.lastReport = r
+}
@@ -0,0 +1,153 @@
+package iscsidev
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/util"
+)
+
+// DeviceSchemaVersion is the version of the serialized Device. Bump it and
+// add the migration in UnmarshalJSON when the format changes.
+const DeviceSchemaVersion = 1
+
+// deviceV0 is the format encoded by encoding/json before the schema version
+// was introduced
+type deviceV0 struct {
+	Target       string
+	KernelDevice *util.KernelDevice
+	BackingFile  string
+	BSType       string
+	BSOpts       string
+}
+
+type deviceV1 struct {
+	SchemaVersion     int                      `json:"schemaVersion"`
+	Target            string                   `json:"target"`
+	KernelDevice      *util.KernelDevice       `json:"kernelDevice,omitempty"`
+	ByIDPath          string                   `json:"byIDPath,omitempty"`
+	BackingFile       string                   `json:"backingFile"`
+	BSType            string                   `json:"bsType"`
+	BSOpts            string                   `json:"bsOpts"`
+	Backend           string                   `json:"backend,omitempty"`
+	Shared            bool                     `json:"shared,omitempty"`
+	MultiWriter       bool                     `json:"multiWriter,omitempty"`
+	MaxSessions       int                      `json:"maxSessions,omitempty"`
+	NegotiationParams *iscsi.NegotiationParams `json:"negotiationParams,omitempty"`
+	Disks             []*Disk                  `json:"disks,omitempty"`
+	TargetID          int                      `json:"targetID,omitempty"`
+	AllowedInitiators []string                 `json:"allowedInitiators,omitempty"`
+	TgtdInstance      string                   `json:"tgtdInstance,omitempty"`
+	IOLimits          *util.IOLimits           `json:"ioLimits,omitempty"`
+	State             string                   `json:"state,omitempty"`
+}
+
+// MarshalJSON encodes the device with the schema version, so the consumers
+// persisting the device can decode it after upgrading the library. The config
+// is not persisted.
+func (dev *Device) MarshalJSON() ([]byte, error) {
+	allowedInitiators := dev.GetAllowedInitiators()
+	sort.Strings(allowedInitiators)
+	return json.Marshal(&deviceV1{
+		SchemaVersion:     DeviceSchemaVersion,
+		Target:            dev.Target,
+		KernelDevice:      dev.KernelDevice,
+		ByIDPath:          dev.ByIDPath,
+		BackingFile:       dev.BackingFile,
+		BSType:            dev.BSType,
+		BSOpts:            dev.BSOpts,
+		Backend:           dev.Backend,
+		Shared:            dev.Shared,
+		MultiWriter:       dev.MultiWriter,
+		MaxSessions:       dev.MaxSessions,
+		NegotiationParams: dev.NegotiationParams,
+		Disks:             dev.Disks,
+		TargetID:          dev.targetID,
+		AllowedInitiators: allowedInitiators,
+		TgtdInstance:      dev.TgtdInstance,
+		IOLimits:          dev.IOLimits,
+		State:             dev.GetState(),
+	})
+}
+
+// UnmarshalJSON decodes the device encoded by any previous version of the
+// library. The decoded device uses DefaultConfig.
+func (dev *Device) UnmarshalJSON(data []byte) error {
+	probe := &struct {
+		SchemaVersion *int `json:"schemaVersion"`
+	}{}
+	if err := json.Unmarshal(data, probe); err != nil {
+		return err
+	}
+
+	version := 0
+	if probe.SchemaVersion != nil {
+		version = *probe.SchemaVersion
+	}
+	v1 := &deviceV1{}
+	switch version {
+	case 0:
+		v0 := &deviceV0{}
+		if err := json.Unmarshal(data, v0); err != nil {
+			return err
+		}
+		v1 = migrateDeviceV0(v0)
+	case 1:
+		if err := json.Unmarshal(data, v1); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported device schema version %v, the latest supported version is %v", version, DeviceSchemaVersion)
+	}
+
+	*dev = Device{
+		Target:            v1.Target,
+		KernelDevice:      v1.KernelDevice,
+		ByIDPath:          v1.ByIDPath,
+		BackingFile:       v1.BackingFile,
+		BSType:            v1.BSType,
+		BSOpts:            v1.BSOpts,
+		Backend:           v1.Backend,
+		Shared:            v1.Shared,
+		MultiWriter:       v1.MultiWriter,
+		MaxSessions:       v1.MaxSessions,
+		NegotiationParams: v1.NegotiationParams,
+		Disks:             v1.Disks,
+		TgtdInstance:      v1.TgtdInstance,
+		IOLimits:          v1.IOLimits,
+		targetID:          v1.TargetID,
+		state:             v1.State,
+		config:            DefaultConfig(),
+	}
+	// The devices encoded before the state machine was introduced
+	if dev.state == "" {
+		switch {
+		case dev.KernelDevice != nil:
+			dev.state = DeviceStateAttached
+		case dev.targetID != 0:
+			dev.state = DeviceStateExported
+		default:
+			dev.state = DeviceStateCreated
+		}
+	}
+	if len(v1.AllowedInitiators) != 0 {
+		dev.allowedInitiators = map[string]struct{}{}
+		for _, initiator := range v1.AllowedInitiators {
+			dev.allowedInitiators[initiator] = struct{}{}
+		}
+	}
+	return nil
+}
+
+func migrateDeviceV0(v0 *deviceV0) *deviceV1 {
+	return &deviceV1{
+		SchemaVersion: 1,
+		Target:        v0.Target,
+		KernelDevice:  v0.KernelDevice,
+		BackingFile:   v0.BackingFile,
+		BSType:        v0.BSType,
+		BSOpts:        v0.BSOpts,
+	}
+}
@@ -0,0 +1,197 @@
+package iscsidev
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/util"
+)
+
+var (
+	// liveSessionParams are the node parameters which can be applied to the
+	// live session via the attributes of iscsi_session in sysfs
+	liveSessionParams = map[string]string{
+		"node.session.timeo.replacement_timeout": "recovery_tmo",
+	}
+	// liveDeviceParams are the node parameters which can be applied to the
+	// live devices via the attributes of the SCSI devices in sysfs
+	liveDeviceParams = map[string]string{
+		"node.session.queue_depth": "queue_depth",
+	}
+)
+
+// UpdateSessionParams updates the node parameters of the attachment. The
+// parameters supported by sysfs are applied to the live session directly,
+// otherwise the target is re-logged in to renegotiate them, which recreates
+// the devices and may change their names. The re-login is refused with
+// util.DeviceInUseError if any device of the target is in use. It returns
+// whether re-login happened, in which case the consumers must refresh
+// KernelDevice and Disks.
+// It records its OperationReport, see GetLastOperationReport.
+func (dev *Device) UpdateSessionParams(params map[string]string) (bool, error) {
+	relogin := false
+	err := dev.runOperation(updateSessionTransition, func() error {
+		report := newOperationReport("update-session-params")
+		var err error
+		relogin, err = dev.updateSessionParams(params, report)
+		report.finish(err)
+		dev.setLastOperationReport(report)
+		return err
+	})
+	return relogin, err
+}
+
+func (dev *Device) updateSessionParams(params map[string]string, report *OperationReport) (bool, error) {
+	config := dev.getConfig()
+
+	endPhase := report.startPhase("lock")
+	lock, err := config.acquireLock(0)
+	if err != nil {
+		return false, err
+	}
+	defer lock.Unlock()
+	endPhase()
+
+	ne, err := config.newHostExecutor()
+	if err != nil {
+		return false, err
+	}
+	report.watch(ne)
+	ip, err := util.GetIPToHost()
+	if err != nil {
+		return false, err
+	}
+	if !iscsi.IsTargetLoggedIn(ip, dev.Target, ne) {
+		return false, fmt.Errorf("target %v is not logged in", dev.Target)
+	}
+
+	relogin := false
+	for name := range params {
+		if _, ok := liveSessionParams[name]; ok {
+			continue
+		}
+		if _, ok := liveDeviceParams[name]; ok {
+			continue
+		}
+		relogin = true
+	}
+	// The re-login replaces the devices under the users
+	if relogin {
+		if err := checkDevicesInUse(dev.Target, config); err != nil {
+			return false, err
+		}
+	}
+
+	// The previous parameters are restored if the re-login fails
+	records, err := iscsi.GetNodeParams(ip, dev.Target, ne)
+	if err != nil {
+		return false, err
+	}
+	previous := map[string]string{}
+	for name := range params {
+		if value, exists := records[name]; exists && value != params[name] {
+			previous[name] = value
+		}
+	}
+
+	for name, value := range params {
+		// Persist the parameters for the future logins
+		if err := iscsi.UpdateNodeParam(ip, dev.Target, name, value, ne); err != nil {
+			return false, err
+		}
+	}
+
+	if relogin {
+		defer report.startPhase("relogin")()
+		return true, dev.relogin(ip, previous, ne, config, report)
+	}
+	defer report.startPhase("apply")()
+	for name, value := range params {
+		if err := dev.applyLiveParam(ip, name, value, ne, config); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+func (dev *Device) applyLiveParam(ip, name, value string, ne *util.NamespaceExecutor, config *Config) error {
+	if attr, ok := liveSessionParams[name]; ok {
+		sessions, err := iscsi.ListSessions(ne)
+		if err != nil {
+			return err
+		}
+		for _, session := range sessions {
+			if session.Target != dev.Target || session.Portal.IP != ip {
+				continue
+			}
+			path := filepath.Join("/sys/class/iscsi_session", "session"+session.SID, attr)
+			if _, err := ne.ExecuteWithStdin("tee", []string{path}, value); err != nil {
+				return fmt.Errorf("Failed to write %v to %v: %v", value, path, err)
+			}
+		}
+		return nil
+	}
+
+	attr := liveDeviceParams[name]
+	devices, err := iscsi.GetDevices(ip, dev.Target, ne)
+	if err != nil {
+		return err
+	}
+	for _, kernelDevice := range devices {
+		path := filepath.Join("/sys/block", kernelDevice.Name, "device", attr)
+		if _, err := ne.ExecuteWithStdin("tee", []string{path}, value); err != nil {
+			return fmt.Errorf("Failed to write %v to %v: %v", value, path, err)
+		}
+	}
+	return nil
+}
+
+// relogin logs out and logs in the target right away without deleting the
+// node record, so the session is renegotiated with the updated parameters. If
+// the login fails, the target is logged in again with the previous parameters.
+func (dev *Device) relogin(ip string, previous map[string]string, ne *util.NamespaceExecutor, config *Config, report *OperationReport) error {
+	logrus.Infof("go-iscsi-helper: re-login target %v to renegotiate the parameters", dev.Target)
+	if err := iscsi.LogoutTarget(ip, dev.Target, ne); err != nil {
+		return err
+	}
+	if err := iscsi.LoginTargetWithIface(ip, dev.Target, config.InitiatorIface, ne); err != nil {
+		dev.restoreSession(ip, previous, ne, config, report)
+		return err
+	}
+	return dev.reloadDevices(ip, ne, config, report)
+}
+
+// restoreSession logs in the target with the previous parameters after the
+// re-login with the updated ones failed, so the device isn't left detached
+func (dev *Device) restoreSession(ip string, previous map[string]string, ne *util.NamespaceExecutor, config *Config, report *OperationReport) {
+	for name, value := range previous {
+		if err := iscsi.UpdateNodeParam(ip, dev.Target, name, value, ne); err != nil {
+			report.warnf("Failed to restore parameter %v of target %v: %v", name, dev.Target, err)
+		}
+	}
+	if err := iscsi.LoginTargetWithIface(ip, dev.Target, config.InitiatorIface, ne); err != nil {
+		report.warnf("Failed to login target %v with the previous parameters: %v", dev.Target, err)
+		return
+	}
+	if err := dev.reloadDevices(ip, ne, config, report); err != nil {
+		report.warnf("Failed to reload devices of target %v with the previous parameters: %v", dev.Target, err)
+		return
+	}
+	logrus.Infof("go-iscsi-helper: logged in target %v with the previous parameters", dev.Target)
+}
+
+// reloadDevices finds and sets up the devices recreated by the login
+func (dev *Device) reloadDevices(ip string, ne *util.NamespaceExecutor, config *Config, report *OperationReport) error {
+	var err error
+
+	if dev.KernelDevice, err = iscsi.GetDevice(ip, dev.Target, config.TargetLunID, ne); err != nil {
+		return err
+	}
+	if err := dev.getDiskDevices(ip, ne); err != nil {
+		return err
+	}
+	return dev.setupDevices(ne, config, report)
+}
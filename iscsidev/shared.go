@@ -0,0 +1,210 @@
+package iscsidev
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/types"
+)
+
+// AllowInitiator allows the initiator with the specified IQN, usually from
+// another node, to attach the shared target. It can be called before or after
+// the target is created.
+func (dev *Device) AllowInitiator(initiator string) error {
+	return dev.runOperation(updateDeviceTransition, func() error {
+		return dev.allowInitiator(initiator)
+	})
+}
+
+func (dev *Device) allowInitiator(initiator string) error {
+	if !dev.Shared {
+		return fmt.Errorf("cannot allow initiator %v for target %v since it's not shared", initiator, dev.Target)
+	}
+	if dev.Backend == types.TargetBackendSPDK {
+		return dev.validateSPDKDevice()
+	}
+	if dev.isInitiatorAllowed(initiator) {
+		return nil
+	}
+
+	tgtd, err := dev.getTgtd()
+	if err != nil {
+		return err
+	}
+	tid, err := tgtd.GetTargetTid(dev.Target)
+	if err != nil {
+		return err
+	}
+	if tid != -1 {
+		if err := tgtd.BindInitiatorName(tid, initiator); err != nil {
+			return err
+		}
+		err := dev.checkMultipleInitiators(tgtd, tid, initiator)
+		// The wildcard address is bound along with the first allowed
+		// initiator, see getInitiatorACLs
+		if err == nil && len(dev.GetAllowedInitiators()) == 0 {
+			err = tgtd.BindInitiator(tid, "ALL")
+		}
+		if err != nil {
+			if unbindErr := tgtd.UnbindInitiatorName(tid, initiator); unbindErr != nil {
+				logrus.Warnf("Failed to unbind initiator %v from shared target %v: %v", initiator, dev.Target, unbindErr)
+			}
+			return err
+		}
+	}
+	dev.initiatorsLock.Lock()
+	if dev.allowedInitiators == nil {
+		dev.allowedInitiators = map[string]struct{}{}
+	}
+	dev.allowedInitiators[initiator] = struct{}{}
+	dev.initiatorsLock.Unlock()
+	logrus.Infof("go-iscsi-helper: initiator %v is allowed to attach shared target %v", initiator, dev.Target)
+	return nil
+}
+
+// DisallowInitiator revokes the permission of the initiator and closes its
+// existing connections to the target, which detaches the target from the node
+// of the initiator
+func (dev *Device) DisallowInitiator(initiator string) error {
+	return dev.runOperation(updateDeviceTransition, func() error {
+		return dev.disallowInitiator(initiator)
+	})
+}
+
+func (dev *Device) disallowInitiator(initiator string) error {
+	if !dev.Shared {
+		return fmt.Errorf("cannot disallow initiator %v for target %v since it's not shared", initiator, dev.Target)
+	}
+	if !dev.isInitiatorAllowed(initiator) {
+		return nil
+	}
+
+	tgtd, err := dev.getTgtd()
+	if err != nil {
+		return err
+	}
+	tid, err := tgtd.GetTargetTid(dev.Target)
+	if err != nil {
+		return err
+	}
+	if tid != -1 {
+		if err := dev.unbindAllowedInitiator(tgtd, tid, initiator); err != nil {
+			return err
+		}
+		sessions, err := tgtd.GetTargetSessions(tid)
+		if err != nil {
+			return err
+		}
+		for _, session := range sessions {
+			if session.Initiator != initiator {
+				continue
+			}
+			for _, cid := range session.CIDs {
+				if err := tgtd.CloseConnection(tid, session.SID, cid); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	dev.initiatorsLock.Lock()
+	delete(dev.allowedInitiators, initiator)
+	dev.initiatorsLock.Unlock()
+	logrus.Infof("go-iscsi-helper: initiator %v is disallowed to attach shared target %v", initiator, dev.Target)
+	return nil
+}
+
+// GetAllowedInitiators returns the initiators allowed to attach the shared
+// target
+func (dev *Device) GetAllowedInitiators() []string {
+	dev.initiatorsLock.Lock()
+	defer dev.initiatorsLock.Unlock()
+	res := []string{}
+	for initiator := range dev.allowedInitiators {
+		res = append(res, initiator)
+	}
+	return res
+}
+
+// getInitiatorACLs returns the address and the name ACLs the target is bound
+// to. tgtd requires an initiator to match both, and the name ACL accepts any
+// initiator if it's empty. So the shared target restricts the initiators by
+// the names, and the wildcard address is only bound if some of them are
+// allowed, otherwise the target would be open to all the initiators.
+func (dev *Device) getInitiatorACLs() ([]string, []string) {
+	if !dev.Shared {
+		return []string{"ALL"}, nil
+	}
+	names := dev.GetAllowedInitiators()
+	if len(names) == 0 {
+		return nil, nil
+	}
+	sort.Strings(names)
+	return []string{"ALL"}, names
+}
+
+// unbindAllowedInitiator unbinds the allowed initiator from the shared
+// target. The wildcard address is unbound first if it's the last allowed
+// one, see getInitiatorACLs.
+func (dev *Device) unbindAllowedInitiator(tgtd *iscsi.Tgtd, tid int, initiator string) error {
+	if allowed := dev.GetAllowedInitiators(); len(allowed) == 1 && allowed[0] == initiator {
+		if err := tgtd.UnbindInitiator(tid, "ALL"); err != nil {
+			return err
+		}
+	}
+	return tgtd.UnbindInitiatorName(tid, initiator)
+}
+
+func (dev *Device) isInitiatorAllowed(initiator string) bool {
+	dev.initiatorsLock.Lock()
+	defer dev.initiatorsLock.Unlock()
+	_, exists := dev.allowedInitiators[initiator]
+	return exists
+}
+
+// GetInitiatorSessions returns the sessions connected to the target grouped
+// by the initiators
+func (dev *Device) GetInitiatorSessions() (map[string][]*iscsi.TargetSession, error) {
+	res := map[string][]*iscsi.TargetSession{}
+	tgtd, err := dev.getTgtd()
+	if err != nil {
+		return nil, err
+	}
+	tid, err := tgtd.GetTargetTid(dev.Target)
+	if err != nil {
+		return nil, err
+	}
+	if tid == -1 {
+		return res, nil
+	}
+	sessions, err := tgtd.GetTargetSessions(tid)
+	if err != nil {
+		return nil, err
+	}
+	for _, session := range sessions {
+		res[session.Initiator] = append(res[session.Initiator], session)
+	}
+	return res, nil
+}
+
+// checkMultipleInitiators refuses the initiator if another one is connected,
+// since the data can be corrupted unless all the writers coordinate, e.g.
+// using a cluster filesystem. It's skipped if the device is MultiWriter.
+func (dev *Device) checkMultipleInitiators(tgtd *iscsi.Tgtd, tid int, initiator string) error {
+	if dev.MultiWriter {
+		return nil
+	}
+	sessions, err := tgtd.GetTargetSessions(tid)
+	if err != nil {
+		return fmt.Errorf("Failed to get sessions of shared target %v: %v", dev.Target, err)
+	}
+	for _, session := range sessions {
+		if session.Initiator != initiator {
+			return fmt.Errorf("cannot allow initiator %v for shared target %v since it's attached by initiator %v, "+
+				"set MultiWriter if the writers coordinate", initiator, dev.Target, session.Initiator)
+		}
+	}
+	return nil
+}
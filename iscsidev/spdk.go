@@ -0,0 +1,158 @@
+package iscsidev
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/spdk"
+	"github.com/longhorn/go-iscsi-helper/types"
+)
+
+const (
+	DefaultSPDKPortalPort = 3261
+)
+
+// createSPDKTarget exports the backing file through the SPDK iSCSI target
+// application, which is expected to be running already. BSType and BSOpts are
+// tgt specific and ignored here, the backing file is always exported as an
+// AIO bdev.
+func (dev *Device) createSPDKTarget() error {
+	if err := dev.validateSPDKDevice(); err != nil {
+		return err
+	}
+	config := dev.getConfig()
+	client := spdk.NewClient(config.SPDKSocketPath)
+
+	if err := ensureSPDKGroups(client, config); err != nil {
+		return err
+	}
+
+	if err := client.CreateAioBdev(dev.Target, dev.BackingFile, spdk.DefaultBlockSize); err != nil {
+		return err
+	}
+	luns := []spdk.Lun{
+		{
+			BdevName: dev.Target,
+			LunID:    config.TargetLunID,
+		},
+	}
+	maps := []spdk.PGIGMap{
+		{
+			PGTag: config.SPDKPortalGroupTag,
+			IGTag: config.SPDKInitiatorGroupTag,
+		},
+	}
+	if err := client.CreateTargetNode(dev.Target, dev.Target, luns, maps); err != nil {
+		if deleteErr := client.DeleteAioBdev(dev.Target); deleteErr != nil {
+			logrus.Warnf("Failed to cleanup SPDK bdev %v: %v", dev.Target, deleteErr)
+		}
+		return err
+	}
+	logrus.Infof("go-iscsi-helper: created SPDK target %v", dev.Target)
+	return nil
+}
+
+// validateSPDKDevice rejects the settings implemented by tgt only, instead of
+// exporting the target without them
+func (dev *Device) validateSPDKDevice() error {
+	unsupported := []string{}
+	if dev.Shared {
+		unsupported = append(unsupported, "Shared")
+	}
+	if dev.MaxSessions != 0 {
+		unsupported = append(unsupported, "MaxSessions")
+	}
+	if dev.NegotiationParams != nil {
+		unsupported = append(unsupported, "NegotiationParams")
+	}
+	if dev.TgtdInstance != "" {
+		unsupported = append(unsupported, "TgtdInstance")
+	}
+	if len(unsupported) != 0 {
+		return fmt.Errorf("%v of target %v are not supported by %v backend", strings.Join(unsupported, ", "), dev.Target, types.TargetBackendSPDK)
+	}
+	return nil
+}
+
+func (dev *Device) deleteSPDKTarget() error {
+	client := spdk.NewClient(dev.getConfig().SPDKSocketPath)
+
+	node, err := client.GetTargetNode(dev.Target)
+	if err != nil {
+		return err
+	}
+	if node != nil {
+		logrus.Infof("Shutdown SPDK target %v", dev.Target)
+		return deleteSPDKTargetNode(client, node)
+	}
+	return nil
+}
+
+// deleteSPDKTargetNode deletes the target node and the bdevs of its LUNs
+func deleteSPDKTargetNode(client *spdk.Client, node *spdk.TargetNode) error {
+	if err := client.DeleteTargetNode(node.Name); err != nil {
+		return err
+	}
+	for _, lun := range node.Luns {
+		if err := client.DeleteAioBdev(lun.BdevName); err != nil {
+			return fmt.Errorf("Failed to delete SPDK bdev %v of target %v: %v", lun.BdevName, node.Name, err)
+		}
+	}
+	return nil
+}
+
+// ensureSPDKGroups creates the portal group and initiator group shared by all
+// the SPDK targets if they don't exist
+func ensureSPDKGroups(client *spdk.Client, config *Config) error {
+	pgs, err := client.GetPortalGroups()
+	if err != nil {
+		return err
+	}
+	pgExists := false
+	for _, pg := range pgs {
+		if pg.Tag == config.SPDKPortalGroupTag {
+			pgExists = true
+			break
+		}
+	}
+	if !pgExists {
+		if err := config.checkSPDKPortal(); err != nil {
+			return err
+		}
+		if err := client.CreatePortalGroup(config.SPDKPortalGroupTag, []spdk.Portal{config.SPDKPortal}); err != nil {
+			return err
+		}
+	}
+
+	igs, err := client.GetInitiatorGroups()
+	if err != nil {
+		return err
+	}
+	for _, ig := range igs {
+		if ig.Tag == config.SPDKInitiatorGroupTag {
+			return nil
+		}
+	}
+	return client.CreateInitiatorGroup(config.SPDKInitiatorGroupTag, []string{spdk.InitiatorAny}, []string{spdk.InitiatorAny})
+}
+
+// checkSPDKPortal refuses the SPDK portal taking the port of a tgtd instance
+func (c *Config) checkSPDKPortal() error {
+	port, err := strconv.Atoi(c.SPDKPortal.Port)
+	if err != nil {
+		return fmt.Errorf("Invalid SPDK portal port %v: %v", c.SPDKPortal.Port, err)
+	}
+	if port == iscsi.DefaultPortalPort {
+		return fmt.Errorf("SPDK portal port %v conflicts with the default tgtd instance", port)
+	}
+	for name, instance := range c.TgtdInstances {
+		if instance.PortalPort == port {
+			return fmt.Errorf("SPDK portal port %v conflicts with tgtd instance %v", port, name)
+		}
+	}
+	return nil
+}
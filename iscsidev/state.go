@@ -0,0 +1,237 @@
+package iscsidev
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// DeviceStateCreated is the device without the target
+	DeviceStateCreated = "created"
+	// DeviceStateExported is the device with the target exported
+	DeviceStateExported = "exported"
+	// DeviceStateAttached is the device with the target logged in
+	DeviceStateAttached = "attached"
+	// DeviceStateStopping is the device being stopped or deleted
+	DeviceStateStopping = "stopping"
+)
+
+// ErrInvalidState is wrapped by StateError, so it can be checked by errors.Is
+var ErrInvalidState = errors.New("invalid device state")
+
+// StateError is returned by the operation of the device not allowed in the
+// current state, or racing with another operation of the same device
+type StateError struct {
+	Target    string
+	Operation string
+	State     string
+	// InProgress is the operation of the device in progress, if any
+	InProgress string
+}
+
+func (e *StateError) Error() string {
+	if e.InProgress != "" {
+		return fmt.Sprintf("cannot %v target %v in state %v: %v is in progress", e.Operation, e.Target, e.State, e.InProgress)
+	}
+	return fmt.Sprintf("cannot %v target %v in state %v", e.Operation, e.Target, e.State)
+}
+
+func (e *StateError) Unwrap() error {
+	return ErrInvalidState
+}
+
+// stateTransition is an operation of the device allowed in the states of
+// from. The device is in the transient state during the operation if it's set,
+// and moves to the state to once the operation succeeds, or back to the
+// original state if it fails. The device stays in the original state if to is
+// empty.
+type stateTransition struct {
+	operation string
+	from      []string
+	transient string
+	to        string
+	// preempt allows the operation to take over the stopping operation in
+	// progress, e.g. the forced logout of a hanging graceful one
+	preempt bool
+}
+
+var (
+	stableStates = []string{DeviceStateCreated, DeviceStateExported, DeviceStateAttached}
+
+	createTargetTransition = &stateTransition{
+		operation: "create-target",
+		from:      []string{DeviceStateCreated},
+		to:        DeviceStateExported,
+	}
+	startInitiatorTransition = &stateTransition{
+		operation: "start-initiator",
+		from:      []string{DeviceStateExported},
+		to:        DeviceStateAttached,
+	}
+	stopInitiatorTransition = &stateTransition{
+		operation: "stop-initiator",
+		from:      []string{DeviceStateAttached},
+		transient: DeviceStateStopping,
+		to:        DeviceStateExported,
+	}
+	forceStopInitiatorTransition = &stateTransition{
+		operation: "stop-initiator",
+		from:      []string{DeviceStateAttached, DeviceStateStopping},
+		transient: DeviceStateStopping,
+		to:        DeviceStateExported,
+		preempt:   true,
+	}
+	// The target can be deleted under the initiators, which is how the
+	// forced shutdown detaches a device failed to logout
+	deleteTargetTransition = &stateTransition{
+		operation: "delete-target",
+		from:      []string{DeviceStateExported, DeviceStateAttached, DeviceStateStopping},
+		transient: DeviceStateStopping,
+		to:        DeviceStateCreated,
+		preempt:   true,
+	}
+	updateTargetTransition = &stateTransition{
+		operation: "update-target",
+		from:      []string{DeviceStateExported, DeviceStateAttached},
+	}
+	// The device stays attached across the re-login of the session update
+	updateSessionTransition = &stateTransition{
+		operation: "update-session",
+		from:      []string{DeviceStateAttached},
+	}
+	updateDeviceTransition = &stateTransition{
+		operation: "update-device",
+		from:      stableStates,
+	}
+)
+
+// deviceOperation is an operation of the device in progress
+type deviceOperation struct {
+	dev        *Device
+	transition *stateTransition
+	original   string
+	seq        int
+}
+
+// GetState returns one of DeviceState*. The device constructed for an existing
+// attachment starts as created, see SyncState.
+func (dev *Device) GetState() string {
+	dev.stateLock.Lock()
+	defer dev.stateLock.Unlock()
+	return dev.getState()
+}
+
+func (dev *Device) getState() string {
+	if dev.state == "" {
+		return DeviceStateCreated
+	}
+	return dev.state
+}
+
+// SyncState sets the state of the device by whether the target is exported
+// and logged in on the node, for the device taking over the target and the
+// attachment created by another process, e.g. after upgrading the process.
+func (dev *Device) SyncState() (string, error) {
+	exported, _, err := dev.IsExported()
+	if err != nil {
+		return "", err
+	}
+	loggedIn, err := dev.IsLoggedIn()
+	if err != nil {
+		return "", err
+	}
+
+	dev.stateLock.Lock()
+	defer dev.stateLock.Unlock()
+	if dev.operation != nil {
+		return "", &StateError{
+			Target:     dev.Target,
+			Operation:  "sync-state",
+			State:      dev.getState(),
+			InProgress: dev.operation.transition.operation,
+		}
+	}
+	switch {
+	case loggedIn:
+		dev.state = DeviceStateAttached
+	case exported:
+		dev.state = DeviceStateExported
+	default:
+		dev.state = DeviceStateCreated
+	}
+	return dev.state, nil
+}
+
+// beginOperation starts the operation if it's allowed in the current state
+// and no other operation of the device is in progress, except the stopping
+// one taken over by the preempting operation
+func (dev *Device) beginOperation(t *stateTransition) (*deviceOperation, error) {
+	dev.stateLock.Lock()
+	defer dev.stateLock.Unlock()
+
+	state := dev.getState()
+	stateErr := &StateError{
+		Target:    dev.Target,
+		Operation: t.operation,
+		State:     state,
+	}
+	original := state
+	if dev.operation != nil {
+		if !t.preempt || state != DeviceStateStopping {
+			stateErr.InProgress = dev.operation.transition.operation
+			return nil, stateErr
+		}
+		original = dev.operation.original
+	}
+	allowed := false
+	for _, s := range t.from {
+		if s == state {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return nil, stateErr
+	}
+
+	dev.operationSeq++
+	op := &deviceOperation{
+		dev:        dev,
+		transition: t,
+		original:   original,
+		seq:        dev.operationSeq,
+	}
+	dev.operation = op
+	if t.transient != "" {
+		dev.state = t.transient
+	}
+	return op, nil
+}
+
+// end completes the operation with its result. The result of the operation
+// taken over by another one is discarded.
+func (op *deviceOperation) end(err error) {
+	dev := op.dev
+	dev.stateLock.Lock()
+	defer dev.stateLock.Unlock()
+
+	if dev.operation == nil || dev.operation.seq != op.seq {
+		return
+	}
+	dev.operation = nil
+	if err != nil || op.transition.to == "" {
+		dev.state = op.original
+		return
+	}
+	dev.state = op.transition.to
+}
+
+func (dev *Device) runOperation(t *stateTransition, fn func() error) error {
+	op, err := dev.beginOperation(t)
+	if err != nil {
+		return err
+	}
+	err = fn()
+	op.end(err)
+	return err
+}
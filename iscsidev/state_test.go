@@ -0,0 +1,166 @@
+package iscsidev
+
+import (
+	"errors"
+	"fmt"
+
+	. "gopkg.in/check.v1"
+)
+
+// StateSuite covers the state machine of the device, which needs neither
+// tgtd nor the host namespace
+type StateSuite struct {
+}
+
+var _ = Suite(&StateSuite{})
+
+var allStates = []string{DeviceStateCreated, DeviceStateExported, DeviceStateAttached, DeviceStateStopping}
+
+func newStateTestDevice(state string) *Device {
+	return &Device{
+		Target: "iqn.2019-10.io.longhorn:vol1",
+		state:  state,
+	}
+}
+
+func (s *StateSuite) TestTransitions(c *C) {
+	testCases := []struct {
+		transition *stateTransition
+		// allowed maps the states the transition is allowed in to the
+		// states the device moves to once it succeeds
+		allowed map[string]string
+	}{
+		{createTargetTransition, map[string]string{
+			DeviceStateCreated: DeviceStateExported,
+		}},
+		{startInitiatorTransition, map[string]string{
+			DeviceStateExported: DeviceStateAttached,
+		}},
+		{stopInitiatorTransition, map[string]string{
+			DeviceStateAttached: DeviceStateExported,
+		}},
+		{forceStopInitiatorTransition, map[string]string{
+			DeviceStateAttached: DeviceStateExported,
+			DeviceStateStopping: DeviceStateExported,
+		}},
+		{deleteTargetTransition, map[string]string{
+			DeviceStateExported: DeviceStateCreated,
+			DeviceStateAttached: DeviceStateCreated,
+			DeviceStateStopping: DeviceStateCreated,
+		}},
+		{updateTargetTransition, map[string]string{
+			DeviceStateExported: DeviceStateExported,
+			DeviceStateAttached: DeviceStateAttached,
+		}},
+		{updateSessionTransition, map[string]string{
+			DeviceStateAttached: DeviceStateAttached,
+		}},
+		{updateDeviceTransition, map[string]string{
+			DeviceStateCreated:  DeviceStateCreated,
+			DeviceStateExported: DeviceStateExported,
+			DeviceStateAttached: DeviceStateAttached,
+		}},
+	}
+
+	for _, tc := range testCases {
+		for _, state := range allStates {
+			comment := Commentf("%v in state %v", tc.transition.operation, state)
+			to, allowed := tc.allowed[state]
+
+			dev := newStateTestDevice(state)
+			err := dev.runOperation(tc.transition, func() error { return nil })
+			if !allowed {
+				c.Assert(errors.Is(err, ErrInvalidState), Equals, true, comment)
+				stateErr := &StateError{}
+				c.Assert(errors.As(err, &stateErr), Equals, true, comment)
+				c.Assert(*stateErr, Equals, StateError{
+					Target:    dev.Target,
+					Operation: tc.transition.operation,
+					State:     state,
+				}, comment)
+				c.Assert(dev.GetState(), Equals, state, comment)
+				continue
+			}
+			c.Assert(err, IsNil, comment)
+			c.Assert(dev.GetState(), Equals, to, comment)
+
+			// The failed operation leaves the device in the original state
+			dev = newStateTestDevice(state)
+			failure := fmt.Errorf("failure")
+			err = dev.runOperation(tc.transition, func() error {
+				if tc.transition.transient != "" {
+					c.Assert(dev.GetState(), Equals, tc.transition.transient, comment)
+				}
+				return failure
+			})
+			c.Assert(err, Equals, failure, comment)
+			c.Assert(dev.GetState(), Equals, state, comment)
+		}
+	}
+}
+
+func (s *StateSuite) TestOperationInProgress(c *C) {
+	dev := newStateTestDevice(DeviceStateExported)
+	op, err := dev.beginOperation(updateTargetTransition)
+	c.Assert(err, IsNil)
+
+	// Even the preempting operations wait for the non-stopping ones
+	for _, t := range []*stateTransition{updateDeviceTransition, forceStopInitiatorTransition, deleteTargetTransition} {
+		_, err = dev.beginOperation(t)
+		stateErr := &StateError{}
+		c.Assert(errors.As(err, &stateErr), Equals, true)
+		c.Assert(stateErr.InProgress, Equals, updateTargetTransition.operation)
+		c.Assert(stateErr.State, Equals, DeviceStateExported)
+	}
+	op.end(nil)
+	c.Assert(dev.GetState(), Equals, DeviceStateExported)
+}
+
+func (s *StateSuite) TestPreemption(c *C) {
+	testCases := []struct {
+		preempting *stateTransition
+		to         string
+	}{
+		{forceStopInitiatorTransition, DeviceStateExported},
+		{deleteTargetTransition, DeviceStateCreated},
+	}
+
+	for _, tc := range testCases {
+		comment := Commentf("preempted by %v", tc.preempting.operation)
+
+		dev := newStateTestDevice(DeviceStateAttached)
+		stop, err := dev.beginOperation(stopInitiatorTransition)
+		c.Assert(err, IsNil, comment)
+		c.Assert(dev.GetState(), Equals, DeviceStateStopping, comment)
+
+		// The non-preempting operations are refused while stopping
+		_, err = dev.beginOperation(startInitiatorTransition)
+		stateErr := &StateError{}
+		c.Assert(errors.As(err, &stateErr), Equals, true, comment)
+		c.Assert(stateErr.InProgress, Equals, stopInitiatorTransition.operation, comment)
+
+		op, err := dev.beginOperation(tc.preempting)
+		c.Assert(err, IsNil, comment)
+		c.Assert(dev.GetState(), Equals, DeviceStateStopping, comment)
+
+		// The result of the preempted operation is discarded
+		stop.end(nil)
+		c.Assert(dev.GetState(), Equals, DeviceStateStopping, comment)
+		op.end(nil)
+		c.Assert(dev.GetState(), Equals, tc.to, comment)
+		stop.end(fmt.Errorf("failure"))
+		c.Assert(dev.GetState(), Equals, tc.to, comment)
+
+		// The failed preempting operation restores the state before the
+		// preempted one
+		dev = newStateTestDevice(DeviceStateAttached)
+		stop, err = dev.beginOperation(stopInitiatorTransition)
+		c.Assert(err, IsNil, comment)
+		op, err = dev.beginOperation(tc.preempting)
+		c.Assert(err, IsNil, comment)
+		op.end(fmt.Errorf("failure"))
+		c.Assert(dev.GetState(), Equals, DeviceStateAttached, comment)
+		stop.end(nil)
+		c.Assert(dev.GetState(), Equals, DeviceStateAttached, comment)
+	}
+}
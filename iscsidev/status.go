@@ -0,0 +1,219 @@
+package iscsidev
+
+import (
+	"fmt"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/types"
+	"github.com/longhorn/go-iscsi-helper/util"
+)
+
+// Status is a point-in-time view of a device built from the live system state
+type Status struct {
+	Target   string
+	TargetID int
+	Exported bool
+	LoggedIn bool
+
+	KernelDevice *util.KernelDevice
+}
+
+// GetStatus is read-only and never takes the operation lock, so it's safe to
+// be called from monitoring loops even when an attachment is in progress. The
+// result may reflect an intermediate state of an ongoing operation.
+func (dev *Device) GetStatus() (*Status, error) {
+	status := &Status{
+		Target:   dev.Target,
+		TargetID: -1,
+	}
+
+	exported, tid, err := dev.IsExported()
+	if err != nil {
+		return nil, err
+	}
+	status.Exported = exported
+	status.TargetID = tid
+
+	ne, err := dev.getConfig().newHostExecutor()
+	if err != nil {
+		return nil, err
+	}
+	ip, err := util.GetIPToHost()
+	if err != nil {
+		return nil, err
+	}
+	if !iscsi.IsTargetLoggedIn(ip, dev.Target, ne) {
+		return status, nil
+	}
+	status.LoggedIn = true
+
+	// The device may not show up yet if the login is in progress
+	if kernelDevice, err := iscsi.FindDevice(ip, dev.Target, dev.getConfig().TargetLunID, ne); err == nil {
+		status.KernelDevice = kernelDevice
+	}
+	return status, nil
+}
+
+// IsExported is read-only and never takes the operation lock. It returns
+// whether the target exists in tgtd and its TID, -1 if it doesn't exist.
+func (dev *Device) IsExported() (bool, int, error) {
+	tgtd, err := dev.getTgtd()
+	if err != nil {
+		return false, -1, err
+	}
+	tid, err := tgtd.GetTargetTid(dev.Target)
+	if err != nil {
+		return false, -1, err
+	}
+	return tid != -1, tid, nil
+}
+
+// IsLoggedIn is read-only and never takes the operation lock
+func (dev *Device) IsLoggedIn() (bool, error) {
+	ne, err := dev.getConfig().newHostExecutor()
+	if err != nil {
+		return false, err
+	}
+	ip, err := util.GetIPToHost()
+	if err != nil {
+		return false, err
+	}
+	return iscsi.IsTargetLoggedIn(ip, dev.Target, ne), nil
+}
+
+// GetNegotiatedParams is read-only and never takes the operation lock. It
+// returns the iSCSI parameters negotiated by the session of the device.
+func (dev *Device) GetNegotiatedParams() (*iscsi.NegotiationParams, error) {
+	ne, err := dev.getConfig().newHostExecutor()
+	if err != nil {
+		return nil, err
+	}
+	ip, err := util.GetIPToHost()
+	if err != nil {
+		return nil, err
+	}
+	return iscsi.GetNegotiatedParams(ip, dev.Target, ne)
+}
+
+// GetDeviceForVolume resolves the kernel device of the volume purely from the
+// live sessions, so a restarted process can find its devices again without
+// the original Device. It's read-only and never takes the operation lock.
+func GetDeviceForVolume(name string) (*util.KernelDevice, error) {
+	return GetDeviceForVolumeWithConfig(name, DefaultConfig())
+}
+
+func GetDeviceForVolumeWithConfig(name string, config *Config) (*util.KernelDevice, error) {
+	ne, err := config.newHostExecutor()
+	if err != nil {
+		return nil, err
+	}
+	target := GetTargetName(name)
+	if !iscsi.IsTargetLoggedIn("", target, ne) {
+		return nil, fmt.Errorf("target %v of volume %v is not logged in", target, name)
+	}
+	return iscsi.FindDevice("", target, config.TargetLunID, ne)
+}
+
+// DeviceOwner is the target LUN a device belongs to, see GetVolumeForDevice
+type DeviceOwner struct {
+	// Device is the kernel name of the SCSI device of the LUN
+	Device string
+	Target string
+	LUN    int
+	// Volume is empty if the target is not created by the devices
+	Volume string
+}
+
+// GetVolumeForDevice maps the device back to the target and the volume it
+// belongs to, using the live sessions. The path can be a SCSI device, a
+// symlink to it, or a dm device stacked on it. It's read-only and never takes
+// the operation lock.
+func GetVolumeForDevice(path string) (*DeviceOwner, error) {
+	return GetVolumeForDeviceWithConfig(path, DefaultConfig())
+}
+
+func GetVolumeForDeviceWithConfig(path string, config *Config) (*DeviceOwner, error) {
+	ne, err := config.newHostExecutor()
+	if err != nil {
+		return nil, err
+	}
+	name, err := util.ResolveDeviceName(path, ne)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to resolve device %v: %v", path, err)
+	}
+	candidates, err := util.GetDeviceSlaves(name, ne)
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		candidates = []string{name}
+	}
+
+	sessions, err := iscsi.ListSessions(ne)
+	if err != nil {
+		return nil, err
+	}
+	targets := []string{}
+	for _, session := range sessions {
+		targets = append(targets, session.Target)
+	}
+	devices, err := iscsi.ListDevices("", targets, ne)
+	if err != nil {
+		return nil, err
+	}
+	for target, luns := range devices {
+		for lun, kernelDevice := range luns {
+			for _, candidate := range candidates {
+				if kernelDevice.Name == candidate {
+					return &DeviceOwner{
+						Device: kernelDevice.Name,
+						Target: target,
+						LUN:    lun,
+						Volume: GetVolumeName(target),
+					}, nil
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("device %v is not a device of any iSCSI session", path)
+}
+
+// GetPortals is read-only and never takes the operation lock. It returns the
+// portals the target of the device is exported on, which are the portals of
+// its tgtd instance shared by all the targets, see AddPortal.
+func (dev *Device) GetPortals() ([]*iscsi.Portal, error) {
+	if dev.Backend == types.TargetBackendSPDK {
+		return nil, fmt.Errorf("Portal query is not supported by %v backend", dev.Backend)
+	}
+	tgtd, err := dev.getTgtd()
+	if err != nil {
+		return nil, err
+	}
+	return tgtd.GetTargetPortals(dev.Target)
+}
+
+// GetTargetIOStats is read-only and never takes the operation lock. It returns
+// the IO statistics of the LUNs of the target indexed by LUN, which is
+// available even if the initiator is on another node.
+func (dev *Device) GetTargetIOStats() (map[int]*iscsi.LunStats, error) {
+	if dev.Backend == types.TargetBackendSPDK {
+		return nil, fmt.Errorf("Target IO stats are not supported by %v backend", dev.Backend)
+	}
+	tgtd, tid, err := dev.getExportedTid()
+	if err != nil {
+		return nil, err
+	}
+	stats, err := tgtd.GetLunStats(tid)
+	if err != nil {
+		return nil, err
+	}
+	res := map[int]*iscsi.LunStats{}
+	for _, s := range stats {
+		// LUN 0 is the controller LUN created by tgtd
+		if s.LUN == 0 {
+			continue
+		}
+		res[s.LUN] = s
+	}
+	return res, nil
+}
@@ -0,0 +1,103 @@
+package iscsidev
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+)
+
+// TgtdInstance is a tgtd instance besides the default one, which the devices
+// are pinned to by its name in Config.TgtdInstances, see Device.TgtdInstance
+type TgtdInstance struct {
+	// ControlPort identifies the instance for tgtadm, it must not be 0
+	ControlPort int
+	// PortalPort is the port the instance listens on, which must differ
+	// from the ones of the other instances on the node
+	PortalPort int
+	// Options customizes how the instance is launched, the default options
+	// are used if nil
+	Options *iscsi.DaemonOptions
+
+	once sync.Once
+	tgtd *iscsi.Tgtd
+}
+
+func (t *TgtdInstance) getTgtd() *iscsi.Tgtd {
+	t.once.Do(func() {
+		t.tgtd = iscsi.NewTgtd(t.ControlPort)
+	})
+	return t.tgtd
+}
+
+func (t *TgtdInstance) getDaemonOptions() *iscsi.DaemonOptions {
+	options := iscsi.DaemonOptions{}
+	if t.Options != nil {
+		options = *t.Options
+	}
+	if options.Portal == "" && t.PortalPort != 0 {
+		options.Portal = net.JoinHostPort("0.0.0.0", strconv.Itoa(t.PortalPort))
+	}
+	return &options
+}
+
+func (c *Config) getTgtdInstance(name string) (*TgtdInstance, error) {
+	instance, ok := c.TgtdInstances[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown tgtd instance %v", name)
+	}
+	if instance.ControlPort == 0 {
+		return nil, fmt.Errorf("Invalid tgtd instance %v: control port 0 is used by the default instance", name)
+	}
+	return instance, nil
+}
+
+// getTgtd returns the tgtd instance the target of the device lives in
+func (dev *Device) getTgtd() (*iscsi.Tgtd, error) {
+	if dev.TgtdInstance == "" {
+		return iscsi.DefaultTgtd, nil
+	}
+	instance, err := dev.getConfig().getTgtdInstance(dev.TgtdInstance)
+	if err != nil {
+		return nil, err
+	}
+	return instance.getTgtd(), nil
+}
+
+func (dev *Device) getTgtdOptions() (*iscsi.DaemonOptions, error) {
+	if dev.TgtdInstance == "" {
+		return dev.getConfig().getTgtdOptions(), nil
+	}
+	instance, err := dev.getConfig().getTgtdInstance(dev.TgtdInstance)
+	if err != nil {
+		return nil, err
+	}
+	return instance.getDaemonOptions(), nil
+}
+
+// getPortalAddress returns the address the initiator discovers the target
+// through, which includes the port if the target listens on a custom one.
+// The other node operations match the records by IP only.
+func (dev *Device) getPortalAddress(ip string) (string, error) {
+	port, err := dev.getPortalPort()
+	if err != nil {
+		return "", err
+	}
+	if port == iscsi.DefaultPortalPort {
+		return ip, nil
+	}
+	return net.JoinHostPort(ip, strconv.Itoa(port)), nil
+}
+
+// getAllTgtds returns the default instance and all the configured ones
+func (c *Config) getAllTgtds() []*iscsi.Tgtd {
+	res := []*iscsi.Tgtd{iscsi.DefaultTgtd}
+	for name := range c.TgtdInstances {
+		if instance, err := c.getTgtdInstance(name); err == nil {
+			res = append(res, instance.getTgtd())
+		}
+	}
+	return res
+}
@@ -0,0 +1,80 @@
+package iscsidev
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/go-iscsi-helper/util"
+)
+
+// SetIOLimits throttles the devices of the attachment at runtime, and keeps
+// the limits for the following attachments. nil limits remove the throttling.
+func (dev *Device) SetIOLimits(limits *util.IOLimits) error {
+	return dev.runOperation(updateDeviceTransition, func() error {
+		return dev.setIOLimits(limits)
+	})
+}
+
+func (dev *Device) setIOLimits(limits *util.IOLimits) error {
+	config := dev.getConfig()
+	if config.ThrottleCgroup == "" {
+		return fmt.Errorf("Cannot throttle target %v since the throttle cgroup is not configured", dev.Target)
+	}
+	dev.IOLimits = limits
+	if dev.KernelDevice == nil {
+		return nil
+	}
+
+	ne, err := config.newHostExecutor()
+	if err != nil {
+		return err
+	}
+	// The removed limits are reset to unlimited
+	for _, kernelDevice := range dev.getKernelDevices() {
+		if err := util.SetDeviceIOLimits(config.ThrottleCgroup, kernelDevice, limits, ne); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("go-iscsi-helper: set IO limits of target %v to %v", dev.Target, limits)
+	return nil
+}
+
+// GetIOLimits returns the limits of the device of the attachment in effect
+func (dev *Device) GetIOLimits() (*util.IOLimits, error) {
+	config := dev.getConfig()
+	if config.ThrottleCgroup == "" {
+		return nil, fmt.Errorf("Cannot get IO limits of target %v since the throttle cgroup is not configured", dev.Target)
+	}
+	if dev.KernelDevice == nil {
+		return nil, fmt.Errorf("Cannot get IO limits of target %v since it's not attached", dev.Target)
+	}
+	ne, err := config.newHostExecutor()
+	if err != nil {
+		return nil, err
+	}
+	return util.GetDeviceIOLimits(config.ThrottleCgroup, dev.KernelDevice, ne)
+}
+
+func (dev *Device) applyIOLimits(ne *util.NamespaceExecutor, config *Config) error {
+	if dev.IOLimits == nil || config.ThrottleCgroup == "" {
+		return nil
+	}
+	for _, kernelDevice := range dev.getKernelDevices() {
+		if err := util.SetDeviceIOLimits(config.ThrottleCgroup, kernelDevice, dev.IOLimits, ne); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getKernelDevices returns the devices of all the LUNs of the attachment
+func (dev *Device) getKernelDevices() []*util.KernelDevice {
+	kernelDevices := []*util.KernelDevice{dev.KernelDevice}
+	for _, disk := range dev.Disks {
+		if disk.KernelDevice != nil {
+			kernelDevices = append(kernelDevices, disk.KernelDevice)
+		}
+	}
+	return kernelDevices
+}
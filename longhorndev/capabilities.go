@@ -0,0 +1,94 @@
+package longhorndev
+
+import (
+	"os"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/iscsidev"
+	"github.com/longhorn/go-iscsi-helper/types"
+	"github.com/longhorn/go-iscsi-helper/util"
+)
+
+const sgRawBinary = "sg_raw"
+
+var (
+	// localBinaries are required in the namespace of the caller
+	localBinaries = append([]string{util.NSBinary, sgRawBinary}, iscsi.TargetBinaries...)
+	// hostBinaries are required in the host namespace
+	hostBinaries = append(append([]string{}, iscsi.InitiatorBinaries...), util.HostBinaries...)
+)
+
+// Capabilities describes what this build of the library supports on the
+// current node
+type Capabilities struct {
+	Version string
+	// Frontends are the frontends accepted by LonghornDevice.SetFrontend
+	Frontends     []string
+	BackingStores []string
+	// Backends are the target backends available for iscsidev.Device,
+	// SPDK is only reported if its RPC socket exists
+	Backends []string
+
+	// CHAP is true if the CHAP accounts can be managed, see
+	// iscsi.CreateAccount
+	CHAP bool
+
+	// Binaries maps the required binaries to whether they're found
+	Binaries map[string]bool
+}
+
+// Version returns the version of the library
+func Version() string {
+	return types.Version
+}
+
+// GetCapabilities is GetCapabilitiesWithConfig with iscsidev.DefaultConfig
+func GetCapabilities() *Capabilities {
+	return GetCapabilitiesWithConfig(iscsidev.DefaultConfig())
+}
+
+// GetCapabilitiesWithConfig reports the features available on the node, so
+// the callers can select the features before attaching the devices. The host
+// binaries are looked up the same as the initiator operations of the config
+// run them, e.g. in InitiatorNetNS. It never fails, the missing pieces are
+// reported as unavailable instead.
+func GetCapabilitiesWithConfig(config *iscsidev.Config) *Capabilities {
+	c := &Capabilities{
+		Version: types.Version,
+		Frontends: []string{
+			types.FrontendTGTBlockDev,
+			types.FrontendTGTISCSI,
+		},
+		BackingStores: []string{},
+		Backends:      []string{types.TargetBackendTGT},
+		Binaries:      map[string]bool{},
+	}
+	if _, err := os.Stat(config.SPDKSocketPath); err == nil {
+		c.Backends = append(c.Backends, types.TargetBackendSPDK)
+	}
+
+	// tgtd is started on demand, so the backing stores are only known when
+	// it's running
+	if backingStores, err := iscsi.GetBackingStores(); err == nil {
+		c.BackingStores = backingStores
+	}
+
+	local, _ := util.NewNamespaceExecutor("")
+	for _, binary := range localBinaries {
+		_, err := local.LookPath(binary)
+		c.Binaries[binary] = err == nil
+	}
+	host, err := config.NewHostExecutor()
+	for _, binary := range hostBinaries {
+		if err != nil {
+			c.Binaries[binary] = false
+			continue
+		}
+		_, lookErr := host.LookPath(binary)
+		c.Binaries[binary] = lookErr == nil
+	}
+	// The CHAP accounts are managed through tgtadm
+	c.CHAP = c.Binaries["tgtadm"]
+
+	return c
+}
@@ -35,6 +35,7 @@ type LonghornDevice struct {
 	endpoint string
 
 	scsiDevice *iscsidev.Device
+	config     *iscsidev.Config
 }
 
 type DeviceService interface {
@@ -57,16 +58,26 @@ type DeviceCreator interface {
 	NewDevice(name string, size int64, frontend string) (DeviceService, error)
 }
 
-type LonghornDeviceCreator struct{}
+type LonghornDeviceCreator struct {
+	// Config is the config of the iSCSI devices, DefaultConfig if nil. Its
+	// DeviceNodeAttributes are applied to the device nodes in DevPath as
+	// well.
+	Config *iscsidev.Config
+}
 
 func (ldc *LonghornDeviceCreator) NewDevice(name string, size int64, frontend string) (DeviceService, error) {
 	if name == "" || size == 0 {
 		return nil, fmt.Errorf("invalid parameter for creating Longhorn device")
 	}
+	config := ldc.Config
+	if config == nil {
+		config = iscsidev.DefaultConfig()
+	}
 	dev := &LonghornDevice{
 		RWMutex: &sync.RWMutex{},
 		name:    name,
 		size:    size,
+		config:  config,
 	}
 	if err := dev.SetFrontend(frontend); err != nil {
 		return nil, err
@@ -93,7 +104,7 @@ func (d *LonghornDevice) InitDevice() error {
 // call with lock hold
 func (d *LonghornDevice) initScsiDevice() error {
 	bsOpts := fmt.Sprintf("size=%v", d.size)
-	scsiDev, err := iscsidev.NewDevice(d.name, d.GetSocketPath(), "longhorn", bsOpts)
+	scsiDev, err := iscsidev.NewDeviceWithConfig(d.name, d.GetSocketPath(), "longhorn", bsOpts, d.config)
 	if err != nil {
 		return err
 	}
@@ -133,6 +144,8 @@ func (d *LonghornDevice) startScsiDevice(startScsiDevice bool) (err error) {
 				return err
 			}
 			logrus.Infof("device %v: SCSI device %s created", d.name, d.scsiDevice.KernelDevice.Name)
+		} else {
+			d.syncScsiDeviceState()
 		}
 
 		d.endpoint = d.getDev()
@@ -147,6 +160,8 @@ func (d *LonghornDevice) startScsiDevice(startScsiDevice bool) (err error) {
 				return err
 			}
 			logrus.Infof("device %v: iSCSI target %s created", d.name, d.scsiDevice.Target)
+		} else {
+			d.syncScsiDeviceState()
 		}
 
 		d.endpoint = d.scsiDevice.Target
@@ -160,6 +175,20 @@ func (d *LonghornDevice) startScsiDevice(startScsiDevice bool) (err error) {
 	return nil
 }
 
+// syncScsiDeviceState takes over the target and the attachment left by the
+// previous process, so they can be shutdown later
+func (d *LonghornDevice) syncScsiDeviceState() {
+	if d.scsiDevice == nil {
+		return
+	}
+	state, err := d.scsiDevice.SyncState()
+	if err != nil {
+		logrus.Warnf("device %v: fail to sync SCSI device state: %v", d.name, err)
+		return
+	}
+	logrus.Infof("device %v: SCSI device of target %v is %v", d.name, d.scsiDevice.Target, state)
+}
+
 func (d *LonghornDevice) Shutdown() error {
 	d.Lock()
 	defer d.Unlock()
@@ -180,34 +209,54 @@ func (d *LonghornDevice) Shutdown() error {
 
 // call with lock hold
 func (d *LonghornDevice) shutdownFrontend() error {
-	switch d.frontend {
-	case types.FrontendTGTBlockDev:
-		dev := d.getDev()
-		if err := util.RemoveDevice(dev); err != nil {
-			return fmt.Errorf("device %v: fail to remove device %s: %v", d.name, dev, err)
-		}
-		if err := d.scsiDevice.StopInitiator(); err != nil {
-			return fmt.Errorf("device %v: fail to stop SCSI device: %v", d.name, err)
-		}
-		if err := d.scsiDevice.DeleteTarget(); err != nil {
-			return fmt.Errorf("device %v: fail to delete target %v", d.name, d.scsiDevice.Target)
-		}
-		logrus.Infof("device %v: SCSI device %v shutdown", d.name, dev)
-		break
-	case types.FrontendTGTISCSI:
-		if err := d.scsiDevice.DeleteTarget(); err != nil {
-			return fmt.Errorf("device %v: fail to delete target %v", d.name, d.scsiDevice.Target)
+	return d.gracefulShutdown()(nil)
+}
+
+// gracefulShutdown returns the shutdown of the current frontend. It only uses
+// what's taken from the device here, so ShutdownWithOptions can give up
+// waiting for it and reset the device while it's still running, and it stops
+// before the next step once the fence is set.
+// call with lock hold
+func (d *LonghornDevice) gracefulShutdown() func(fence *iscsidev.Fence) error {
+	name := d.name
+	frontend := d.frontend
+	dev := d.getDev()
+	scsiDevice := d.scsiDevice
+	return func(fence *iscsidev.Fence) error {
+		switch frontend {
+		case types.FrontendTGTBlockDev:
+			if err := util.RemoveDevice(dev); err != nil {
+				return fmt.Errorf("device %v: fail to remove device %s: %v", name, dev, err)
+			}
+			if err := fence.Check(); err != nil {
+				return err
+			}
+			if err := scsiDevice.StopInitiator(); err != nil {
+				return fmt.Errorf("device %v: fail to stop SCSI device: %v", name, err)
+			}
+			if err := fence.Check(); err != nil {
+				return err
+			}
+			if err := scsiDevice.DeleteTarget(); err != nil {
+				return fmt.Errorf("device %v: fail to delete target %v", name, scsiDevice.Target)
+			}
+			logrus.Infof("device %v: SCSI device %v shutdown", name, dev)
+			break
+		case types.FrontendTGTISCSI:
+			if err := scsiDevice.DeleteTarget(); err != nil {
+				return fmt.Errorf("device %v: fail to delete target %v", name, scsiDevice.Target)
+			}
+			logrus.Infof("device %v: SCSI target %v ", name, scsiDevice.Target)
+			break
+		case "":
+			logrus.Infof("device %v: skip shutdown frontend since it's not enabled", name)
+			break
+		default:
+			return fmt.Errorf("device %v: unknown frontend %v", name, frontend)
 		}
-		logrus.Infof("device %v: SCSI target %v ", d.name, d.scsiDevice.Target)
-		break
-	case "":
-		logrus.Infof("device %v: skip shutdown frontend since it's not enabled", d.name)
-		break
-	default:
-		return fmt.Errorf("device %v: unknown frontend %v", d.name, d.frontend)
-	}
 
-	return nil
+		return nil
+	}
 }
 
 func (d *LonghornDevice) WaitForSocket(stopCh chan struct{}) chan error {
@@ -263,7 +312,7 @@ func (d *LonghornDevice) createDev() error {
 		}
 	}
 
-	if err := util.DuplicateDevice(d.scsiDevice.KernelDevice, dev); err != nil {
+	if err := util.DuplicateDeviceWithAttributes(d.scsiDevice.KernelDevice, dev, d.config.DeviceNodeAttributes); err != nil {
 		return err
 	}
 
@@ -325,7 +374,7 @@ func (d *LonghornDevice) ReloadSocketConnection() error {
 	dev := d.getDev()
 	d.RUnlock()
 
-	cmd := exec.Command("sg_raw", dev, "a6", "00", "00", "00", "00", "00")
+	cmd := exec.Command(sgRawBinary, dev, "a6", "00", "00", "00", "00", "00")
 	if err := cmd.Run(); err != nil {
 		return errors.Wrapf(err, "failed to reload socket connection at %v", dev)
 	}
@@ -419,3 +468,35 @@ func (d *LonghornDevice) Expand(size int64) error {
 
 	return nil
 }
+
+// PurgeAll tears down all the resources of the Longhorn devices on the node,
+// see iscsidev.PurgeAll. Only the device nodes in DevPath created for the
+// purged targets are removed, the ones of the targets in use are kept.
+func PurgeAll() (*iscsidev.PurgeReport, error) {
+	report, err := iscsidev.PurgeAll(iscsidev.TargetNamePrefix, iscsidev.DefaultConfig())
+	if report == nil {
+		return nil, err
+	}
+	names := map[string]struct{}{}
+	for _, target := range append(report.Sessions, report.Targets...) {
+		if name := iscsidev.GetVolumeName(target); name != "" {
+			names[name] = struct{}{}
+		}
+	}
+	for name := range names {
+		file := filepath.Join(DevPath, name)
+		info, statErr := os.Lstat(file)
+		if statErr != nil || info.Mode()&os.ModeDevice == 0 || info.Mode()&os.ModeCharDevice != 0 {
+			continue
+		}
+		if removeErr := util.RemoveDevice(file); removeErr != nil {
+			report.Errors = append(report.Errors, removeErr.Error())
+			if err == nil {
+				err = removeErr
+			}
+			continue
+		}
+		logrus.Infof("go-iscsi-helper: purged device %v", file)
+	}
+	return report, err
+}
@@ -0,0 +1,110 @@
+package longhorndev
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/longhorn/go-iscsi-helper/iscsidev"
+	"github.com/longhorn/go-iscsi-helper/types"
+	"github.com/longhorn/go-iscsi-helper/util"
+)
+
+// ShutdownOptions controls ShutdownWithOptions
+type ShutdownOptions struct {
+	// Timeout bounds the graceful shutdown, which waits indefinitely if 0
+	Timeout time.Duration
+	// Force escalates to the forced teardown if the graceful shutdown fails
+	// or times out, instead of returning the error
+	Force bool
+}
+
+// ShutdownReport tells how the frontend was shut down
+type ShutdownReport struct {
+	// Graceful is true if the frontend stopped without escalation
+	Graceful bool
+	// Escalations are the forced teardown steps taken, see
+	// iscsidev.EscalationStep*
+	Escalations []string
+	// Errors are the failures of the graceful shutdown and the steps
+	Errors []string
+}
+
+// ShutdownWithOptions shuts down the frontend like Shutdown, but gives up the
+// graceful stop after the timeout. If force is set, it then closes the
+// connections of the target, which unblocks a hung logout, and tears down
+// whatever is left of the device node, the session and the target. The
+// graceful stop given up on may still be running, but it's fenced off from
+// taking any further step, see iscsidev.Escalation.
+func (d *LonghornDevice) ShutdownWithOptions(options *ShutdownOptions) (*ShutdownReport, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.scsiDevice == nil {
+		return &ShutdownReport{
+			Graceful:    true,
+			Escalations: []string{},
+			Errors:      []string{},
+		}, nil
+	}
+
+	escalation := &iscsidev.Escalation{
+		Name:    "device " + d.name,
+		Timeout: options.Timeout,
+		Force:   options.Force,
+		Unblock: &iscsidev.EscalationStep{
+			Name: iscsidev.EscalationStepCloseConnections,
+			Run:  d.closeConnections,
+		},
+		Steps: d.forceShutdownSteps(),
+	}
+	result, err := escalation.Run(d.gracefulShutdown())
+	report := &ShutdownReport{
+		Graceful:    result.Graceful,
+		Escalations: result.Escalations,
+		Errors:      result.Errors,
+	}
+	if err != nil {
+		return report, fmt.Errorf("device %v: failed to shutdown frontend: %v", d.name, err)
+	}
+	d.scsiDevice = nil
+	d.endpoint = ""
+	return report, nil
+}
+
+// call with lock hold
+func (d *LonghornDevice) closeConnections() error {
+	exported, _, err := d.scsiDevice.IsExported()
+	if err != nil || !exported {
+		return err
+	}
+	return d.scsiDevice.CloseConnections()
+}
+
+// forceShutdownSteps tears down whatever is left of the frontend. The logout
+// doesn't take the operation lock, which the hanging graceful logout holds.
+// call with lock hold
+func (d *LonghornDevice) forceShutdownSteps() []*iscsidev.EscalationStep {
+	scsiDevice := d.scsiDevice
+	steps := []*iscsidev.EscalationStep{}
+	if d.frontend == types.FrontendTGTBlockDev {
+		dev := d.getDev()
+		steps = append(steps,
+			&iscsidev.EscalationStep{
+				Name: iscsidev.EscalationStepRemoveDevice,
+				Run: func() error {
+					return util.RemoveDevice(dev)
+				},
+			},
+			&iscsidev.EscalationStep{
+				Name: iscsidev.EscalationStepForceLogout,
+				Run: func() error {
+					_, err := scsiDevice.ForceLogout()
+					return err
+				},
+			})
+	}
+	return append(steps, &iscsidev.EscalationStep{
+		Name: iscsidev.EscalationStepDeleteTarget,
+		Run:  scsiDevice.DeleteTarget,
+	})
+}
@@ -0,0 +1,164 @@
+package nbddev
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/go-iscsi-helper/util"
+)
+
+var (
+	MaxNBDDevices = 16
+
+	RetryCounts   = 10
+	RetryInterval = 500 * time.Millisecond
+)
+
+const (
+	qemuNBDBinary = "qemu-nbd"
+
+	FormatQcow2 = "qcow2"
+	FormatRaw   = "raw"
+)
+
+// Device attaches a backing file in any format supported by qemu, e.g. qcow2,
+// as a block device through the kernel NBD client and qemu-nbd
+type Device struct {
+	BackingFile  string
+	Format       string
+	KernelDevice *util.KernelDevice
+}
+
+func NewDevice(backingFile, format string) (*Device, error) {
+	if backingFile == "" || format == "" {
+		return nil, fmt.Errorf("invalid parameter for creating NBD device")
+	}
+	if err := util.ValidateArgument("backing file", backingFile); err != nil {
+		return nil, err
+	}
+	if err := util.ValidateArgument("format", format); err != nil {
+		return nil, err
+	}
+	return &Device{
+		BackingFile: backingFile,
+		Format:      format,
+	}, nil
+}
+
+func getNBDSysfsPidFile(name string) string {
+	return filepath.Join("/sys/block", name, "pid")
+}
+
+// findAvailableNBDDevice returns the first NBD device not connected to a
+// server
+func findAvailableNBDDevice() (string, error) {
+	for i := 0; i < MaxNBDDevices; i++ {
+		name := fmt.Sprintf("nbd%d", i)
+		if _, err := os.Stat(filepath.Join("/sys/block", name)); err != nil {
+			continue
+		}
+		if _, err := os.Stat(getNBDSysfsPidFile(name)); os.IsNotExist(err) {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("cannot find an available NBD device")
+}
+
+func loadNBDModule() error {
+	if _, err := os.Stat("/sys/module/nbd"); err == nil {
+		return nil
+	}
+	opts := []string{
+		"nbd",
+		fmt.Sprintf("nbds_max=%d", MaxNBDDevices),
+	}
+	if _, err := util.Execute("modprobe", opts); err != nil {
+		return fmt.Errorf("Failed to load nbd module: %v", err)
+	}
+	return nil
+}
+
+// Start connects the backing file to an available NBD device
+func (dev *Device) Start() error {
+	if dev.KernelDevice != nil {
+		return nil
+	}
+	if err := loadNBDModule(); err != nil {
+		return err
+	}
+
+	name, err := findAvailableNBDDevice()
+	if err != nil {
+		return err
+	}
+	devPath := filepath.Join("/dev", name)
+	opts := []string{
+		"--connect=" + devPath,
+		"--format=" + dev.Format,
+		"--cache=none",
+		"--aio=native",
+		dev.BackingFile,
+	}
+	if _, err := util.Execute(qemuNBDBinary, opts); err != nil {
+		return err
+	}
+
+	// qemu-nbd returns before the kernel finishes the connection
+	connected := false
+	for i := 0; i < RetryCounts; i++ {
+		if _, err := os.Stat(getNBDSysfsPidFile(name)); err == nil {
+			connected = true
+			break
+		}
+		time.Sleep(RetryInterval)
+	}
+	if !connected {
+		dev.disconnect(devPath)
+		return fmt.Errorf("Timeout waiting for NBD device %v to connect", devPath)
+	}
+
+	ne, err := util.NewNamespaceExecutor("")
+	if err != nil {
+		dev.disconnect(devPath)
+		return err
+	}
+	devices, err := util.GetKnownDevices(ne)
+	if err != nil {
+		dev.disconnect(devPath)
+		return err
+	}
+	kernelDevice, known := devices[name]
+	if !known {
+		dev.disconnect(devPath)
+		return fmt.Errorf("Cannot find kernel device for NBD device: %s", name)
+	}
+	dev.KernelDevice = kernelDevice
+	logrus.Infof("go-iscsi-helper: %v file %v connected to %v", dev.Format, dev.BackingFile, devPath)
+	return nil
+}
+
+// Stop disconnects the NBD device, which terminates the qemu-nbd server
+func (dev *Device) Stop() error {
+	if dev.KernelDevice == nil {
+		return nil
+	}
+	devPath := filepath.Join("/dev", dev.KernelDevice.Name)
+	if err := dev.disconnect(devPath); err != nil {
+		return err
+	}
+	logrus.Infof("go-iscsi-helper: NBD device %v disconnected", devPath)
+	dev.KernelDevice = nil
+	return nil
+}
+
+func (dev *Device) disconnect(devPath string) error {
+	if _, err := util.Execute(qemuNBDBinary, []string{"--disconnect", devPath}); err != nil {
+		logrus.Warnf("Failed to disconnect NBD device %v: %v", devPath, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package nbddev
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/longhorn/go-iscsi-helper/util"
+)
+
+// DeviceSchemaVersion is the version of the serialized Device
+const DeviceSchemaVersion = 1
+
+type deviceV1 struct {
+	SchemaVersion int                `json:"schemaVersion"`
+	BackingFile   string             `json:"backingFile"`
+	Format        string             `json:"format"`
+	KernelDevice  *util.KernelDevice `json:"kernelDevice,omitempty"`
+}
+
+func (dev *Device) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&deviceV1{
+		SchemaVersion: DeviceSchemaVersion,
+		BackingFile:   dev.BackingFile,
+		Format:        dev.Format,
+		KernelDevice:  dev.KernelDevice,
+	})
+}
+
+func (dev *Device) UnmarshalJSON(data []byte) error {
+	v1 := &deviceV1{}
+	if err := json.Unmarshal(data, v1); err != nil {
+		return err
+	}
+	if v1.SchemaVersion != DeviceSchemaVersion {
+		return fmt.Errorf("unsupported NBD device schema version %v", v1.SchemaVersion)
+	}
+	*dev = Device{
+		BackingFile:  v1.BackingFile,
+		Format:       v1.Format,
+		KernelDevice: v1.KernelDevice,
+	}
+	return nil
+}
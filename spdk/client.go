@@ -0,0 +1,103 @@
+package spdk
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	DefaultSocketPath = "/var/tmp/spdk.sock"
+	RPCTimeout        = 30 * time.Second
+)
+
+const (
+	jsonRPCVersion = "2.0"
+)
+
+// Client talks to the SPDK target application through its JSON-RPC socket
+type Client struct {
+	socketPath string
+
+	lock *sync.Mutex
+	id   int
+}
+
+type rpcRequest struct {
+	Version string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	ID      int         `json:"id"`
+	Params  interface{} `json:"params,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcResponse struct {
+	Version string          `json:"jsonrpc"`
+	ID      int             `json:"id"`
+	Result  json.RawMessage `json:"result"`
+	Error   *rpcError       `json:"error"`
+}
+
+// NewClient returns a client of the SPDK application listening on socketPath.
+// DefaultSocketPath is used if socketPath is empty.
+func NewClient(socketPath string) *Client {
+	if socketPath == "" {
+		socketPath = DefaultSocketPath
+	}
+	return &Client{
+		socketPath: socketPath,
+		lock:       &sync.Mutex{},
+	}
+}
+
+// Call invokes method with params and decodes the result into result, which
+// can be nil if the caller doesn't care about it
+func (c *Client) Call(method string, params interface{}, result interface{}) error {
+	c.lock.Lock()
+	c.id++
+	id := c.id
+	c.lock.Unlock()
+
+	conn, err := net.DialTimeout("unix", c.socketPath, RPCTimeout)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to SPDK socket %v: %v", c.socketPath, err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(RPCTimeout)); err != nil {
+		return err
+	}
+
+	req := &rpcRequest{
+		Version: jsonRPCVersion,
+		Method:  method,
+		ID:      id,
+		Params:  params,
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return fmt.Errorf("Failed to send SPDK request %v: %v", method, err)
+	}
+
+	resp := &rpcResponse{}
+	if err := json.NewDecoder(conn).Decode(resp); err != nil {
+		return fmt.Errorf("Failed to read SPDK response of %v: %v", method, err)
+	}
+	if resp.ID != id {
+		return fmt.Errorf("BUG: SPDK response id %v doesn't match request id %v", resp.ID, id)
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("SPDK request %v failed: code %v, message %v", method, resp.Error.Code, resp.Error.Message)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(resp.Result, result); err != nil {
+		return fmt.Errorf("Failed to parse SPDK response of %v: %v", method, err)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package spdk
+
+const (
+	DefaultBlockSize  = 512
+	DefaultQueueDepth = 64
+
+	// InitiatorAny allows any initiator from any network to connect
+	InitiatorAny = "ANY"
+)
+
+type Bdev struct {
+	Name        string `json:"name"`
+	ProductName string `json:"product_name"`
+	BlockSize   int    `json:"block_size"`
+	NumBlocks   int64  `json:"num_blocks"`
+}
+
+type Portal struct {
+	Host string `json:"host"`
+	Port string `json:"port"`
+}
+
+type PortalGroup struct {
+	Tag     int      `json:"tag"`
+	Portals []Portal `json:"portals"`
+}
+
+type InitiatorGroup struct {
+	Tag        int      `json:"tag"`
+	Initiators []string `json:"initiators"`
+	Netmasks   []string `json:"netmasks"`
+}
+
+type PGIGMap struct {
+	PGTag int `json:"pg_tag"`
+	IGTag int `json:"ig_tag"`
+}
+
+type Lun struct {
+	BdevName string `json:"bdev_name"`
+	LunID    int    `json:"lun_id"`
+}
+
+type TargetNode struct {
+	Name       string    `json:"name"`
+	AliasName  string    `json:"alias_name"`
+	PGIGMaps   []PGIGMap `json:"pg_ig_maps"`
+	Luns       []Lun     `json:"luns"`
+	QueueDepth int       `json:"queue_depth"`
+}
+
+type createTargetNodeParams struct {
+	TargetNode
+	DisableChap bool `json:"disable_chap"`
+}
+
+// CreateAioBdev creates a bdev backed by file using Linux AIO
+func (c *Client) CreateAioBdev(name, file string, blockSize int) error {
+	params := map[string]interface{}{
+		"name":       name,
+		"filename":   file,
+		"block_size": blockSize,
+	}
+	return c.Call("bdev_aio_create", params, nil)
+}
+
+// DeleteAioBdev removes the AIO bdev
+func (c *Client) DeleteAioBdev(name string) error {
+	params := map[string]interface{}{
+		"name": name,
+	}
+	return c.Call("bdev_aio_delete", params, nil)
+}
+
+func (c *Client) GetBdevs() ([]Bdev, error) {
+	res := []Bdev{}
+	if err := c.Call("bdev_get_bdevs", nil, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// GetBdev returns nil if the bdev doesn't exist
+func (c *Client) GetBdev(name string) (*Bdev, error) {
+	bdevs, err := c.GetBdevs()
+	if err != nil {
+		return nil, err
+	}
+	for i := range bdevs {
+		if bdevs[i].Name == name {
+			return &bdevs[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func (c *Client) CreatePortalGroup(tag int, portals []Portal) error {
+	params := &PortalGroup{
+		Tag:     tag,
+		Portals: portals,
+	}
+	return c.Call("iscsi_create_portal_group", params, nil)
+}
+
+func (c *Client) GetPortalGroups() ([]PortalGroup, error) {
+	res := []PortalGroup{}
+	if err := c.Call("iscsi_get_portal_groups", nil, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (c *Client) CreateInitiatorGroup(tag int, initiators, netmasks []string) error {
+	params := &InitiatorGroup{
+		Tag:        tag,
+		Initiators: initiators,
+		Netmasks:   netmasks,
+	}
+	return c.Call("iscsi_create_initiator_group", params, nil)
+}
+
+func (c *Client) GetInitiatorGroups() ([]InitiatorGroup, error) {
+	res := []InitiatorGroup{}
+	if err := c.Call("iscsi_get_initiator_groups", nil, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// CreateTargetNode exports the bdevs as the LUNs of target name through the
+// portal group and initiator group pairs. The name is used as is if it's a
+// full IQN, otherwise SPDK prefixes it with its node base.
+func (c *Client) CreateTargetNode(name, alias string, luns []Lun, maps []PGIGMap) error {
+	params := &createTargetNodeParams{
+		TargetNode: TargetNode{
+			Name:       name,
+			AliasName:  alias,
+			PGIGMaps:   maps,
+			Luns:       luns,
+			QueueDepth: DefaultQueueDepth,
+		},
+		DisableChap: true,
+	}
+	return c.Call("iscsi_create_target_node", params, nil)
+}
+
+func (c *Client) DeleteTargetNode(name string) error {
+	params := map[string]interface{}{
+		"name": name,
+	}
+	return c.Call("iscsi_delete_target_node", params, nil)
+}
+
+func (c *Client) GetTargetNodes() ([]TargetNode, error) {
+	res := []TargetNode{}
+	if err := c.Call("iscsi_get_target_nodes", nil, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// GetTargetNode returns nil if the target node doesn't exist
+func (c *Client) GetTargetNode(name string) (*TargetNode, error) {
+	nodes, err := c.GetTargetNodes()
+	if err != nil {
+		return nil, err
+	}
+	for i := range nodes {
+		if nodes[i].Name == name {
+			return &nodes[i], nil
+		}
+	}
+	return nil, nil
+}
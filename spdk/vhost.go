@@ -0,0 +1,35 @@
+package spdk
+
+type VhostController struct {
+	Ctrlr       string `json:"ctrlr"`
+	Cpumask     string `json:"cpumask"`
+	Socket      string `json:"socket"`
+	DelayBaseUs int    `json:"delay_base_us"`
+}
+
+// CreateVhostBlkController exposes the bdev to the VMs as a vhost-user-blk
+// device. The socket of the controller is created in the vhost socket
+// directory the SPDK application was started with, named after ctrlr.
+func (c *Client) CreateVhostBlkController(ctrlr, bdevName string, readonly bool) error {
+	params := map[string]interface{}{
+		"ctrlr":    ctrlr,
+		"dev_name": bdevName,
+		"readonly": readonly,
+	}
+	return c.Call("vhost_create_blk_controller", params, nil)
+}
+
+func (c *Client) DeleteVhostController(ctrlr string) error {
+	params := map[string]interface{}{
+		"ctrlr": ctrlr,
+	}
+	return c.Call("vhost_delete_controller", params, nil)
+}
+
+func (c *Client) GetVhostControllers() ([]VhostController, error) {
+	res := []VhostController{}
+	if err := c.Call("vhost_get_controllers", nil, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -1,6 +1,17 @@
 package types
 
+var (
+	// Version of the library. Consumers can override it at build time with
+	// -ldflags "-X github.com/longhorn/go-iscsi-helper/types.Version=<version>"
+	Version = "dev"
+)
+
 const (
 	FrontendTGTBlockDev = "tgt-blockdev"
 	FrontendTGTISCSI    = "tgt-iscsi"
 )
+
+const (
+	TargetBackendTGT  = "tgt"
+	TargetBackendSPDK = "spdk"
+)
@@ -0,0 +1,70 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidArgument is wrapped by InvalidArgumentError, so it can be checked
+// by errors.Is
+var ErrInvalidArgument = errors.New("invalid argument")
+
+// InvalidArgumentError is returned for the arguments rejected by
+// ValidateArgument and the executors
+type InvalidArgumentError struct {
+	Name   string
+	Value  string
+	Reason string
+}
+
+func (e *InvalidArgumentError) Error() string {
+	return fmt.Sprintf("invalid %v %q: %v", e.Name, e.Value, e.Reason)
+}
+
+func (e *InvalidArgumentError) Unwrap() error {
+	return ErrInvalidArgument
+}
+
+// ValidateArgument rejects the value containing the control bytes. It's for
+// the user inputs flowing into the command lines, e.g. the volume names and
+// the backing file paths. The commands are executed without a shell, and the
+// values used in the shell scripts are quoted by ShellQuote, so the
+// shell metacharacters are allowed.
+func ValidateArgument(name, value string) error {
+	return checkControlBytes(name, value)
+}
+
+func checkControlBytes(name, value string) error {
+	for i := 0; i < len(value); i++ {
+		if value[i] < 0x20 || value[i] == 0x7f {
+			return &InvalidArgumentError{
+				Name:   name,
+				Value:  value,
+				Reason: fmt.Sprintf("control byte 0x%02x is not allowed", value[i]),
+			}
+		}
+	}
+	return nil
+}
+
+// checkCommandArgs is applied to all the commands by the executors. The
+// arguments are passed to the commands directly rather than through a shell,
+// so only the control bytes are rejected here.
+func checkCommandArgs(binary string, args []string) error {
+	if err := checkControlBytes("command", binary); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		if err := checkControlBytes("argument", arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ShellQuote quotes the string to be used as a single word in the scripts
+// executed by "sh -c" or "bash -c"
+func ShellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
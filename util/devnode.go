@@ -0,0 +1,102 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ChownBinary = "chown"
+	ChmodBinary = "chmod"
+	ChconBinary = "chcon"
+
+	selinuxXattr = "security.selinux"
+)
+
+// DeviceNodeAttributes are applied to the device nodes right after they are
+// created, so the unprivileged consumers can open the devices without an
+// extra chown or chcon racing with udev
+type DeviceNodeAttributes struct {
+	// UID and GID are kept unchanged if nil, the zero values would mean
+	// root
+	UID *int
+	GID *int
+	// Mode is the permission bits, kept unchanged if 0
+	Mode os.FileMode
+	// SELinuxContext is e.g. "system_u:object_r:container_file_t:s0", kept
+	// unchanged if empty
+	SELinuxContext string
+}
+
+// ApplyDeviceNodeAttributes applies the attributes to the device node in the
+// current mount namespace. The symlinks are followed.
+func ApplyDeviceNodeAttributes(path string, attrs *DeviceNodeAttributes) error {
+	if attrs == nil {
+		return nil
+	}
+	if attrs.UID != nil || attrs.GID != nil {
+		uid, gid := -1, -1
+		if attrs.UID != nil {
+			uid = *attrs.UID
+		}
+		if attrs.GID != nil {
+			gid = *attrs.GID
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			return fmt.Errorf("Couldn't change owner of the device %s: %v", path, err)
+		}
+	}
+	if attrs.Mode != 0 {
+		if err := os.Chmod(path, attrs.Mode.Perm()); err != nil {
+			return fmt.Errorf("Couldn't change permission of the device %s: %v", path, err)
+		}
+	}
+	if attrs.SELinuxContext != "" {
+		if err := unix.Setxattr(path, selinuxXattr, []byte(attrs.SELinuxContext), 0); err != nil {
+			return fmt.Errorf("Couldn't change SELinux context of the device %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// ApplyDeviceNodeAttributesInNamespace applies the attributes to the device
+// node in the namespace of the executor, e.g. /dev/sdX of the host
+func ApplyDeviceNodeAttributesInNamespace(path string, attrs *DeviceNodeAttributes, ne *NamespaceExecutor) error {
+	if attrs == nil {
+		return nil
+	}
+	if owner := getOwnerArg(attrs.UID, attrs.GID); owner != "" {
+		if _, err := ne.Execute(ChownBinary, []string{owner, path}); err != nil {
+			return fmt.Errorf("Couldn't change owner of the device %s: %v", path, err)
+		}
+	}
+	if attrs.Mode != 0 {
+		mode := strconv.FormatUint(uint64(attrs.Mode.Perm()), 8)
+		if _, err := ne.Execute(ChmodBinary, []string{mode, path}); err != nil {
+			return fmt.Errorf("Couldn't change permission of the device %s: %v", path, err)
+		}
+	}
+	if attrs.SELinuxContext != "" {
+		if _, err := ne.Execute(ChconBinary, []string{attrs.SELinuxContext, path}); err != nil {
+			return fmt.Errorf("Couldn't change SELinux context of the device %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// getOwnerArg returns the owner argument of chown, which is empty if neither
+// is changed
+func getOwnerArg(uid, gid *int) string {
+	switch {
+	case uid != nil && gid != nil:
+		return fmt.Sprintf("%d:%d", *uid, *gid)
+	case uid != nil:
+		return strconv.Itoa(*uid)
+	case gid != nil:
+		return ":" + strconv.Itoa(*gid)
+	}
+	return ""
+}
@@ -0,0 +1,74 @@
+package util
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DMSetupBinary = "dmsetup"
+)
+
+// SuspendDMDevice suspends the device-mapper device. If noFlush is true, the
+// outstanding IO is queued instead of being flushed, which is required when
+// the underlying device cannot serve IO anymore.
+func SuspendDMDevice(name string, noFlush bool, ne *NamespaceExecutor) error {
+	opts := []string{
+		"suspend",
+	}
+	if noFlush {
+		opts = append(opts, "--noflush")
+	}
+	opts = append(opts, name)
+	if _, err := ne.Execute(DMSetupBinary, opts); err != nil {
+		return fmt.Errorf("Failed to suspend device-mapper device %v: %v", name, err)
+	}
+	return nil
+}
+
+// ResumeDMDevice resumes the suspended device-mapper device
+func ResumeDMDevice(name string, ne *NamespaceExecutor) error {
+	if _, err := ne.Execute(DMSetupBinary, []string{"resume", name}); err != nil {
+		return fmt.Errorf("Failed to resume device-mapper device %v: %v", name, err)
+	}
+	return nil
+}
+
+// SuspendDMDeviceDuring pauses the IO of the device-mapper device while fn is
+// running, e.g. swapping the target behind the device, so the filesystem sees
+// a delay instead of IO errors. The device is resumed only after fn returns,
+// since resuming it underneath fn would expose the half-swapped device. If fn
+// runs longer than maxSuspend, it's still waited for and a timeout error is
+// returned after the device is resumed.
+func SuspendDMDeviceDuring(name string, maxSuspend time.Duration, fn func() error, ne *NamespaceExecutor) error {
+	if err := SuspendDMDevice(name, true, ne); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(maxSuspend):
+		logrus.Errorf("The operation on suspended device-mapper device %v is taking longer than %v, IO stays paused until it completes", name, maxSuspend)
+		if fnErr := <-done; fnErr != nil {
+			err = fnErr
+		} else {
+			err = fmt.Errorf("Timeout waiting for the operation on suspended device-mapper device %v after %v", name, maxSuspend)
+		}
+	}
+
+	if resumeErr := ResumeDMDevice(name, ne); resumeErr != nil {
+		logrus.Errorf("Failed to resume device-mapper device %v, IO is still paused: %v", name, resumeErr)
+		if err == nil {
+			err = resumeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,125 @@
+package util
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// FaultInjector is consulted before every command is executed, so the retry
+// and the cleanup logic can be exercised deterministically in the tests
+type FaultInjector interface {
+	// Inject returns a non-nil error to fail the command without running it
+	Inject(binary string, args []string) error
+}
+
+var (
+	faultInjectorLock sync.RWMutex
+	faultInjector     FaultInjector
+)
+
+// SetFaultInjector installs the fault injector for all the commands, and
+// returns the function to restore the previous one. It's meant for tests only.
+func SetFaultInjector(fi FaultInjector) func() {
+	faultInjectorLock.Lock()
+	defer faultInjectorLock.Unlock()
+	previous := faultInjector
+	faultInjector = fi
+	return func() {
+		faultInjectorLock.Lock()
+		defer faultInjectorLock.Unlock()
+		faultInjector = previous
+	}
+}
+
+func injectFault(binary string, args []string) error {
+	faultInjectorLock.RLock()
+	defer faultInjectorLock.RUnlock()
+	if faultInjector == nil {
+		return nil
+	}
+	return faultInjector.Inject(binary, args)
+}
+
+// CommandFault fails the matching commands the way the real failures look,
+// so the callers checking the error messages behave the same
+type CommandFault struct {
+	// Command is the name of the binary, it's also matched against the
+	// arguments so the commands executed in a namespace are matched
+	Command string
+	// Args must all be present in the arguments of the command
+	Args []string
+	// ExitCode fails the command with the exit status
+	ExitCode int
+	// Timeout fails the command as it timed out, ExitCode is ignored
+	Timeout bool
+	// Count is the number of the times to inject the fault, 0 for always
+	Count int
+
+	injected int
+}
+
+func (f *CommandFault) matches(binary string, args []string) bool {
+	if f.Count != 0 && f.injected >= f.Count {
+		return false
+	}
+	found := filepath.Base(binary) == f.Command
+	for _, arg := range args {
+		if found {
+			break
+		}
+		found = filepath.Base(arg) == f.Command
+	}
+	if !found {
+		return false
+	}
+	for _, expected := range f.Args {
+		present := false
+		for _, arg := range args {
+			if arg == expected {
+				present = true
+				break
+			}
+		}
+		if !present {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *CommandFault) err(binary string, args []string) error {
+	if f.Timeout {
+		return fmt.Errorf("Timeout executing: %v %v, output , stderr, injected fault, error <nil>", binary, args)
+	}
+	return fmt.Errorf("Failed to execute: %v %v, output , stderr, injected fault, error exit status %v", binary, args, f.ExitCode)
+}
+
+// CommandFaults is a FaultInjector injecting the first matching fault
+type CommandFaults struct {
+	lock   sync.Mutex
+	faults []*CommandFault
+	// Injected records the command lines of the injected faults
+	Injected []string
+}
+
+func NewCommandFaults(faults ...*CommandFault) *CommandFaults {
+	return &CommandFaults{
+		faults:   faults,
+		Injected: []string{},
+	}
+}
+
+func (c *CommandFaults) Inject(binary string, args []string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, f := range c.faults {
+		if f.matches(binary, args) {
+			f.injected++
+			c.Injected = append(c.Injected, strings.Join(append([]string{binary}, args...), " "))
+			return f.err(binary, args)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package util
+
+import (
+	"bufio"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ProcLocksFile lists the file locks of the system, the PIDs of the holders
+// not in the PID namespace of the caller are not visible
+var ProcLocksFile = "/proc/locks"
+
+// IsFlocked returns true if the file of the inode is locked by flock. The
+// holders not in the PID namespace of the caller count as well.
+func IsFlocked(inode uint64) (bool, error) {
+	data, err := ioutil.ReadFile(ProcLocksFile)
+	if err != nil {
+		return false, err
+	}
+	return len(parseFlockHolders(string(data), inode)) != 0, nil
+}
+
+// GetFlockHolders returns the PIDs of the processes holding flock on the file
+// of the inode, in the PID namespace of the proc filesystem mounted at
+// procPath, e.g. the HostProc of iscsidev. The holders not visible in the
+// namespace are skipped.
+func GetFlockHolders(procPath string, inode uint64) ([]int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(procPath, "locks"))
+	if err != nil {
+		return nil, err
+	}
+	pids := []int{}
+	for _, pid := range parseFlockHolders(string(data), inode) {
+		if pid > 0 {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// parseFlockHolders returns the PIDs of the flock holders of the inode, which
+// are 0 if not visible
+func parseFlockHolders(output string, inode uint64) []int {
+	/* Output will looks like:
+	1: FLOCK  ADVISORY  WRITE 2371 00:2e:1048611 0 EOF
+	1: -> FLOCK  ADVISORY  WRITE 2380 00:2e:1048611 0 EOF
+	2: POSIX  ADVISORY  WRITE 812 fd:01:2359301 0 EOF
+	*/
+	pids := []int{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// The blocked waiters are marked by "->"
+		if len(fields) < 6 || fields[1] != "FLOCK" {
+			continue
+		}
+		ids := strings.Split(fields[5], ":")
+		if ids[len(ids)-1] != strconv.FormatUint(inode, 10) {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[4])
+		if err != nil {
+			continue
+		}
+		pids = append(pids, pid)
+	}
+	return pids
+}
@@ -0,0 +1,87 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	FSFreezeBinary = "fsfreeze"
+)
+
+// FreezeFilesystem freezes the filesystem mounted at the mount point, which
+// flushes the dirty data and blocks the new writes. fsfreeze is killed after
+// the timeout, e.g. if the device cannot serve IO, and the filesystem is thawed
+// in case the freeze took effect anyway.
+func FreezeFilesystem(mountpoint string, timeout time.Duration, ne *NamespaceExecutor) error {
+	if _, err := ne.ExecuteWithTimeout(timeout, FSFreezeBinary, []string{"-f", mountpoint}); err != nil {
+		if thawErr := UnfreezeFilesystem(mountpoint, ne); thawErr != nil {
+			logrus.Warnf("Failed to thaw filesystem %v after the failed freeze: %v", mountpoint, thawErr)
+		}
+		return fmt.Errorf("Failed to freeze filesystem %v: %v", mountpoint, err)
+	}
+	return nil
+}
+
+// UnfreezeFilesystem thaws the filesystem. It's a no-op if the filesystem is
+// not frozen.
+func UnfreezeFilesystem(mountpoint string, ne *NamespaceExecutor) error {
+	if _, err := ne.Execute(FSFreezeBinary, []string{"-u", mountpoint}); err != nil {
+		// The kernel returns EINVAL if the filesystem is not frozen
+		if strings.Contains(err.Error(), "Invalid argument") {
+			return nil
+		}
+		return fmt.Errorf("Failed to thaw filesystem %v: %v", mountpoint, err)
+	}
+	return nil
+}
+
+// FreezeFilesystemsDuring freezes the filesystems while fn is running, e.g.
+// swapping the backing store or taking a snapshot, so the data is at a
+// consistent point. The filesystems are always thawed after fn returns, or as
+// soon as maxFreeze is reached, in which case fn keeps running in the
+// background and a timeout error is returned.
+func FreezeFilesystemsDuring(mountpoints []string, maxFreeze time.Duration, fn func() error, ne *NamespaceExecutor) error {
+	deadline := time.Now().Add(maxFreeze)
+	frozen := []string{}
+	thaw := func() error {
+		var err error
+		for _, mountpoint := range frozen {
+			if thawErr := UnfreezeFilesystem(mountpoint, ne); thawErr != nil {
+				logrus.Errorf("Failed to thaw filesystem %v, writes are still blocked: %v", mountpoint, thawErr)
+				if err == nil {
+					err = thawErr
+				}
+			}
+		}
+		return err
+	}
+
+	for _, mountpoint := range mountpoints {
+		if err := FreezeFilesystem(mountpoint, time.Until(deadline), ne); err != nil {
+			thaw()
+			return err
+		}
+		frozen = append(frozen, mountpoint)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(time.Until(deadline)):
+		err = fmt.Errorf("Timeout waiting for the operation on frozen filesystems %v after %v", mountpoints, maxFreeze)
+	}
+
+	if thawErr := thaw(); thawErr != nil && err == nil {
+		err = thawErr
+	}
+	return err
+}
@@ -0,0 +1,273 @@
+package util
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrDeviceInUse is wrapped by DeviceInUseError, so it can be checked by
+// errors.Is
+var ErrDeviceInUse = errors.New("device is in use")
+
+// DeviceInUseError lists the users of the device found by CheckDeviceInUse
+type DeviceInUseError struct {
+	Device string
+	// Holders are the partitions of the device and the devices stacked on
+	// them, e.g. dm-crypt or LVM
+	Holders []string
+	// Mounts are the mount points of the device and its holders
+	Mounts []string
+	// Processes are the PIDs holding the device or its holders open
+	Processes []string
+}
+
+func (e *DeviceInUseError) Error() string {
+	return fmt.Sprintf("device %v is in use: holders %v, mounts %v, processes %v",
+		e.Device, e.Holders, e.Mounts, e.Processes)
+}
+
+func (e *DeviceInUseError) Unwrap() error {
+	return ErrDeviceInUse
+}
+
+// DeviceMount is a mount of the device or its holders
+type DeviceMount struct {
+	// Device is the major:minor of the mounted device
+	Device     string
+	MountPoint string
+	// Local is true if the mount is in the mount namespace of the executor,
+	// otherwise MountPoint is only valid in the mount namespace of another
+	// process, e.g. a container
+	Local bool
+}
+
+// CheckDeviceInUse returns a DeviceInUseError if the device, any partition of
+// it or any device stacked on them, is mounted in any mount namespace or held
+// open by any process visible in the namespace of ne. The devices are matched
+// by major:minor instead of the paths, so the users through the other device
+// nodes, e.g. /dev/longhorn/<volume> or the by-id links, are found as well.
+func CheckDeviceInUse(dev *KernelDevice, ne *NamespaceExecutor) error {
+	holders, numbers, err := getStackedDevices(dev, ne)
+	if err != nil {
+		return err
+	}
+
+	deviceMounts, err := findDeviceMounts(numbers, ne)
+	if err != nil {
+		return err
+	}
+	mounts := []string{}
+	seen := map[string]struct{}{}
+	for _, m := range deviceMounts {
+		if _, exists := seen[m.MountPoint]; exists {
+			continue
+		}
+		seen[m.MountPoint] = struct{}{}
+		mounts = append(mounts, m.MountPoint)
+	}
+
+	processes, err := findOpeners(numbers, ne)
+	if err != nil {
+		return err
+	}
+
+	if len(mounts) == 0 && len(processes) == 0 {
+		return nil
+	}
+	return &DeviceInUseError{
+		Device:    dev.Name,
+		Holders:   holders,
+		Mounts:    mounts,
+		Processes: processes,
+	}
+}
+
+// GetDeviceMounts returns the mounts of the device, or any partition of it or
+// any device stacked on them, in all the mount namespaces. Each mount is
+// reported once per device and mount point.
+func GetDeviceMounts(dev *KernelDevice, ne *NamespaceExecutor) ([]*DeviceMount, error) {
+	_, numbers, err := getStackedDevices(dev, ne)
+	if err != nil {
+		return nil, err
+	}
+	return findDeviceMounts(numbers, ne)
+}
+
+// getStackedDevices returns the partitions of the device and the devices
+// stacked on them recursively, and the major:minor of all of them including
+// the device itself
+func getStackedDevices(dev *KernelDevice, ne *NamespaceExecutor) ([]string, map[string]struct{}, error) {
+	numbers := map[string]struct{}{
+		fmt.Sprintf("%d:%d", dev.Major, dev.Minor): {},
+	}
+	holders, err := getDeviceHolders(dev.Name, ne)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, holder := range holders {
+		output, err := ne.Execute("cat", []string{filepath.Join("/sys/class/block", holder, "dev")})
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to get device number of %v: %v", holder, err)
+		}
+		numbers[strings.TrimSpace(output)] = struct{}{}
+	}
+	return holders, numbers, nil
+}
+
+// getDeviceHolders returns the partitions of the device and the devices
+// stacked on them recursively
+func getDeviceHolders(name string, ne *NamespaceExecutor) ([]string, error) {
+	sysDir := filepath.Join("/sys/class/block", name)
+	output, err := ne.Execute("ls", []string{filepath.Join(sysDir, "holders")})
+	if err != nil {
+		return nil, err
+	}
+	stacked := strings.Fields(output)
+	// The partitions are the subdirectories named after the device
+	output, err = ne.Execute("ls", []string{sysDir + "/"})
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range strings.Fields(output) {
+		if strings.HasPrefix(entry, name) && entry != name {
+			stacked = append(stacked, entry)
+		}
+	}
+
+	holders := []string{}
+	for _, holder := range stacked {
+		nested, err := getDeviceHolders(holder, ne)
+		if err != nil {
+			return nil, err
+		}
+		holders = append(holders, holder)
+		holders = append(holders, nested...)
+	}
+	return holders, nil
+}
+
+// findDeviceMounts scans the mountinfo of the namespace of ne and all the
+// processes for the mounts of the devices
+func findDeviceMounts(numbers map[string]struct{}, ne *NamespaceExecutor) ([]*DeviceMount, error) {
+	// The processes may exit during the scan, ignore the errors of grep
+	cmd := "grep -H -s -F"
+	for number := range numbers {
+		cmd += " -e " + ShellQuote(" "+number+" ")
+	}
+	cmd += " /proc/self/mountinfo /proc/[0-9]*/mountinfo; true"
+	output, err := ne.Execute("sh", []string{"-c", cmd})
+	if err != nil {
+		return nil, err
+	}
+	return parseDeviceMounts(output, numbers), nil
+}
+
+func parseDeviceMounts(output string, numbers map[string]struct{}) []*DeviceMount {
+	/* Output will looks like:
+	/proc/self/mountinfo:36 25 8:16 / /var/lib/data rw,relatime shared:1 - ext4 /dev/sdb rw
+	/proc/2371/mountinfo:512 480 8:16 / /data rw,relatime - ext4 /dev/sdb rw
+	*/
+	res := []*DeviceMount{}
+	seen := map[string]*DeviceMount{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		fields := strings.Fields(parts[1])
+		if len(fields) < 5 {
+			continue
+		}
+		if _, exists := numbers[fields[2]]; !exists {
+			continue
+		}
+		local := parts[0] == "/proc/self/mountinfo"
+		key := fields[2] + " " + fields[4]
+		if m, exists := seen[key]; exists {
+			m.Local = m.Local || local
+			continue
+		}
+		m := &DeviceMount{
+			Device:     fields[2],
+			MountPoint: unescapeMountInfo(fields[4]),
+			Local:      local,
+		}
+		seen[key] = m
+		res = append(res, m)
+	}
+	return res
+}
+
+// unescapeMountInfo decodes the octal escapes of the space, tab, newline and
+// backslash in the mountinfo fields
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	res := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				res.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		res.WriteByte(s[i])
+	}
+	return res.String()
+}
+
+// findOpeners returns the PIDs of the processes holding the devices open
+func findOpeners(numbers map[string]struct{}, ne *NamespaceExecutor) ([]string, error) {
+	// The processes may exit during the scan, ignore the errors of find
+	cmd := "find /proc/[0-9]*/fd -mindepth 1 -maxdepth 1 -xtype b -exec stat -L -c '%n %t %T' {} + 2>/dev/null; true"
+	output, err := ne.Execute("sh", []string{"-c", cmd})
+	if err != nil {
+		return nil, err
+	}
+	return parseOpeners(output, numbers), nil
+}
+
+func parseOpeners(output string, numbers map[string]struct{}) []string {
+	/* Output will looks like, with the major and minor in hex:
+	/proc/123/fd/4 8 10
+	*/
+	pids := map[string]struct{}{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		// /proc/<pid>/fd/<fd>
+		path := strings.Split(fields[0], "/")
+		if len(path) != 5 || path[1] != "proc" || path[3] != "fd" {
+			continue
+		}
+		major, err := strconv.ParseUint(fields[1], 16, 32)
+		if err != nil {
+			continue
+		}
+		minor, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil {
+			continue
+		}
+		if _, exists := numbers[fmt.Sprintf("%d:%d", major, minor)]; !exists {
+			continue
+		}
+		pids[path[2]] = struct{}{}
+	}
+	res := []string{}
+	for pid := range pids {
+		res = append(res, pid)
+	}
+	sort.Strings(res)
+	return res
+}
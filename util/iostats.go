@@ -0,0 +1,236 @@
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	sectorSize = 512
+)
+
+var (
+	SysBlockPath = "/sys/block"
+)
+
+// blockStat is the counters in /sys/block/<dev>/stat, see
+// Documentation/block/stat.txt of the kernel
+type blockStat struct {
+	ReadIOs      uint64
+	ReadSectors  uint64
+	ReadTicks    uint64
+	WriteIOs     uint64
+	WriteSectors uint64
+	WriteTicks   uint64
+	InFlight     uint64
+}
+
+// IOStats is the IO statistics of a device over the last sampling interval
+type IOStats struct {
+	Device    string
+	Timestamp time.Time
+
+	ReadIOPS         float64
+	WriteIOPS        float64
+	ReadBytesPerSec  float64
+	WriteBytesPerSec float64
+	ReadLatency      time.Duration
+	WriteLatency     time.Duration
+	InFlightRequests uint64
+}
+
+func parseBlockStat(content string) (*blockStat, error) {
+	fields := strings.Fields(content)
+	if len(fields) < 11 {
+		return nil, fmt.Errorf("invalid block stat %v", content)
+	}
+	values := make([]uint64, 11)
+	for i := range values {
+		v, err := strconv.ParseUint(fields[i], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid block stat %v: %v", content, err)
+		}
+		values[i] = v
+	}
+	return &blockStat{
+		ReadIOs:      values[0],
+		ReadSectors:  values[2],
+		ReadTicks:    values[3],
+		WriteIOs:     values[4],
+		WriteSectors: values[6],
+		WriteTicks:   values[7],
+		InFlight:     values[8],
+	}, nil
+}
+
+func readBlockStat(device string) (*blockStat, error) {
+	content, err := ioutil.ReadFile(filepath.Join(SysBlockPath, device, "stat"))
+	if err != nil {
+		return nil, err
+	}
+	return parseBlockStat(string(content))
+}
+
+func latency(ticks, ios uint64) time.Duration {
+	if ios == 0 {
+		return 0
+	}
+	return time.Duration(ticks) * time.Millisecond / time.Duration(ios)
+}
+
+func calculateIOStats(device string, prev, cur *blockStat, interval time.Duration) *IOStats {
+	seconds := interval.Seconds()
+	readIOs := cur.ReadIOs - prev.ReadIOs
+	writeIOs := cur.WriteIOs - prev.WriteIOs
+	return &IOStats{
+		Device:           device,
+		ReadIOPS:         float64(readIOs) / seconds,
+		WriteIOPS:        float64(writeIOs) / seconds,
+		ReadBytesPerSec:  float64((cur.ReadSectors-prev.ReadSectors)*sectorSize) / seconds,
+		WriteBytesPerSec: float64((cur.WriteSectors-prev.WriteSectors)*sectorSize) / seconds,
+		ReadLatency:      latency(cur.ReadTicks-prev.ReadTicks, readIOs),
+		WriteLatency:     latency(cur.WriteTicks-prev.WriteTicks, writeIOs),
+		InFlightRequests: cur.InFlight,
+	}
+}
+
+// IOStatsCollector periodically samples the block stat of the registered
+// devices in the background, and calculates the per volume IOPS, throughput
+// and average latency
+type IOStatsCollector struct {
+	*sync.RWMutex
+	interval time.Duration
+
+	devices  map[string]string
+	samples  map[string]*blockStat
+	lastTime map[string]time.Time
+	stats    map[string]*IOStats
+
+	stopCh chan struct{}
+}
+
+func NewIOStatsCollector(interval time.Duration) *IOStatsCollector {
+	return &IOStatsCollector{
+		RWMutex:  &sync.RWMutex{},
+		interval: interval,
+		devices:  map[string]string{},
+		samples:  map[string]*blockStat{},
+		lastTime: map[string]time.Time{},
+		stats:    map[string]*IOStats{},
+	}
+}
+
+// AddDevice starts collecting the stats of the kernel device, e.g. sdb, for
+// the volume
+func (c *IOStatsCollector) AddDevice(volume, device string) {
+	c.Lock()
+	defer c.Unlock()
+	if c.devices[volume] != device {
+		c.clearVolume(volume)
+	}
+	c.devices[volume] = device
+}
+
+func (c *IOStatsCollector) RemoveDevice(volume string) {
+	c.Lock()
+	defer c.Unlock()
+	c.clearVolume(volume)
+	delete(c.devices, volume)
+}
+
+// call with lock hold
+func (c *IOStatsCollector) clearVolume(volume string) {
+	delete(c.samples, volume)
+	delete(c.lastTime, volume)
+	delete(c.stats, volume)
+}
+
+// GetStats returns the stats of the last interval. It's available after the
+// device has been sampled twice.
+func (c *IOStatsCollector) GetStats(volume string) (*IOStats, error) {
+	c.RLock()
+	defer c.RUnlock()
+	if _, exists := c.devices[volume]; !exists {
+		return nil, fmt.Errorf("volume %v is not being collected", volume)
+	}
+	stats, exists := c.stats[volume]
+	if !exists {
+		return nil, fmt.Errorf("stats of volume %v is not available yet", volume)
+	}
+	res := *stats
+	return &res, nil
+}
+
+// GetAllStats returns the stats of all the volumes available
+func (c *IOStatsCollector) GetAllStats() map[string]*IOStats {
+	c.RLock()
+	defer c.RUnlock()
+	res := map[string]*IOStats{}
+	for volume, stats := range c.stats {
+		s := *stats
+		res[volume] = &s
+	}
+	return res
+}
+
+func (c *IOStatsCollector) Start() {
+	c.Lock()
+	defer c.Unlock()
+	if c.stopCh != nil {
+		return
+	}
+	c.stopCh = make(chan struct{})
+	go c.run(c.stopCh)
+}
+
+func (c *IOStatsCollector) Stop() {
+	c.Lock()
+	defer c.Unlock()
+	if c.stopCh == nil {
+		return
+	}
+	close(c.stopCh)
+	c.stopCh = nil
+}
+
+func (c *IOStatsCollector) run(stopCh chan struct{}) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	c.sample()
+	for {
+		select {
+		case <-ticker.C:
+			c.sample()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (c *IOStatsCollector) sample() {
+	c.Lock()
+	defer c.Unlock()
+	for volume, device := range c.devices {
+		now := time.Now()
+		cur, err := readBlockStat(device)
+		if err != nil {
+			logrus.Debugf("Failed to read block stat of device %v for volume %v: %v", device, volume, err)
+			c.clearVolume(volume)
+			continue
+		}
+		if prev, exists := c.samples[volume]; exists {
+			stats := calculateIOStats(device, prev, cur, now.Sub(c.lastTime[volume]))
+			stats.Timestamp = now
+			c.stats[volume] = stats
+		}
+		c.samples[volume] = cur
+		c.lastTime[volume] = now
+	}
+}
@@ -0,0 +1,39 @@
+package util
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// ResolveDeviceName returns the kernel name of the device node in the
+// namespace of ne, following the symlinks, e.g. /dev/disk/by-id/* or
+// /dev/mapper/*
+func ResolveDeviceName(path string, ne *NamespaceExecutor) (string, error) {
+	output, err := ne.Execute("readlink", []string{"-f", path})
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(strings.TrimSpace(output)), nil
+}
+
+// GetDeviceSlaves returns the bottom devices the device is stacked on, e.g.
+// the SCSI devices under a dm device, or nil if it's not stacked
+func GetDeviceSlaves(name string, ne *NamespaceExecutor) ([]string, error) {
+	output, err := ne.Execute("ls", []string{filepath.Join(SysBlockPath, name, "slaves")})
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, slave := range strings.Fields(output) {
+		stacked, err := GetDeviceSlaves(slave, ne)
+		if err != nil {
+			return nil, err
+		}
+		if len(stacked) == 0 {
+			res = append(res, slave)
+			continue
+		}
+		res = append(res, stacked...)
+	}
+	return res, nil
+}
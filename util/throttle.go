@@ -0,0 +1,95 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	cgroupIOMaxFile = "io.max"
+	ioMaxUnlimited  = "max"
+)
+
+// IOLimits are the cgroup v2 io.max limits of a device, 0 means unlimited
+type IOLimits struct {
+	ReadBPS   uint64
+	WriteBPS  uint64
+	ReadIOPS  uint64
+	WriteIOPS uint64
+}
+
+func formatIOLimit(limit uint64) string {
+	if limit == 0 {
+		return ioMaxUnlimited
+	}
+	return strconv.FormatUint(limit, 10)
+}
+
+func (l *IOLimits) String() string {
+	return fmt.Sprintf("rbps=%s wbps=%s riops=%s wiops=%s",
+		formatIOLimit(l.ReadBPS), formatIOLimit(l.WriteBPS), formatIOLimit(l.ReadIOPS), formatIOLimit(l.WriteIOPS))
+}
+
+// SetDeviceIOLimits throttles the IO of the processes in the cgroup, and all
+// its descendants, to the device. cgroup is the directory of a non-root cgroup
+// v2 in the namespace of ne, whose parent enables the io controller. nil
+// limits remove the throttling.
+func SetDeviceIOLimits(cgroup string, dev *KernelDevice, limits *IOLimits, ne *NamespaceExecutor) error {
+	if limits == nil {
+		limits = &IOLimits{}
+	}
+	path := filepath.Join(cgroup, cgroupIOMaxFile)
+	value := fmt.Sprintf("%d:%d %s", dev.Major, dev.Minor, limits)
+	if _, err := ne.ExecuteWithStdin("tee", []string{path}, value); err != nil {
+		return fmt.Errorf("Failed to set IO limits %v of device %v in %v: %v", limits, dev.Name, path, err)
+	}
+	return nil
+}
+
+// GetDeviceIOLimits returns the limits of the device in the cgroup
+func GetDeviceIOLimits(cgroup string, dev *KernelDevice, ne *NamespaceExecutor) (*IOLimits, error) {
+	output, err := ne.Execute("cat", []string{filepath.Join(cgroup, cgroupIOMaxFile)})
+	if err != nil {
+		return nil, err
+	}
+	return parseIOMax(output, dev.Major, dev.Minor)
+}
+
+// parseIOMax parses io.max, which has a line per limited device like:
+//
+//	8:16 rbps=2097152 wbps=max riops=max wiops=120
+func parseIOMax(output string, major, minor int) (*IOLimits, error) {
+	limits := &IOLimits{}
+	device := fmt.Sprintf("%d:%d", major, minor)
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] != device {
+			continue
+		}
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 || kv[1] == ioMaxUnlimited {
+				continue
+			}
+			value, err := strconv.ParseUint(kv[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid IO limit %v of device %v: %v", field, device, err)
+			}
+			switch kv[0] {
+			case "rbps":
+				limits.ReadBPS = value
+			case "wbps":
+				limits.WriteBPS = value
+			case "riops":
+				limits.ReadIOPS = value
+			case "wiops":
+				limits.WriteIOPS = value
+			}
+		}
+	}
+	return limits, nil
+}
@@ -0,0 +1,181 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	UeventActionAdd    = "add"
+	UeventActionRemove = "remove"
+	UeventActionChange = "change"
+
+	ueventBufferSize   = 64 * 1024
+	ueventKernelGroup  = 1
+	ueventReadTimeout  = time.Second
+	ueventChannelDepth = 128
+)
+
+// Uevent is a kernel object event received through netlink
+type Uevent struct {
+	Action    string
+	DevPath   string
+	Subsystem string
+	DevName   string
+	Env       map[string]string
+}
+
+// UeventMonitor receives the kernel uevents in the background
+type UeventMonitor struct {
+	fd     int
+	events chan *Uevent
+	done   chan struct{}
+}
+
+// NewUeventMonitor subscribes to the kernel uevents. The uevents may not be
+// delivered to a non-host network namespace, so the callers should always be
+// prepared to fall back to polling.
+func NewUeventMonitor() (*UeventMonitor, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create uevent socket: %v", err)
+	}
+	addr := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: ueventKernelGroup,
+	}
+	if err := unix.Bind(fd, addr); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("Failed to bind uevent socket: %v", err)
+	}
+	// Wake up periodically so the monitor can be closed
+	tv := unix.NsecToTimeval(ueventReadTimeout.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("Failed to set uevent socket timeout: %v", err)
+	}
+
+	m := &UeventMonitor{
+		fd:     fd,
+		events: make(chan *Uevent, ueventChannelDepth),
+		done:   make(chan struct{}),
+	}
+	go m.run()
+	return m, nil
+}
+
+// Events returns the channel of the uevents. It's closed after the monitor
+// is closed.
+func (m *UeventMonitor) Events() <-chan *Uevent {
+	return m.events
+}
+
+func (m *UeventMonitor) Close() {
+	close(m.done)
+}
+
+func (m *UeventMonitor) run() {
+	defer close(m.events)
+	defer unix.Close(m.fd)
+
+	buf := make([]byte, ueventBufferSize)
+	for {
+		select {
+		case <-m.done:
+			return
+		default:
+		}
+
+		n, _, err := unix.Recvfrom(m.fd, buf, 0)
+		if err != nil {
+			if err == unix.EAGAIN || err == unix.EINTR {
+				continue
+			}
+			logrus.Warnf("Failed to receive uevent, stop monitoring: %v", err)
+			return
+		}
+		event, err := parseUevent(buf[:n])
+		if err != nil {
+			logrus.Debugf("Skip invalid uevent: %v", err)
+			continue
+		}
+		select {
+		case m.events <- event:
+		case <-m.done:
+			return
+		default:
+			logrus.Debugf("Drop uevent %v %v since the consumer is too slow", event.Action, event.DevPath)
+		}
+	}
+}
+
+func parseUevent(buf []byte) (*Uevent, error) {
+	/* The message looks like, separated by \0:
+	add@/devices/platform/host3/session1/target3:0:0/3:0:0:1/block/sdb
+	ACTION=add
+	DEVPATH=/devices/platform/host3/session1/target3:0:0/3:0:0:1/block/sdb
+	SUBSYSTEM=block
+	DEVNAME=sdb
+	...
+	*/
+	fields := bytes.Split(bytes.TrimRight(buf, "\x00"), []byte{0})
+	if len(fields) < 2 || !bytes.Contains(fields[0], []byte("@")) {
+		return nil, fmt.Errorf("unknown uevent header %q", fields[0])
+	}
+	event := &Uevent{
+		Env: map[string]string{},
+	}
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(string(field), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		event.Env[kv[0]] = kv[1]
+	}
+	event.Action = event.Env["ACTION"]
+	event.DevPath = event.Env["DEVPATH"]
+	event.Subsystem = event.Env["SUBSYSTEM"]
+	event.DevName = event.Env["DEVNAME"]
+	return event, nil
+}
+
+// WaitForCondition waits until check returns true or timeout. check is
+// evaluated immediately, then whenever a uevent accepted by filter arrives or
+// pollInterval elapses. If monitor is nil, it's pure polling.
+func WaitForCondition(timeout, pollInterval time.Duration, monitor *UeventMonitor, filter func(*Uevent) bool, check func() bool) bool {
+	if check() {
+		return true
+	}
+
+	var events <-chan *Uevent
+	if monitor != nil {
+		events = monitor.Events()
+	}
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				// Fall back to polling only
+				events = nil
+				continue
+			}
+			if filter != nil && !filter(event) {
+				continue
+			}
+		case <-ticker.C:
+		case <-deadline:
+			return check()
+		}
+		if check() {
+			return true
+		}
+	}
+}
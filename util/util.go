@@ -21,6 +21,17 @@ const (
 	LSBLKBinary = "lsblk"
 )
 
+// HostBinaries are executed by the helpers of the package through
+// NamespaceExecutor, while NSBinary runs in the namespace of the caller
+var HostBinaries = []string{
+	LSBLKBinary,
+	FSFreezeBinary,
+	DMSetupBinary,
+	ChownBinary,
+	ChmodBinary,
+	ChconBinary,
+}
+
 var (
 	cmdTimeout = time.Minute // one minute by default
 )
@@ -74,7 +85,10 @@ func GetIPToHost() (string, error) {
 }
 
 type NamespaceExecutor struct {
-	ns string
+	ns       string
+	root     string
+	netNS    string
+	recorder func(cmd string)
 }
 
 func NewNamespaceExecutor(ns string) (*NamespaceExecutor, error) {
@@ -99,41 +113,129 @@ func NewNamespaceExecutor(ns string) (*NamespaceExecutor, error) {
 	return ne, nil
 }
 
+// SetCommandRecorder sets the function to be called with the command line of
+// every command executed by ne, e.g. to report the commands of an operation
+func (ne *NamespaceExecutor) SetCommandRecorder(recorder func(cmd string)) {
+	ne.recorder = recorder
+}
+
+// SetNetworkNamespace makes ne run the commands in the network namespace at
+// netNS instead of the one of ns, e.g. /var/run/netns/storage for the storage
+// traffic isolated into a dedicated network namespace. The mount namespace is
+// not changed. nsenter opens netNS before switching the namespaces, so the
+// path is the one seen by the caller, e.g. /host/var/run/netns/storage in a
+// container with the host /var/run mounted at /host/var/run. It's not
+// validated, see ValidateNetworkNamespace.
+func (ne *NamespaceExecutor) SetNetworkNamespace(netNS string) {
+	ne.netNS = netNS
+}
+
+// ValidateNetworkNamespace verifies the network namespace at netNS, in the
+// path seen by the caller, can be entered
+func ValidateNetworkNamespace(netNS string) error {
+	if _, err := Execute(NSBinary, []string{"--net=" + netNS, "true"}); err != nil {
+		return fmt.Errorf("Invalid net namespace %v, error %v", netNS, err)
+	}
+	return nil
+}
+
+// isLocal returns true if the commands run in the namespaces of the caller
+func (ne *NamespaceExecutor) isLocal() bool {
+	return ne.ns == "" && ne.netNS == ""
+}
+
+func (ne *NamespaceExecutor) record(name string, args []string) {
+	if ne.recorder != nil {
+		ne.recorder(strings.Join(append([]string{name}, args...), " "))
+	}
+}
+
+// NewNamespaceExecutorWithChroot returns the executor running the commands
+// chrooted into the root directory of the process owning the namespaces as
+// well, so the binaries and the config files installed on the host are used
+// even if the container has conflicting copies
+func NewNamespaceExecutorWithChroot(ns string) (*NamespaceExecutor, error) {
+	if ns == "" {
+		return nil, fmt.Errorf("Cannot chroot without namespace")
+	}
+	ne, err := NewNamespaceExecutor(ns)
+	if err != nil {
+		return nil, err
+	}
+	// ns is in the /proc/<pid>/ns format
+	root := filepath.Join(filepath.Dir(filepath.Clean(ns)), "root")
+	if _, err := Execute(NSBinary, []string{"--mount=" + filepath.Join(ns, "mnt"), "--root=" + root, "true"}); err != nil {
+		return nil, fmt.Errorf("Invalid root directory %v, error %v", root, err)
+	}
+	ne.root = root
+	return ne, nil
+}
+
 func (ne *NamespaceExecutor) prepareCommandArgs(name string, args []string) []string {
-	cmdArgs := []string{
-		"--mount=" + filepath.Join(ne.ns, "mnt"),
-		"--net=" + filepath.Join(ne.ns, "net"),
-		name,
+	cmdArgs := []string{}
+	if ne.ns != "" {
+		cmdArgs = append(cmdArgs, "--mount="+filepath.Join(ne.ns, "mnt"))
+	}
+	if ne.netNS != "" {
+		cmdArgs = append(cmdArgs, "--net="+ne.netNS)
+	} else if ne.ns != "" {
+		cmdArgs = append(cmdArgs, "--net="+filepath.Join(ne.ns, "net"))
 	}
+	if ne.root != "" {
+		cmdArgs = append(cmdArgs, "--root="+ne.root, "--wd="+ne.root)
+	}
+	cmdArgs = append(cmdArgs, name)
 	return append(cmdArgs, args...)
 }
 
 func (ne *NamespaceExecutor) Execute(name string, args []string) (string, error) {
-	if ne.ns == "" {
+	ne.record(name, args)
+	if ne.isLocal() {
 		return Execute(name, args)
 	}
 	return Execute(NSBinary, ne.prepareCommandArgs(name, args))
 }
 
 func (ne *NamespaceExecutor) ExecuteWithTimeout(timeout time.Duration, name string, args []string) (string, error) {
-	if ne.ns == "" {
+	ne.record(name, args)
+	if ne.isLocal() {
 		return ExecuteWithTimeout(timeout, name, args)
 	}
 	return ExecuteWithTimeout(timeout, NSBinary, ne.prepareCommandArgs(name, args))
 }
 
 func (ne *NamespaceExecutor) ExecuteWithoutTimeout(name string, args []string) (string, error) {
-	if ne.ns == "" {
+	ne.record(name, args)
+	if ne.isLocal() {
 		return ExecuteWithoutTimeout(name, args)
 	}
 	return ExecuteWithoutTimeout(NSBinary, ne.prepareCommandArgs(name, args))
 }
 
+// LookPath searches for the binary in the namespace of ne
+func (ne *NamespaceExecutor) LookPath(binary string) (string, error) {
+	if ne.ns == "" {
+		return exec.LookPath(binary)
+	}
+	output, err := ne.Execute("sh", []string{"-c", "command -v " + ShellQuote(binary)})
+	if err != nil {
+		return "", fmt.Errorf("Cannot find %v in namespace %v: %v", binary, ne.ns, err)
+	}
+	return strings.TrimSpace(output), nil
+}
+
 func Execute(binary string, args []string) (string, error) {
 	return ExecuteWithTimeout(cmdTimeout, binary, args)
 }
 
 func ExecuteWithTimeout(timeout time.Duration, binary string, args []string) (string, error) {
+	if err := checkCommandArgs(binary, args); err != nil {
+		return "", err
+	}
+	if err := injectFault(binary, args); err != nil {
+		return "", err
+	}
+
 	var err error
 	cmd := exec.Command(binary, args...)
 	done := make(chan struct{})
@@ -170,6 +272,13 @@ func ExecuteWithTimeout(timeout time.Duration, binary string, args []string) (st
 // TODO: Merge this with ExecuteWithTimeout
 
 func ExecuteWithoutTimeout(binary string, args []string) (string, error) {
+	if err := checkCommandArgs(binary, args); err != nil {
+		return "", err
+	}
+	if err := injectFault(binary, args); err != nil {
+		return "", err
+	}
+
 	var err error
 	var output, stderr bytes.Buffer
 
@@ -185,19 +294,21 @@ func ExecuteWithoutTimeout(binary string, args []string) (string, error) {
 }
 
 func (ne *NamespaceExecutor) ExecuteWithStdin(name string, args []string, stdinString string) (string, error) {
-	if ne.ns == "" {
+	ne.record(name, args)
+	if ne.isLocal() {
 		return ExecuteWithStdin(name, args, stdinString)
 	}
-	cmdArgs := []string{
-		"--mount=" + filepath.Join(ne.ns, "mnt"),
-		"--net=" + filepath.Join(ne.ns, "net"),
-		name,
-	}
-	cmdArgs = append(cmdArgs, args...)
-	return ExecuteWithStdin(NSBinary, cmdArgs, stdinString)
+	return ExecuteWithStdin(NSBinary, ne.prepareCommandArgs(name, args), stdinString)
 }
 
 func ExecuteWithStdin(binary string, args []string, stdinString string) (string, error) {
+	if err := checkCommandArgs(binary, args); err != nil {
+		return "", err
+	}
+	if err := injectFault(binary, args); err != nil {
+		return "", err
+	}
+
 	var err error
 	cmd := exec.Command(binary, args...)
 	done := make(chan struct{})
@@ -305,13 +416,19 @@ func GetKnownDevices(ne *NamespaceExecutor) (map[string]*KernelDevice, error) {
 }
 
 func DuplicateDevice(dev *KernelDevice, dest string) error {
+	return DuplicateDeviceWithAttributes(dev, dest, nil)
+}
+
+// DuplicateDeviceWithAttributes applies the attributes to the new device node
+// before returning, see DeviceNodeAttributes
+func DuplicateDeviceWithAttributes(dev *KernelDevice, dest string, attrs *DeviceNodeAttributes) error {
 	if err := mknod(dest, dev.Major, dev.Minor); err != nil {
 		return fmt.Errorf("Cannot create device node %s for device %s", dest, dev.Name)
 	}
 	if err := os.Chmod(dest, 0660); err != nil {
 		return fmt.Errorf("Couldn't change permission of the device %s: %s", dest, err)
 	}
-	return nil
+	return ApplyDeviceNodeAttributes(dest, attrs)
 }
 
 func mknod(device string, major, minor int) error {
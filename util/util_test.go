@@ -1,7 +1,10 @@
 package util
 
 import (
+	"errors"
+	"strings"
 	"testing"
+	"time"
 
 	. "gopkg.in/check.v1"
 )
@@ -53,3 +56,159 @@ func (s *TestSuite) TestFindDockerdProcess(c *C) {
 	c.Assert(err, NotNil)
 	c.Assert(ps, IsNil)
 }
+
+func (s *TestSuite) TestCalculateIOStats(c *C) {
+	prev, err := parseBlockStat("     100        0     1600      100      200        0     3200      400        0      500      500")
+	c.Assert(err, IsNil)
+	cur, err := parseBlockStat("     300        0     5600      300      200        0     3200      400        2      900      900        0        0        0        0")
+	c.Assert(err, IsNil)
+
+	stats := calculateIOStats("sdb", prev, cur, 2*time.Second)
+	c.Assert(stats.ReadIOPS, Equals, float64(100))
+	c.Assert(stats.WriteIOPS, Equals, float64(0))
+	c.Assert(stats.ReadBytesPerSec, Equals, float64(4000*512/2))
+	c.Assert(stats.ReadLatency, Equals, time.Millisecond)
+	c.Assert(stats.WriteLatency, Equals, time.Duration(0))
+	c.Assert(stats.InFlightRequests, Equals, uint64(2))
+
+	_, err = parseBlockStat("1 2 3")
+	c.Assert(err, NotNil)
+}
+
+func (s *TestSuite) TestParseUevent(c *C) {
+	msg := "add@/devices/platform/host3/session1/target3:0:0/3:0:0:1/block/sdb\x00" +
+		"ACTION=add\x00DEVPATH=/devices/platform/host3/session1/target3:0:0/3:0:0:1/block/sdb\x00" +
+		"SUBSYSTEM=block\x00MAJOR=8\x00MINOR=16\x00DEVNAME=sdb\x00DEVTYPE=disk\x00SEQNUM=4242\x00"
+	event, err := parseUevent([]byte(msg))
+	c.Assert(err, IsNil)
+	c.Assert(event.Action, Equals, UeventActionAdd)
+	c.Assert(event.Subsystem, Equals, "block")
+	c.Assert(event.DevName, Equals, "sdb")
+	c.Assert(event.Env["MAJOR"], Equals, "8")
+
+	_, err = parseUevent([]byte("libudev\x00garbage"))
+	c.Assert(err, NotNil)
+}
+
+func (s *TestSuite) TestParseDeviceMounts(c *C) {
+	output := `/proc/self/mountinfo:22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+/proc/self/mountinfo:36 22 8:16 / /var/lib/data rw,relatime shared:2 - ext4 /dev/sdb rw
+/proc/1/mountinfo:36 22 8:16 / /var/lib/data rw,relatime shared:2 - ext4 /dev/sdb rw
+/proc/2371/mountinfo:512 480 253:0 / /mnt/crypt\040vol rw - xfs /dev/mapper/crypt-vol rw
+/proc/2371/mountinfo:513 480 8:160 / /mnt/other rw - ext4 /dev/sdk rw
+`
+	numbers := map[string]struct{}{"8:16": {}, "253:0": {}}
+	mounts := parseDeviceMounts(output, numbers)
+	c.Assert(mounts, HasLen, 2)
+	c.Assert(*mounts[0], DeepEquals, DeviceMount{Device: "8:16", MountPoint: "/var/lib/data", Local: true})
+	c.Assert(*mounts[1], DeepEquals, DeviceMount{Device: "253:0", MountPoint: "/mnt/crypt vol", Local: false})
+}
+
+func (s *TestSuite) TestParseOpeners(c *C) {
+	output := `/proc/123/fd/4 8 10
+/proc/123/fd/5 fd 0
+/proc/45/fd/0 8 10
+/proc/46/fd/0 8 0
+`
+	numbers := map[string]struct{}{"8:16": {}, "253:0": {}}
+	c.Assert(parseOpeners(output, numbers), DeepEquals, []string{"123", "45"})
+	c.Assert(parseOpeners("", numbers), HasLen, 0)
+}
+
+func (s *TestSuite) TestFaultInjector(c *C) {
+	faults := NewCommandFaults(
+		&CommandFault{Command: "true", Args: []string{"fail"}, ExitCode: 21, Count: 1},
+		&CommandFault{Command: "true", Args: []string{"timeout"}, Timeout: true},
+	)
+	restore := SetFaultInjector(faults)
+	defer restore()
+
+	_, err := Execute("true", []string{"fail"})
+	c.Assert(err, NotNil)
+	c.Assert(strings.Contains(err.Error(), "exit status 21"), Equals, true)
+	// The fault is injected once only
+	_, err = Execute("true", []string{"fail"})
+	c.Assert(err, IsNil)
+
+	_, err = Execute(NSBinary, []string{"--mount=/proc/1/ns/mnt", "true", "timeout"})
+	c.Assert(err, NotNil)
+	c.Assert(strings.HasPrefix(err.Error(), "Timeout executing: "), Equals, true)
+
+	_, err = Execute("true", []string{"other"})
+	c.Assert(err, IsNil)
+	c.Assert(faults.Injected, HasLen, 2)
+}
+
+func (s *TestSuite) TestValidateArgument(c *C) {
+	c.Assert(ValidateArgument("name", "pvc-1234_vol.0"), IsNil)
+	c.Assert(ValidateArgument("name", "/var/lib/longhorn/volume-head-000.img"), IsNil)
+	c.Assert(ValidateArgument("name", "bsoflags=sync:direct"), IsNil)
+	c.Assert(ValidateArgument("name", "/mnt/data [1]/~backup#2/disk*.img"), IsNil)
+	c.Assert(ValidateArgument("name", "iqn.2019-10.io.longhorn:vol{1}!"), IsNil)
+
+	for _, value := range []string{"vol\n", "vol\x00", "vol\x7f"} {
+		err := ValidateArgument("name", value)
+		c.Assert(err, NotNil)
+		c.Assert(errors.Is(err, ErrInvalidArgument), Equals, true)
+	}
+
+	_, err := Execute("echo", []string{"a\nb"})
+	c.Assert(errors.Is(err, ErrInvalidArgument), Equals, true)
+
+	for _, value := range []string{"it's $HOME", "vol;reboot", "$(id)", "a|b `id` *"} {
+		output, err := Execute("sh", []string{"-c", "echo " + ShellQuote(value)})
+		c.Assert(err, IsNil)
+		c.Assert(output, Equals, value+"\n")
+	}
+}
+
+func (s *TestSuite) TestParseFlockHolders(c *C) {
+	output := `1: -> FLOCK  ADVISORY  WRITE 2380 00:2e:1048611 0 EOF
+2: POSIX  ADVISORY  WRITE 812 00:2e:1048611 0 EOF
+3: FLOCK  ADVISORY  WRITE 0 fd:01:2359301 0 EOF
+`
+	c.Assert(parseFlockHolders(output, 1048611), HasLen, 0)
+	c.Assert(parseFlockHolders(output, 2359301), DeepEquals, []int{0})
+	c.Assert(parseFlockHolders("4: FLOCK  ADVISORY  WRITE 2371 00:2e:1048611 0 EOF\n", 1048611), DeepEquals, []int{2371})
+}
+
+func (s *TestSuite) TestGetOwnerArg(c *C) {
+	uid, gid, root := 1000, 100, 0
+	c.Assert(getOwnerArg(&uid, &gid), Equals, "1000:100")
+	c.Assert(getOwnerArg(&uid, nil), Equals, "1000")
+	c.Assert(getOwnerArg(nil, &gid), Equals, ":100")
+	c.Assert(getOwnerArg(&root, &root), Equals, "0:0")
+	c.Assert(getOwnerArg(nil, nil), Equals, "")
+}
+
+func (s *TestSuite) TestParseIOMax(c *C) {
+	output := `8:0 rbps=max wbps=max riops=100 wiops=max
+8:16 rbps=2097152 wbps=max riops=max wiops=120
+`
+	limits, err := parseIOMax(output, 8, 16)
+	c.Assert(err, IsNil)
+	c.Assert(*limits, Equals, IOLimits{ReadBPS: 2097152, WriteIOPS: 120})
+	c.Assert(limits.String(), Equals, "rbps=2097152 wbps=max riops=max wiops=120")
+
+	limits, err = parseIOMax(output, 8, 32)
+	c.Assert(err, IsNil)
+	c.Assert(*limits, Equals, IOLimits{})
+
+	_, err = parseIOMax("8:16 rbps=abc", 8, 16)
+	c.Assert(err, NotNil)
+}
+
+func (s *TestSuite) TestPrepareCommandArgs(c *C) {
+	ne := &NamespaceExecutor{ns: "/host/proc/1/ns"}
+	c.Assert(ne.prepareCommandArgs("iscsiadm", []string{"-m", "session"}), DeepEquals,
+		[]string{"--mount=/host/proc/1/ns/mnt", "--net=/host/proc/1/ns/net", "iscsiadm", "-m", "session"})
+
+	ne.netNS = "/var/run/netns/storage"
+	c.Assert(ne.prepareCommandArgs("iscsiadm", []string{"-m", "session"}), DeepEquals,
+		[]string{"--mount=/host/proc/1/ns/mnt", "--net=/var/run/netns/storage", "iscsiadm", "-m", "session"})
+
+	ne = &NamespaceExecutor{netNS: "/var/run/netns/storage"}
+	c.Assert(ne.isLocal(), Equals, false)
+	c.Assert(ne.prepareCommandArgs("ip", []string{"addr"}), DeepEquals,
+		[]string{"--net=/var/run/netns/storage", "ip", "addr"})
+}
@@ -0,0 +1,44 @@
+package vhostdev
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// DeviceSchemaVersion is the version of the serialized Device
+const DeviceSchemaVersion = 1
+
+type deviceV1 struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Name          string `json:"name"`
+	BackingFile   string `json:"backingFile"`
+	ReadOnly      bool   `json:"readOnly,omitempty"`
+	SocketPath    string `json:"socketPath,omitempty"`
+}
+
+func (dev *Device) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&deviceV1{
+		SchemaVersion: DeviceSchemaVersion,
+		Name:          dev.Name,
+		BackingFile:   dev.BackingFile,
+		ReadOnly:      dev.ReadOnly,
+		SocketPath:    dev.SocketPath,
+	})
+}
+
+func (dev *Device) UnmarshalJSON(data []byte) error {
+	v1 := &deviceV1{}
+	if err := json.Unmarshal(data, v1); err != nil {
+		return err
+	}
+	if v1.SchemaVersion != DeviceSchemaVersion {
+		return fmt.Errorf("unsupported vhost-user-blk device schema version %v", v1.SchemaVersion)
+	}
+	*dev = Device{
+		Name:        v1.Name,
+		BackingFile: v1.BackingFile,
+		ReadOnly:    v1.ReadOnly,
+		SocketPath:  v1.SocketPath,
+	}
+	return nil
+}
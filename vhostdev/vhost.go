@@ -0,0 +1,118 @@
+package vhostdev
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/go-iscsi-helper/spdk"
+)
+
+var (
+	SPDKSocketPath = spdk.DefaultSocketPath
+
+	// SocketDirectory must match the vhost socket directory of the SPDK
+	// application, which is set by its -S option
+	SocketDirectory = "/var/tmp"
+)
+
+// Device exposes a backing file to the VMs through vhost-user-blk, so the VMs
+// can attach the volume without going through the iSCSI stack of the host
+// kernel
+type Device struct {
+	Name        string
+	BackingFile string
+	ReadOnly    bool
+
+	// SocketPath is the vhost-user socket to be passed to the VMM, available
+	// after the device is started
+	SocketPath string
+}
+
+func NewDevice(name, backingFile string, readOnly bool) (*Device, error) {
+	if name == "" || backingFile == "" {
+		return nil, fmt.Errorf("invalid parameter for creating vhost-user-blk device")
+	}
+	return &Device{
+		Name:        name,
+		BackingFile: backingFile,
+		ReadOnly:    readOnly,
+	}, nil
+}
+
+func (dev *Device) getBdevName() string {
+	return "vhost-" + dev.Name
+}
+
+// Start creates the bdev and the vhost-user-blk controller in the SPDK
+// application. It's no-op if the controller already exists, e.g. created
+// before the restart of the caller.
+func (dev *Device) Start() error {
+	client := spdk.NewClient(SPDKSocketPath)
+
+	ctrlr, err := dev.getController(client)
+	if err != nil {
+		return err
+	}
+	if ctrlr != nil {
+		dev.SocketPath = filepath.Join(SocketDirectory, dev.Name)
+		return nil
+	}
+
+	bdev := dev.getBdevName()
+	if err := client.CreateAioBdev(bdev, dev.BackingFile, spdk.DefaultBlockSize); err != nil {
+		return err
+	}
+	if err := client.CreateVhostBlkController(dev.Name, bdev, dev.ReadOnly); err != nil {
+		if deleteErr := client.DeleteAioBdev(bdev); deleteErr != nil {
+			logrus.Warnf("Failed to cleanup SPDK bdev %v: %v", bdev, deleteErr)
+		}
+		return err
+	}
+	dev.SocketPath = filepath.Join(SocketDirectory, dev.Name)
+	logrus.Infof("go-iscsi-helper: vhost-user-blk device %v created at %v", dev.Name, dev.SocketPath)
+	return nil
+}
+
+// Stop removes the vhost-user-blk controller and the bdev. It's no-op for the
+// parts don't exist.
+func (dev *Device) Stop() error {
+	client := spdk.NewClient(SPDKSocketPath)
+
+	ctrlr, err := dev.getController(client)
+	if err != nil {
+		return err
+	}
+	if ctrlr != nil {
+		if err := client.DeleteVhostController(dev.Name); err != nil {
+			return err
+		}
+	}
+	bdev, err := client.GetBdev(dev.getBdevName())
+	if err != nil {
+		return err
+	}
+	if bdev != nil {
+		if err := client.DeleteAioBdev(bdev.Name); err != nil {
+			return err
+		}
+	}
+	dev.SocketPath = ""
+	logrus.Infof("go-iscsi-helper: vhost-user-blk device %v shutdown", dev.Name)
+	return nil
+}
+
+// getController returns nil if the controller of the device doesn't exist
+func (dev *Device) getController(client *spdk.Client) (*spdk.VhostController, error) {
+	ctrlrs, err := client.GetVhostControllers()
+	if err != nil {
+		return nil, err
+	}
+	for i := range ctrlrs {
+		if ctrlrs[i].Ctrlr == dev.Name {
+			return &ctrlrs[i], nil
+		}
+	}
+	return nil, nil
+}